@@ -41,6 +41,7 @@ func init() {
 	flag.StringVar(&conf.NodeID, "nodeid", "", "node id")
 	flag.BoolVar(&conf.IsControllerServer, "controller", false, "Start controller server")
 	flag.BoolVar(&conf.IsNodeServer, "node", false, "Start node server")
+	flag.StringVar(&conf.MetricsAddress, "metrics-address", "", "Address to serve prometheus metrics at /metrics, e.g. :9811, disabled if empty")
 
 	klog.InitFlags(nil)
 	if err := flag.Set("logtostderr", "true"); err != nil {
@@ -0,0 +1,34 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CSI rpc metrics, recorded by logGRPC interceptor
+var (
+	csiOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "spdkcsi_csi_operations_total",
+		Help: "CSI rpc calls per method and grpc status code.",
+	}, []string{"method", "code"})
+	csiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "spdkcsi_csi_operation_duration_seconds",
+		Help: "Latency of CSI rpc calls per method.",
+	}, []string{"method"})
+)
@@ -20,10 +20,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 )
 
@@ -72,7 +74,10 @@ func NewControllerServiceCapability(captype csi.ControllerServiceCapability_RPC_
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
 	klog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	csiDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	csiOperations.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
 	if err != nil {
 		klog.Errorf("GRPC error: %v", err)
 	} else {
@@ -18,11 +18,18 @@ package spdk
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -34,33 +41,125 @@ import (
 
 var errVolumeInCreation = status.Error(codes.Internal, "volume in creation")
 
+// placeholder of volume id in volumesIdem while the volume is in creation
+const creatingTag = "__CREATING__"
+
+// StorageClass parameters
+const (
+	paramThinProvision  = "thinProvision"
+	paramClearMethod    = "clearMethod"
+	paramLvstore        = "lvstore"
+	paramSpdkNode       = "spdkNode"
+	paramSchedulePolicy = "schedulePolicy"
+	// qos limits, also mutable per volume
+	paramRWIOsPerSec    = "rwIosPerSec"
+	paramRWMBytesPerSec = "rwMBytesPerSec"
+	paramRMBytesPerSec  = "rMBytesPerSec"
+	paramWMBytesPerSec  = "wMBytesPerSec"
+	// encryption at rest, see keyprovider.go
+	paramEncryption  = "encryption"
+	paramKeyProvider = "keyProvider"
+)
+
+// lvol names are derived from CO provided names, so volumes and snapshots
+// can be found on spdk nodes after controller restart
+const (
+	lvolPrefix      = "csi-"
+	snapshotPrefix  = "csi-snap-"
+	clonePrefix     = "csi-clone-" // hidden snapshot backing a volume cloned from another volume
+	encryptedPrefix = "csi-enc-"   // volume exported only through crypto bdev
+)
+
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
 
-	spdkNodes []util.SpdkNode // all spdk nodes in cluster
+	spdkNodes   []*storageNode      // all spdk nodes in cluster, replaced on config reload
+	mtxNodes    sync.RWMutex        // protect spdkNodes slice
+	nodeWatcher *storageNodeWatcher // nil if storage node resources are not used
+
+	keyProviders    map[string]keyProvider // key provider name to key provider
+	schedulers      map[string]scheduler   // schedule policy to scheduler
+	schedulePolicy  string                 // default schedule policy
+	iostatInterval  time.Duration          // interval to collect volume iostat, 0 if disabled
+	reservations    map[lvstoreKey]int64   // space in MiB reserved by volumes in creation
+	reservedVolumes map[lvstoreKey]int     // number of volumes in creation
+	mtxReservation  sync.Mutex             // protect reservations and reservedVolumes map
 
 	volumes       map[string]*volume      // volume id to volume struct
-	volumesIdem   map[string]string       // volume name to id, for CreateVolume idempotency
-	mtx           sync.Mutex              // protect volumes and volumesIdem map
-	snapshotsIdem map[string]csi.Snapshot // snapshot id to csi.Snapshot struct
+	volumesIdem   map[string]string       // lvol name to id, for CreateVolume idempotency
+	placements    map[string]*storageNode // lvol name to spdk node of volume in creation, see placeVolume
+	mtx           sync.Mutex              // protect volumes, volumesIdem and placements map, and published nodes of volumes
+	snapshotsIdem map[string]*snapshot    // snapshot id to snapshot struct
 	mtxSnapshot   sync.RWMutex            // protect snapshotsIdem map
 }
 
+// spdk node and its topology segments, node without topology is accessible
+// from all nodes in cluster
+type storageNode struct {
+	util.SpdkNode
+	name     string
+	topology map[string]string
+	weight   int          // relative weight in weighted schedule policy
+	mtx      sync.RWMutex // protect topology and weight, changed in place on config reload
+	// config and rpc token the node is created from, compared on reload
+	config       spdkNodeConfig
+	token        rpcToken
+	refused      *spdkNodeConfig // last connection change not applied as node hosts volumes
+	refusedPaths *spdkNodeConfig // last multipath change failed to apply
+	maintenance  atomic.Bool     // see spdkNodeConfig
+	health       nodeHealth      // see health.go
+}
+
 type volume struct {
-	name      string // CO provided volume name
-	spdkNode  util.SpdkNode
+	name      string // lvol name, derived from CO provided volume name
+	lvstore   string
+	spdkNode  *storageNode
 	csiVolume csi.Volume
-	mtx       sync.Mutex // per volume lock to serialize DeleteVolume requests
+	mtx       sync.Mutex // per volume lock to serialize DeleteVolume/ControllerExpandVolume/ControllerPublishVolume requests
+	// hidden snapshot this volume is cloned from, deleted together with the volume
+	cloneSnapshotID string
+	// nodes the volume is attached to per ControllerPublishVolume, more than
+	// one in multi-node access modes, not persisted, CO re-publishes
+	// attached volumes after controller restart
+	publishedNodes []string
+	// pvc of volume from CreateVolume parameters, labels volume iostat. For
+	// volumes restored after controller restart, it's looked up from claim
+	// of PersistentVolume, see resolvePVCs
+	pvcName      string
+	pvcNamespace string
+	pvcResolved  bool
+	// crypto bdev of encrypted volume is lost after spdk target restarts, the
+	// volume is not published until it's re-created with key from the key
+	// provider of the volume
+	keyLost bool
+}
+
+// provisioning parameters from StorageClass
+type volumeParams struct {
+	lvolOptions    util.LvolOptions
+	schedulePolicy string // overrides default schedule policy
+	lvstore        string // pin volume to lvstore of this name
+	spdkNode       string // pin volume to spdk node of this name in config map
+	qos            util.QosLimits
+	keyProvider    string // encrypt volume with key from this provider, empty if not encrypted
+}
+
+type snapshot struct {
+	name        string // lvol name, derived from CO provided snapshot name
+	lvstore     string
+	spdkNode    *storageNode
+	csiSnapshot csi.Snapshot
 }
 
 func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	lvolName := volumeLvolName(req.Name)
+
 	// be idempotent to duplicated requests
 	volume, err := func() (*volume, error) {
-		const creatingTag = "__CREATING__"
 		cs.mtx.Lock()
 		defer cs.mtx.Unlock()
 
-		volumeID, exists := cs.volumesIdem[req.Name]
+		volumeID, exists := cs.volumesIdem[lvolName]
 		if exists {
 			// this is a duplicated request
 			if volumeID == creatingTag {
@@ -73,7 +172,7 @@ func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolum
 			return volume, nil
 		}
 		// we're processing the first request
-		cs.volumesIdem[req.Name] = creatingTag
+		cs.volumesIdem[lvolName] = creatingTag
 		return nil, nil
 	}()
 	if err != nil {
@@ -87,34 +186,39 @@ func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolum
 	defer func() {
 		if err != nil {
 			cs.mtx.Lock()
-			delete(cs.volumesIdem, req.Name)
+			delete(cs.volumesIdem, lvolName)
+			delete(cs.placements, lvolName)
 			cs.mtx.Unlock()
 		}
 	}()
 
 	volume, err = cs.createVolume(req)
 	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	volumeInfo, err := publishVolume(volume)
 	if err != nil {
-		deleteVolume(volume) //nolint:errcheck // we can do little
+		discardVolume(volume)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	// copy volume info. node needs these info to contact target(ip, port, nqn, ...)
-	if volume.csiVolume.VolumeContext == nil {
-		volume.csiVolume.VolumeContext = volumeInfo
-	} else {
-		for k, v := range volumeInfo {
-			volume.csiVolume.VolumeContext[k] = v
-		}
+	for k, v := range volumeInfo {
+		volume.csiVolume.VolumeContext[k] = v
 	}
 
+	volume.pvcName = req.GetParameters()[paramPVCName]
+	volume.pvcNamespace = req.GetParameters()[paramPVCNamespace]
+	volume.pvcResolved = true
+
 	volumeID := volume.csiVolume.GetVolumeId()
 	cs.mtx.Lock()
 	cs.volumes[volumeID] = volume
-	cs.volumesIdem[req.Name] = volumeID
+	cs.volumesIdem[lvolName] = volumeID
+	delete(cs.placements, lvolName)
 	cs.mtx.Unlock()
 
 	return &csi.CreateVolumeResponse{Volume: &volume.csiVolume}, nil
@@ -159,10 +263,24 @@ func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// no clone depends on the hidden snapshot now
+	if volume.cloneSnapshotID != "" {
+		err = volume.spdkNode.DeleteVolume(volume.cloneSnapshotID)
+		if errors.Is(err, util.ErrJSONNoSuchDevice) {
+			klog.Warningf("clone snapshot not exists: %s", volume.cloneSnapshotID)
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if isEncrypted(volume) {
+		cs.deleteVolumeKey(volume.name)
+	}
+
 	// no harm if volumeID already deleted
 	cs.mtx.Lock()
 	delete(cs.volumes, volumeID)
-	delete(cs.volumesIdem, volume.name)
+	delete(cs.volumesIdem, volumeIdemName(volume.name))
 	cs.mtx.Unlock()
 
 	return &csi.DeleteVolumeResponse{}, nil
@@ -171,6 +289,10 @@ func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	// make sure we support all requested caps
 	for _, cap := range req.VolumeCapabilities {
+		// both filesystem and raw block volumes are supported
+		if cap.GetMount() == nil && cap.GetBlock() == nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: ""}, nil
+		}
 		supported := false
 		for _, accessMode := range cs.Driver.GetVolumeCapabilityAccessModes() {
 			if cap.GetAccessMode().GetMode() == accessMode.GetMode() {
@@ -181,6 +303,9 @@ func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 		if !supported {
 			return &csi.ValidateVolumeCapabilitiesResponse{Message: ""}, nil
 		}
+		if err := checkMultiNodeWriter(cap); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
@@ -189,24 +314,330 @@ func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 	}, nil
 }
 
+func isMultiNode(cap *csi.VolumeCapability) bool {
+	switch cap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	default:
+		return false
+	}
+}
+
+// filesystems cannot be mounted on several nodes for write, only raw block
+// volumes are shared by multiple writers, e.g. clustered databases
+func checkMultiNodeWriter(cap *csi.VolumeCapability) error {
+	if isMultiNode(cap) && cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY &&
+		cap.GetBlock() == nil {
+		return fmt.Errorf("access mode %s is only supported by raw block volumes", cap.GetAccessMode().GetMode())
+	}
+	return nil
+}
+
 func (cs *controllerServer) ControllerGetVolume(_ context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 
 	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
 	volume, exists := cs.volumes[volumeID]
-	cs.mtx.Unlock()
 	if !exists {
 		errMsg := fmt.Sprintf("volume does not exist: %s", volumeID)
 		klog.Warningf(errMsg)
 		return &csi.ControllerGetVolumeResponse{}, status.Error(codes.NotFound, errMsg)
 	}
 
-	return &csi.ControllerGetVolumeResponse{Volume: &volume.csiVolume}, nil
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &volume.csiVolume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: append([]string(nil), volume.publishedNodes...),
+			VolumeCondition:  volume.condition(),
+		},
+	}, nil
+}
+
+func (cs *controllerServer) ControllerPublishVolume(_ context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	if volumeID == "" || nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and node id must be provided")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability must be provided")
+	}
+	err := checkMultiNodeWriter(req.GetVolumeCapability())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// controller publish secrets of StorageClass
+	creds, err := util.CredentialsFromSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	cs.mtx.Lock()
+	volume, exists := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume does not exist: %s", volumeID)
+	}
+
+	// serialize requests to same volume by holding volume lock
+	volume.mtx.Lock()
+	defer volume.mtx.Unlock()
+
+	err = cs.recoverEncryptedVolume(volume, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mtx.Lock()
+	publishedNodes := volume.publishedNodes
+	cs.mtx.Unlock()
+	// node published with previous node id is allowed again with its new id
+	otherNodes := make([]string, 0, len(publishedNodes))
+	var replacedNodes []string
+	for _, publishedNode := range publishedNodes {
+		if publishedNode == nodeID {
+			// already published to this node
+			return &csi.ControllerPublishVolumeResponse{}, nil
+		}
+		if util.SameNode(publishedNode, nodeID) {
+			replacedNodes = append(replacedNodes, publishedNode)
+		} else {
+			otherNodes = append(otherNodes, publishedNode)
+		}
+	}
+	// volume is attached to more nodes only in multi-node access modes, the
+	// subsystem stays published and hosts are allowed one by one
+	if len(otherNodes) > 0 && !isMultiNode(req.GetVolumeCapability()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already published to node %s", volumeID, otherNodes[0])
+	}
+
+	// node id reported by NodeGetInfo carries host nqn and initiator name
+	_, host := util.DecodeNodeID(nodeID)
+	err = volume.spdkNode.AllowHost(volumeID, host, creds)
+	if errors.Is(err, util.ErrHostIDRequired) {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s: %s", nodeID, err)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// revoke access granted to the node with its previous host id
+	for _, replacedNode := range replacedNodes {
+		err = disallowNode(volume, volumeID, replacedNode, append(otherNodes, nodeID))
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	cs.mtx.Lock()
+	volume.publishedNodes = append(otherNodes, nodeID)
+	cs.mtx.Unlock()
+
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ControllerUnpublishVolume(_ context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be provided")
+	}
+
+	cs.mtx.Lock()
+	volume, exists := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		// already deleted?
+		klog.Warningf("volume not exists: %s", volumeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	volume.mtx.Lock()
+	defer volume.mtx.Unlock()
+
+	// empty node id means unpublish from all nodes
+	nodeID := req.GetNodeId()
+	cs.mtx.Lock()
+	unpublishNodes := append([]string(nil), volume.publishedNodes...)
+	cs.mtx.Unlock()
+	if nodeID != "" {
+		// published nodes are lost after controller restart, always revoke
+		// access of the requested node
+		unpublishNodes = []string{nodeID}
+	}
+
+	cs.mtx.Lock()
+	publishedNodes := make([]string, 0, len(volume.publishedNodes))
+	for _, publishedNode := range volume.publishedNodes {
+		if nodeID == "" {
+			continue
+		}
+		if util.SameNode(publishedNode, nodeID) {
+			if publishedNode != nodeID {
+				unpublishNodes = append(unpublishNodes, publishedNode)
+			}
+		} else {
+			publishedNodes = append(publishedNodes, publishedNode)
+		}
+	}
+	cs.mtx.Unlock()
+
+	for _, unpublishNode := range unpublishNodes {
+		err := disallowNode(volume, volumeID, unpublishNode, publishedNodes)
+		if errors.Is(err, util.ErrVolumeUnpublished) || errors.Is(err, util.ErrVolumeDeleted) {
+			klog.Warningf("volume not published: %s", volumeID)
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	cs.mtx.Lock()
+	volume.publishedNodes = publishedNodes
+	cs.mtx.Unlock()
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// revokes access of the node to the volume, unless its host is shared by
+// remaining published nodes, e.g. empty host id of nodes published by older
+// releases, which is any host access of the whole subsystem or target node
+func disallowNode(volume *volume, volumeID, nodeID string, remainingNodes []string) error {
+	_, host := util.DecodeNodeID(nodeID)
+	for _, remainingNode := range remainingNodes {
+		if _, remainingHost := util.DecodeNodeID(remainingNode); remainingHost == host {
+			klog.Infof("host of node %s kept for other nodes: %s", nodeID, volumeID)
+			return nil
+		}
+	}
+	return volume.spdkNode.DisallowHost(volumeID, host)
+}
+
+// ControllerModifyVolume retunes qos limits of a volume live per mutable
+// parameters of VolumeAttributesClass, limits not present are kept
+func (cs *controllerServer) ControllerModifyVolume(_ context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be provided")
+	}
+	mutableParameters := req.GetMutableParameters()
+	err := checkMutableParameters(mutableParameters)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mtx.Lock()
+	volume, exists := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume does not exist: %s", volumeID)
+	}
+
+	volume.mtx.Lock()
+	defer volume.mtx.Unlock()
+
+	// current limits are reflected in volume context
+	var qos util.QosLimits
+	err = parseQos(volume.csiVolume.GetVolumeContext(), &qos)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "corrupted qos of volume %s: %s", volumeID, err.Error())
+	}
+	err = parseQos(mutableParameters, &qos)
+	if err != nil {
+		return nil, err
+	}
+
+	err = volume.spdkNode.SetQos(volumeID, qos)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if volume.csiVolume.VolumeContext == nil {
+		volume.csiVolume.VolumeContext = make(map[string]string)
+	}
+	setQosContext(volume.csiVolume.VolumeContext, qos)
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ListVolumes(_ context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries: %d", req.GetMaxEntries())
+	}
+
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	volumeIDs := make([]string, 0, len(cs.volumes))
+	for volumeID := range cs.volumes {
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+	sort.Strings(volumeIDs)
+
+	start, end, nextToken, err := paginate(len(volumeIDs), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, volumeID := range volumeIDs[start:end] {
+		volume := cs.volumes[volumeID]
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &volume.csiVolume,
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: append([]string(nil), volume.publishedNodes...),
+				VolumeCondition:  volume.condition(),
+			},
+		})
+	}
+	return &csi.ListVolumesResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+func (cs *controllerServer) ControllerExpandVolume(_ context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+
+	cs.mtx.Lock()
+	volume, exists := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume does not exist: %s", volumeID)
+	}
+
+	sizeMiB := util.ToMiB(req.GetCapacityRange().GetRequiredBytes())
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if limitBytes != 0 && sizeMiB*1024*1024 > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange, "volume size %d MiB exceeds limit %d bytes", sizeMiB, limitBytes)
+	}
+
+	// serialize requests to same volume by holding volume lock
+	volume.mtx.Lock()
+	defer volume.mtx.Unlock()
+
+	err := cs.recoverEncryptedVolume(volume, req.GetSecrets())
+	if err != nil && status.Code(err) != codes.FailedPrecondition {
+		return nil, err
+	}
+
+	// no harm if volume already expanded
+	if sizeMiB*1024*1024 > volume.csiVolume.GetCapacityBytes() {
+		err = resizeVolume(volume, sizeMiB)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes: volume.csiVolume.GetCapacityBytes(),
+		// raw block volume has no filesystem to grow, but initiator must
+		// rescan the device to see new size
+		NodeExpansionRequired: true,
+	}, nil
 }
 
 func (cs *controllerServer) CreateSnapshot(_ context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	lvolID := req.GetSourceVolumeId()
-	snapshotName := req.GetName()
+	idemName := snapshotIdemName(req.GetName())
 
 	cs.mtx.Lock()
 	volume, exists := cs.volumes[lvolID]
@@ -215,31 +646,48 @@ func (cs *controllerServer) CreateSnapshot(_ context.Context, req *csi.CreateSna
 		klog.Warningf("volume does not exist: %s", lvolID)
 		return &csi.CreateSnapshotResponse{}, status.Error(codes.Internal, "snapshot source volume does not exist")
 	}
+	// snapshot holds ciphertext, and clones cannot be decrypted
+	if isEncrypted(volume) {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot of encrypted volume is not supported: %s", lvolID)
+	}
 
 	cs.mtxSnapshot.RLock()
-	if exSnap, ok := cs.snapshotsIdem[snapshotName]; ok {
-		cs.mtxSnapshot.RUnlock()
-		if exSnap.SourceVolumeId == lvolID {
+	var exSnap *snapshot
+	for _, snap := range cs.snapshotsIdem {
+		if name, _, _ := parseSnapshotLvolName(snap.name); name == idemName {
+			exSnap = snap
+			break
+		}
+	}
+	cs.mtxSnapshot.RUnlock()
+	if exSnap != nil {
+		if exSnap.csiSnapshot.SourceVolumeId == lvolID {
 			return &csi.CreateSnapshotResponse{
-				Snapshot: &exSnap,
+				Snapshot: &exSnap.csiSnapshot,
 			}, nil
 		}
-		return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name: %s but with different SourceVolumeId already exists", snapshotName)
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name: %s but with different SourceVolumeId already exists", req.GetName())
 	}
-	cs.mtxSnapshot.RUnlock()
 
+	// in seconds as recorded in lvol name
+	creationTime := time.Now().Truncate(time.Second)
+	snapshotName := snapshotLvolName(req.GetName(), lvolID, creationTime)
 	snapshotID, err := volume.spdkNode.CreateSnapshot(lvolID, snapshotName)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	creationTime := timestamppb.Now()
-	snapshotData := csi.Snapshot{
-		SizeBytes:      volume.csiVolume.GetCapacityBytes(),
-		SnapshotId:     snapshotID,
-		SourceVolumeId: lvolID,
-		CreationTime:   creationTime,
-		ReadyToUse:     true,
+	snapshotData := &snapshot{
+		name:     snapshotName,
+		lvstore:  volume.lvstore,
+		spdkNode: volume.spdkNode,
+		csiSnapshot: csi.Snapshot{
+			SizeBytes:      volume.csiVolume.GetCapacityBytes(),
+			SnapshotId:     snapshotID,
+			SourceVolumeId: lvolID,
+			CreationTime:   timestamppb.New(creationTime),
+			ReadyToUse:     true,
+		},
 	}
 
 	cs.mtxSnapshot.Lock()
@@ -247,7 +695,7 @@ func (cs *controllerServer) CreateSnapshot(_ context.Context, req *csi.CreateSna
 	cs.mtxSnapshot.Unlock()
 
 	return &csi.CreateSnapshotResponse{
-		Snapshot: &snapshotData,
+		Snapshot: &snapshotData.csiSnapshot,
 	}, nil
 }
 
@@ -261,16 +709,8 @@ func (cs *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSna
 		return &csi.DeleteSnapshotResponse{}, status.Error(codes.Internal, "snapshot does not exist")
 	}
 
-	sourceVolumeID := exSnap.SourceVolumeId
-	cs.mtx.Lock()
-	volume, exists := cs.volumes[sourceVolumeID]
-	cs.mtx.Unlock()
-	if !exists {
-		klog.Warningf("sourceVolume does not exist: %s", sourceVolumeID)
-		return &csi.DeleteSnapshotResponse{}, status.Error(codes.Internal, "snapshot source volume does not exist")
-	}
-
-	err := volume.spdkNode.DeleteVolume(snapshotID)
+	// snapshot outlives its source volume, delete it from the node it lives on
+	err := exSnap.spdkNode.DeleteVolume(snapshotID)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -282,147 +722,1126 @@ func (cs *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSna
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*volume, error) {
-	size := req.GetCapacityRange().GetRequiredBytes()
-	if size == 0 {
-		klog.Warningln("invalid volume size, resize to 1G")
-		size = 1024 * 1024 * 1024
+func (cs *controllerServer) ListSnapshots(_ context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries: %d", req.GetMaxEntries())
 	}
-	sizeMiB := util.ToMiB(size)
 
-	// schedule suitable node:lvstore
-	spdkNode, lvstore, err := cs.schedule(sizeMiB)
-	if err != nil {
-		return nil, err
-	}
+	snapshots := cs.listSnapshots()
 
-	// TODO: re-schedule on ErrJSONNoSpaceLeft per optimistic concurrency control
-	volumeID, err := spdkNode.CreateVolume(lvstore, sizeMiB)
-	if err != nil {
-		return nil, err
+	var snapshotIDs []string
+	for snapshotID, csiSnapshot := range snapshots {
+		if req.GetSnapshotId() != "" && snapshotID != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && csiSnapshot.GetSourceVolumeId() != req.GetSourceVolumeId() {
+			continue
+		}
+		snapshotIDs = append(snapshotIDs, snapshotID)
 	}
+	sort.Strings(snapshotIDs)
 
-	return &volume{
-		name:     req.Name,
-		spdkNode: spdkNode,
-		csiVolume: csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: sizeMiB * 1024 * 1024,
-			VolumeContext: req.GetParameters(),
-			ContentSource: req.GetVolumeContentSource(),
-		},
-	}, nil
-}
-
-func publishVolume(volume *volume) (map[string]string, error) {
-	err := volume.spdkNode.PublishVolume(volume.csiVolume.GetVolumeId())
+	start, end, nextToken, err := paginate(len(snapshotIDs), req.GetStartingToken(), req.GetMaxEntries())
 	if err != nil {
 		return nil, err
 	}
 
-	volumeInfo, err := volume.spdkNode.VolumeInfo(volume.csiVolume.GetVolumeId())
-	if err != nil {
-		unpublishVolume(volume) //nolint:errcheck // we can do little
-		return nil, err
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)
+	for _, snapshotID := range snapshotIDs[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshots[snapshotID]})
 	}
-	return volumeInfo, nil
-}
 
-func deleteVolume(volume *volume) error {
-	return volume.spdkNode.DeleteVolume(volume.csiVolume.GetVolumeId())
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
 }
 
-func unpublishVolume(volume *volume) error {
-	return volume.spdkNode.UnpublishVolume(volume.csiVolume.GetVolumeId())
-}
+// get snapshots from lvols on spdk nodes, so size and readiness reflect
+// current state. creation time is not recorded by spdk, tracked one is used.
+// tracked snapshots are returned as is if their node is not reachable.
+func (cs *controllerServer) listSnapshots() map[string]*csi.Snapshot {
+	snapshots := make(map[string]*csi.Snapshot)
+	spdkNodes := cs.storageNodes()
 
-// simplest volume scheduler: find first node:lvstore with enough free space
-func (cs *controllerServer) schedule(sizeMiB int64) (spdkNode util.SpdkNode, lvstore string, err error) {
-	for _, spdkNode := range cs.spdkNodes {
-		// retrieve lastest lvstore info from spdk node
-		lvstores, err := spdkNode.LvStores()
+	cs.mtxSnapshot.RLock()
+	defer cs.mtxSnapshot.RUnlock()
+
+	for _, spdkNode := range spdkNodes {
+		lvols, err := spdkNode.Lvols()
 		if err != nil {
-			klog.Errorf("failed to get lvstores from node %s: %s", spdkNode.Info(), err.Error())
+			klog.Errorf("failed to get lvols from node %s: %s", spdkNode.Info(), err.Error())
+			for snapshotID, snap := range cs.snapshotsIdem {
+				if snap.spdkNode == spdkNode {
+					snapshots[snapshotID] = &snap.csiSnapshot
+				}
+			}
 			continue
 		}
-		// check if lvstore has enough free space
-		for i := range lvstores {
-			lvstore := &lvstores[i]
-			if lvstore.FreeSizeMiB > sizeMiB {
-				return spdkNode, lvstore.Name, nil
+
+		lvolsByName := make(map[string]*util.Lvol)
+		for i := range lvols {
+			lvolsByName[lvols[i].LvsName+"/"+lvols[i].Name] = &lvols[i]
+		}
+		for i := range lvols {
+			lvol := &lvols[i]
+			if !lvol.IsSnapshot || !strings.HasPrefix(lvol.Name, snapshotPrefix) {
+				continue
 			}
+			csiSnapshot := &csi.Snapshot{
+				SizeBytes:  lvol.SizeMiB * 1024 * 1024,
+				SnapshotId: lvol.ID,
+				ReadyToUse: true,
+			}
+			if snap, exists := cs.snapshotsIdem[lvol.ID]; exists {
+				csiSnapshot.SourceVolumeId = snap.csiSnapshot.GetSourceVolumeId()
+				csiSnapshot.CreationTime = snap.csiSnapshot.GetCreationTime()
+			} else {
+				csiSnapshot.SourceVolumeId, csiSnapshot.CreationTime = snapshotOrigin(lvol, lvolsByName)
+			}
+			snapshots[lvol.ID] = csiSnapshot
 		}
-		klog.Infof("not enough free space from node %s", spdkNode.Info())
 	}
 
-	return nil, "", fmt.Errorf("failed to find node with enough free space")
+	return snapshots
 }
 
-func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
-	server := controllerServer{
-		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
-		volumes:                 make(map[string]*volume),
-		volumesIdem:             make(map[string]string),
-		snapshotsIdem:           make(map[string]csi.Snapshot),
+// page over total entries in stable order, token is index of next entry
+func paginate(total int, startingToken string, maxEntries int32) (start, end int, nextToken string, err error) {
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token: %s", startingToken)
+		}
 	}
-
-	// get spdk node configs, see deploy/kubernetes/config-map.yaml
-	//nolint:tagliatelle // not using json:snake case
-	var config struct {
-		Nodes []struct {
-			Name       string `json:"name"`
-			URL        string `json:"rpcURL"`
-			TargetType string `json:"targetType"`
-			TargetAddr string `json:"targetAddr"`
-		} `json:"Nodes"`
+	end = total
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+	if end < total {
+		nextToken = strconv.Itoa(end)
 	}
-	configFile := util.FromEnv("SPDKCSI_CONFIG", "/etc/spdkcsi-config/config.json")
-	err := util.ParseJSONFile(configFile, &config)
+	return start, end, nextToken, nil
+}
+
+func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*volume, error) {
+	params, err := cs.parseVolumeParams(req.GetParameters())
 	if err != nil {
 		return nil, err
 	}
-
-	// get spdk node secrets, see deploy/kubernetes/secret.yaml
-	//nolint:tagliatelle // not using json:snake case
-	var secret struct {
-		Tokens []struct {
-			Name     string `json:"name"`
-			UserName string `json:"username"`
-			Password string `json:"password"`
-		} `json:"rpcTokens"`
+	// mutable parameters of VolumeAttributesClass override StorageClass
+	mutableParameters := req.GetMutableParameters()
+	err = checkMutableParameters(mutableParameters)
+	if err != nil {
+		return nil, err
 	}
-	secretFile := util.FromEnv("SPDKCSI_SECRET", "/etc/spdkcsi-secret/secret.json")
-	err = util.ParseJSONFile(secretFile, &secret)
+	err = parseQos(mutableParameters, &params.qos)
 	if err != nil {
 		return nil, err
 	}
+	for _, cap := range req.GetVolumeCapabilities() {
+		err = checkMultiNodeWriter(cap)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 
-	// create spdk nodes
-	for i := range config.Nodes {
-		node := &config.Nodes[i]
-		tokenFound := false
-		// find secret per node
-		for j := range secret.Tokens {
-			token := &secret.Tokens[j]
-			if token.Name == node.Name {
-				tokenFound = true
-				spdkNode, err := util.NewSpdkNode(node.URL, token.UserName, token.Password, node.TargetType, node.TargetAddr)
-				if err != nil {
-					klog.Errorf("failed to create spdk node %s: %s", node.Name, err.Error())
-				} else {
-					klog.Infof("spdk node created: name=%s, url=%s", node.Name, node.URL)
-					server.spdkNodes = append(server.spdkNodes, spdkNode)
-				}
+	if params.keyProvider != "" && req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "encrypted volume cannot be created from content source")
+	}
+
+	volume, err := cs.createLvol(req, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.keyProvider != "" {
+		err = cs.encryptVolume(volume, params.keyProvider, req.GetSecrets())
+		if err != nil {
+			discardVolume(volume)
+			return nil, err
+		}
+	}
+	if params.qos != (util.QosLimits{}) {
+		err = volume.spdkNode.SetQos(volume.csiVolume.GetVolumeId(), params.qos)
+		if err != nil {
+			discardVolume(volume)
+			return nil, err
+		}
+	}
+	if len(mutableParameters) > 0 {
+		setQosContext(volume.csiVolume.VolumeContext, params.qos)
+	}
+	return volume, nil
+}
+
+// stack crypto bdev with key from the provider on a new volume, key is
+// deleted if the volume cannot be encrypted
+func (cs *controllerServer) encryptVolume(volume *volume, provider string, secrets map[string]string) error {
+	key, err := cs.keyProviders[provider].volumeKey(volume.name, secrets)
+	if err != nil {
+		return err
+	}
+	err = volume.spdkNode.EncryptVolume(volume.csiVolume.GetVolumeId(), key)
+	if err != nil {
+		cs.deleteVolumeKey(volume.name)
+		return err
+	}
+	return nil
+}
+
+// delete key of a volume from its key provider, recorded in volume name
+func (cs *controllerServer) deleteVolumeKey(lvolName string) {
+	name := volumeKeyProvider(lvolName)
+	provider, exists := cs.keyProviders[name]
+	if !exists {
+		return
+	}
+	err := provider.deleteKey(lvolName)
+	if err != nil {
+		klog.Errorf("failed to delete key of %s from provider %s: %s", lvolName, name, err.Error())
+	}
+}
+
+// create lvol from scratch or from content source
+func (cs *controllerServer) createLvol(req *csi.CreateVolumeRequest, params *volumeParams) (*volume, error) {
+	if source := req.GetVolumeContentSource(); source != nil {
+		switch {
+		case source.GetSnapshot() != nil:
+			return cs.createVolumeFromSnapshot(req, params, source.GetSnapshot().GetSnapshotId())
+		case source.GetVolume() != nil:
+			return cs.createVolumeFromVolume(req, params, source.GetVolume().GetVolumeId())
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported volume content source: %v", source)
+		}
+	}
+
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if size == 0 {
+		klog.Warningln("invalid volume size, resize to 1G")
+		size = 1024 * 1024 * 1024
+	}
+	sizeMiB := util.ToMiB(size)
+
+	lvolName := volumeLvolName(req.Name)
+	if params.keyProvider != "" {
+		lvolName = encryptedLvolName(lvolName, params.keyProvider)
+	}
+	var (
+		spdkNode *storageNode
+		lvstore  string
+		volumeID string
+		excluded []lvstoreKey // lvstores without enough space in previous tries
+		err      error
+	)
+	for retry := 0; ; retry++ {
+		// schedule suitable node:lvstore, space is reserved until lvol created
+		spdkNode, lvstore, err = cs.schedule(sizeMiB, req.GetAccessibilityRequirements(), params, excluded)
+		if err != nil {
+			return nil, err
+		}
+		if !cs.placeVolume(volumeLvolName(req.Name), spdkNode) {
+			// node re-created on config reload since scheduled, re-schedule
+			cs.unreserve(spdkNode, lvstore, sizeMiB)
+			if retry >= maxScheduleRetries {
+				return nil, status.Errorf(codes.Unavailable, "spdk node %s is being reconfigured", spdkNode.name)
+			}
+			continue
+		}
+		volumeID, err = spdkNode.CreateVolume(lvolName, lvstore, sizeMiB, params.lvolOptions)
+		cs.unreserve(spdkNode, lvstore, sizeMiB)
+		if err == nil {
+			break
+		}
+		// lvstore filled up by others since scheduled, re-schedule per optimistic concurrency control
+		if !errors.Is(err, util.ErrJSONNoSpaceLeft) || retry >= maxScheduleRetries {
+			return nil, err
+		}
+		klog.Warningf("no space left in node %s, lvstore %s, re-schedule volume %s", spdkNode.Info(), lvstore, req.Name)
+		excluded = append(excluded, lvstoreKey{spdkNode, lvstore})
+	}
+
+	return &volume{
+		name:     lvolName,
+		lvstore:  lvstore,
+		spdkNode: spdkNode,
+		csiVolume: csi.Volume{
+			VolumeId:           volumeID,
+			CapacityBytes:      sizeMiB * 1024 * 1024,
+			VolumeContext:      volumeContext(req.GetParameters()),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: spdkNode.accessibleTopology(),
+		},
+	}, nil
+}
+
+// clone the snapshot on spdk node where it lives, and grow the clone if
+// requested size is larger than the snapshot
+func (cs *controllerServer) createVolumeFromSnapshot(req *csi.CreateVolumeRequest, params *volumeParams, snapshotID string) (*volume, error) {
+	cs.mtxSnapshot.RLock()
+	snapshot, exists := cs.snapshotsIdem[snapshotID]
+	cs.mtxSnapshot.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "snapshot does not exist: %s", snapshotID)
+	}
+
+	snapshotSizeMiB := util.ToMiB(snapshot.csiSnapshot.GetSizeBytes())
+	sizeMiB := util.ToMiB(req.GetCapacityRange().GetRequiredBytes())
+	if sizeMiB == 0 {
+		sizeMiB = snapshotSizeMiB
+	}
+	if sizeMiB < snapshotSizeMiB {
+		return nil, status.Errorf(codes.OutOfRange, "requested size %d MiB is smaller than snapshot size %d MiB", sizeMiB, snapshotSizeMiB)
+	}
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if limitBytes != 0 && sizeMiB*1024*1024 > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange, "snapshot size %d MiB exceeds limit %d bytes", sizeMiB, limitBytes)
+	}
+
+	if !snapshot.spdkNode.satisfies(req.GetAccessibilityRequirements()) {
+		return nil, status.Errorf(codes.ResourceExhausted, "snapshot %s is not accessible from requested topology", snapshotID)
+	}
+	if !params.allows(snapshot.spdkNode, snapshot.lvstore) {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is not in requested spdk node or lvstore", snapshotID)
+	}
+
+	lvolName := volumeLvolName(req.Name)
+	if !cs.placeVolume(lvolName, snapshot.spdkNode) {
+		return nil, status.Errorf(codes.Unavailable, "spdk node %s is being reconfigured", snapshot.spdkNode.name)
+	}
+	volumeID, err := snapshot.spdkNode.CloneSnapshot(lvolName, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	volume := &volume{
+		name:     lvolName,
+		lvstore:  snapshot.lvstore,
+		spdkNode: snapshot.spdkNode,
+		csiVolume: csi.Volume{
+			VolumeId:           volumeID,
+			CapacityBytes:      snapshotSizeMiB * 1024 * 1024,
+			VolumeContext:      volumeContext(req.GetParameters()),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: snapshot.spdkNode.accessibleTopology(),
+		},
+	}
+	if sizeMiB > snapshotSizeMiB {
+		err = resizeVolume(volume, sizeMiB)
+		if err != nil {
+			deleteVolume(volume) //nolint:errcheck // we can do little
+			return nil, err
+		}
+	}
+	return volume, nil
+}
+
+// snapshot source volume to a hidden snapshot and clone it, the snapshot is
+// not visible to CO and is deleted when the cloned volume is deleted
+//
+//nolint:cyclop // many checks increases complexity
+func (cs *controllerServer) createVolumeFromVolume(req *csi.CreateVolumeRequest, params *volumeParams, sourceVolumeID string) (*volume, error) {
+	cs.mtx.Lock()
+	sourceVolume, exists := cs.volumes[sourceVolumeID]
+	cs.mtx.Unlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "source volume does not exist: %s", sourceVolumeID)
+	}
+	if isEncrypted(sourceVolume) {
+		return nil, status.Errorf(codes.InvalidArgument, "clone of encrypted volume is not supported: %s", sourceVolumeID)
+	}
+
+	// serialize with DeleteVolume/ControllerExpandVolume on source volume
+	sourceVolume.mtx.Lock()
+	defer sourceVolume.mtx.Unlock()
+
+	sourceSizeMiB := util.ToMiB(sourceVolume.csiVolume.GetCapacityBytes())
+	sizeMiB := util.ToMiB(req.GetCapacityRange().GetRequiredBytes())
+	if sizeMiB == 0 {
+		sizeMiB = sourceSizeMiB
+	}
+	if sizeMiB < sourceSizeMiB {
+		return nil, status.Errorf(codes.OutOfRange, "requested size %d MiB is smaller than source volume size %d MiB", sizeMiB, sourceSizeMiB)
+	}
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if limitBytes != 0 && sizeMiB*1024*1024 > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange, "source volume size %d MiB exceeds limit %d bytes", sizeMiB, limitBytes)
+	}
+
+	spdkNode := sourceVolume.spdkNode
+	if !spdkNode.satisfies(req.GetAccessibilityRequirements()) {
+		return nil, status.Errorf(codes.ResourceExhausted, "source volume %s is not accessible from requested topology", sourceVolumeID)
+	}
+	if !params.allows(spdkNode, sourceVolume.lvstore) {
+		return nil, status.Errorf(codes.InvalidArgument, "source volume %s is not in requested spdk node or lvstore", sourceVolumeID)
+	}
+
+	lvolName := volumeLvolName(req.Name)
+	if !cs.placeVolume(lvolName, spdkNode) {
+		return nil, status.Errorf(codes.Unavailable, "spdk node %s is being reconfigured", spdkNode.name)
+	}
+	cloneSnapshotID, err := spdkNode.CreateSnapshot(sourceVolumeID, cloneSnapshotLvolName(lvolName))
+	if err != nil {
+		return nil, err
+	}
+	volumeID, err := spdkNode.CloneSnapshot(lvolName, cloneSnapshotID)
+	if err != nil {
+		spdkNode.DeleteVolume(cloneSnapshotID) //nolint:errcheck // we can do little
+		return nil, err
+	}
+
+	volume := &volume{
+		name:     lvolName,
+		lvstore:  sourceVolume.lvstore,
+		spdkNode: spdkNode,
+		csiVolume: csi.Volume{
+			VolumeId:           volumeID,
+			CapacityBytes:      sourceSizeMiB * 1024 * 1024,
+			VolumeContext:      volumeContext(req.GetParameters()),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: spdkNode.accessibleTopology(),
+		},
+		cloneSnapshotID: cloneSnapshotID,
+	}
+	if sizeMiB > sourceSizeMiB {
+		err = resizeVolume(volume, sizeMiB)
+		if err != nil {
+			deleteVolume(volume)                   //nolint:errcheck // we can do little
+			spdkNode.DeleteVolume(cloneSnapshotID) //nolint:errcheck // we can do little
+			return nil, err
+		}
+	}
+	return volume, nil
+}
+
+// volume context of new volume, parameters of the request are copied as
+// volume info is merged into it
+func volumeContext(parameters map[string]string) map[string]string {
+	volumeContext := make(map[string]string, len(parameters))
+	for k, v := range parameters {
+		volumeContext[k] = v
+	}
+	return volumeContext
+}
+
+func publishVolume(volume *volume) (map[string]string, error) {
+	err := volume.spdkNode.PublishVolume(volume.csiVolume.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	volumeInfo, err := volume.spdkNode.VolumeInfo(volume.csiVolume.GetVolumeId())
+	if err != nil {
+		unpublishVolume(volume) //nolint:errcheck // we can do little
+		return nil, err
+	}
+	return volumeInfo, nil
+}
+
+func deleteVolume(volume *volume) error {
+	return volume.spdkNode.DeleteVolume(volume.csiVolume.GetVolumeId())
+}
+
+// delete volume failed in creation, errors are ignored
+func discardVolume(volume *volume) {
+	deleteVolume(volume) //nolint:errcheck // we can do little
+	if volume.cloneSnapshotID != "" {
+		volume.spdkNode.DeleteVolume(volume.cloneSnapshotID) //nolint:errcheck // we can do little
+	}
+}
+
+func unpublishVolume(volume *volume) error {
+	return volume.spdkNode.UnpublishVolume(volume.csiVolume.GetVolumeId())
+}
+
+// caller must hold volume lock
+func resizeVolume(volume *volume, sizeMiB int64) error {
+	lvstores, err := volume.spdkNode.LvStores()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	// check if lvstore has enough free space for the grown part
+	deltaMiB := sizeMiB - util.ToMiB(volume.csiVolume.GetCapacityBytes())
+	for i := range lvstores {
+		lvstore := &lvstores[i]
+		if lvstore.Name == volume.lvstore && lvstore.FreeSizeMiB < deltaMiB {
+			return status.Errorf(codes.ResourceExhausted, "not enough free space in lvstore %s to grow %d MiB", lvstore.Name, deltaMiB)
+		}
+	}
+
+	err = volume.spdkNode.ResizeVolume(volume.csiVolume.GetVolumeId(), sizeMiB)
+	if errors.Is(err, util.ErrJSONNoSpaceLeft) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	volume.csiVolume.CapacityBytes = sizeMiB * 1024 * 1024
+	return nil
+}
+
+func volumeLvolName(volumeName string) string {
+	return lvolPrefix + uuid.NewSHA1(uuid.NameSpaceOID, []byte(volumeName)).String()
+}
+
+// snapshot lvol is named after CO provided snapshot name, followed by source
+// volume id and creation time which spdk doesn't record, so they are known
+// after controller restart. uuids are base64 encoded to fit lvol name in 63
+// characters. Source and time are omitted if source volume id is no uuid.
+func snapshotLvolName(snapshotName, sourceVolumeID string, creationTime time.Time) string {
+	name := snapshotIdemName(snapshotName)
+	sourceUUID, err := uuid.Parse(sourceVolumeID)
+	if err != nil {
+		return name
+	}
+	return name + base64.RawURLEncoding.EncodeToString(sourceUUID[:]) + fmt.Sprintf("%08x", creationTime.Unix())
+}
+
+// CreateSnapshot idempotency is tracked by the snapshot name part of lvol
+func snapshotIdemName(snapshotName string) string {
+	nameUUID := uuid.NewSHA1(uuid.NameSpaceOID, []byte(snapshotName))
+	return snapshotPrefix + base64.RawURLEncoding.EncodeToString(nameUUID[:])
+}
+
+// parse lvol name of snapshot, source volume id is empty and creation time
+// is zero if not recorded in the name
+func parseSnapshotLvolName(lvolName string) (idemName, sourceVolumeID string, creationTime time.Time) {
+	const encodedUUIDLen = 22 // base64 of 16 bytes without padding
+	encoded := strings.TrimPrefix(lvolName, snapshotPrefix)
+	if len(encoded) < encodedUUIDLen {
+		return lvolName, "", time.Time{}
+	}
+	idemName = snapshotPrefix + encoded[:encodedUUIDLen]
+	encoded = encoded[encodedUUIDLen:]
+	if len(encoded) != encodedUUIDLen+8 {
+		return idemName, "", time.Time{}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded[:encodedUUIDLen])
+	if err != nil {
+		return idemName, "", time.Time{}
+	}
+	sourceUUID, err := uuid.FromBytes(data)
+	if err != nil {
+		return idemName, "", time.Time{}
+	}
+	unixTime, err := strconv.ParseInt(encoded[encodedUUIDLen:], 16, 64)
+	if err != nil {
+		return idemName, "", time.Time{}
+	}
+	return idemName, sourceUUID.String(), time.Unix(unixTime, 0)
+}
+
+// source volume and creation time of snapshot found on spdk node, source is
+// searched among clones of the snapshot if not recorded in lvol name
+func snapshotOrigin(snapshot *util.Lvol, lvolsByName map[string]*util.Lvol) (sourceVolumeID string, creationTime *timestamppb.Timestamp) {
+	_, sourceVolumeID, unixTime := parseSnapshotLvolName(snapshot.Name)
+	if sourceVolumeID == "" {
+		if source := snapshotSource(snapshot, lvolsByName); source != nil {
+			sourceVolumeID = source.ID
+		}
+	}
+	if unixTime.IsZero() {
+		return sourceVolumeID, timestamppb.Now() // not recorded
+	}
+	return sourceVolumeID, timestamppb.New(unixTime)
+}
+
+// encrypted volume is named differently, so it's never exported without the
+// crypto bdev if found after controller restart, and its key is recovered
+// only from the key provider recorded in the name
+func encryptedLvolName(lvolName, provider string) string {
+	return encryptedPrefix + provider + "-" + strings.TrimPrefix(lvolName, lvolPrefix)
+}
+
+// key provider of encrypted volume, empty if not encrypted
+func volumeKeyProvider(lvolName string) string {
+	if !strings.HasPrefix(lvolName, encryptedPrefix) {
+		return ""
+	}
+	provider, _, _ := strings.Cut(strings.TrimPrefix(lvolName, encryptedPrefix), "-")
+	return provider
+}
+
+// CreateVolume idempotency is tracked by the name of unencrypted volume
+func volumeIdemName(lvolName string) string {
+	if provider := volumeKeyProvider(lvolName); provider != "" {
+		return lvolPrefix + strings.TrimPrefix(lvolName, encryptedPrefix+provider+"-")
+	}
+	return lvolName
+}
+
+// key of an existing encrypted volume from its key provider
+func (cs *controllerServer) existingVolumeKey(lvolName string, secrets map[string]string) (util.CryptoKey, error) {
+	name := volumeKeyProvider(lvolName)
+	provider, exists := cs.keyProviders[name]
+	if !exists {
+		return util.CryptoKey{}, status.Errorf(codes.FailedPrecondition, "key provider %q of encrypted volume %s is not configured", name, lvolName)
+	}
+	return provider.existingKey(lvolName, secrets)
+}
+
+func isEncrypted(volume *volume) bool {
+	return strings.HasPrefix(volume.name, encryptedPrefix)
+}
+
+// re-create crypto bdev of a restored encrypted volume with key its provider
+// recovers without secrets, i.e. key stored by file provider
+func (cs *controllerServer) recoverCryptoBdev(spdkNode *storageNode, lvol *util.Lvol) error {
+	key, err := cs.existingVolumeKey(lvol.Name, nil)
+	if err != nil {
+		return err
+	}
+	err = spdkNode.EncryptVolume(lvol.ID, key)
+	if err != nil {
+		return err
+	}
+	klog.Infof("crypto bdev of encrypted volume %s re-created", lvol.ID)
+	return nil
+}
+
+// re-create lost crypto bdev of an encrypted volume with key from its key
+// provider, and publish the volume. Secrets of controller publish and expand
+// must carry master key of provisioner secret for "secret" provider. Caller
+// must hold volume lock.
+func (cs *controllerServer) recoverEncryptedVolume(volume *volume, secrets map[string]string) error {
+	volumeID := volume.csiVolume.GetVolumeId()
+	cs.mtx.Lock()
+	keyLost := volume.keyLost
+	cs.mtx.Unlock()
+	if !keyLost {
+		return nil
+	}
+
+	key, err := cs.existingVolumeKey(volume.name, secrets)
+	if err != nil {
+		return status.Errorf(status.Code(err), "crypto bdev of encrypted volume %s is lost: %s", volumeID, status.Convert(err).Message())
+	}
+	err = volume.spdkNode.EncryptVolume(volumeID, key)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	err = volume.spdkNode.PublishVolume(volumeID)
+	if err != nil && !errors.Is(err, util.ErrVolumePublished) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	volumeInfo, err := volume.spdkNode.VolumeInfo(volumeID)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for k, v := range volumeInfo {
+		volume.csiVolume.VolumeContext[k] = v
+	}
+	volume.keyLost = false
+	klog.Infof("encrypted volume recovered: %s", volumeID)
+	return nil
+}
+
+// hidden snapshot of a cloned volume is named after the clone, so it can be
+// associated with the clone after controller restart
+func cloneSnapshotLvolName(lvolName string) string {
+	return clonePrefix + strings.TrimPrefix(lvolName, lvolPrefix)
+}
+
+// rebuild volume and snapshot tracking from lvols found on spdk nodes, so
+// volumes created before controller restart can still be managed
+func (cs *controllerServer) restoreVolumes() {
+	for _, spdkNode := range cs.storageNodes() {
+		err := cs.restoreNodeVolumes(spdkNode)
+		if err != nil {
+			klog.Errorf("failed to restore volumes from node %s: %s", spdkNode.Info(), err.Error())
+		}
+	}
+}
+
+//nolint:cyclop // many checks per lvol increases complexity
+func (cs *controllerServer) restoreNodeVolumes(spdkNode *storageNode) error {
+	lvols, err := spdkNode.Lvols()
+	if err != nil {
+		return err
+	}
+
+	var volumeLvols, snapshotLvols []*util.Lvol
+	lvolsByName := make(map[string]*util.Lvol) // "lvs_name/lvol_name" to lvol
+	for i := range lvols {
+		lvol := &lvols[i]
+		lvolsByName[lvol.LvsName+"/"+lvol.Name] = lvol
+		switch {
+		case lvol.IsSnapshot && strings.HasPrefix(lvol.Name, snapshotPrefix):
+			snapshotLvols = append(snapshotLvols, lvol)
+		case !lvol.IsSnapshot && strings.HasPrefix(lvol.Name, lvolPrefix):
+			volumeLvols = append(volumeLvols, lvol)
+		}
+	}
+
+	volumeIDs := make([]string, len(volumeLvols))
+	for i, lvol := range volumeLvols {
+		volumeIDs[i] = lvol.ID
+	}
+	err = spdkNode.RestoreVolumes(volumeIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, lvol := range volumeLvols {
+		// crypto bdev is lost if spdk target restarts, re-create it with key
+		// stored by file provider, or wait for secrets of next request to
+		// derive the key, never export the ciphertext
+		keyLost := false
+		if strings.HasPrefix(lvol.Name, encryptedPrefix) && !lvol.Encrypted {
+			err = cs.recoverCryptoBdev(spdkNode, lvol)
+			if err != nil {
+				klog.Errorf("crypto bdev of encrypted volume %s not re-created, volume is not published until key is recovered: %s", lvol.ID, err.Error())
+				keyLost = true
+			}
+		}
+		if !keyLost {
+			// finish publishing if we were interrupted in CreateVolume
+			err = spdkNode.PublishVolume(lvol.ID)
+			if err != nil && !errors.Is(err, util.ErrVolumePublished) {
+				klog.Errorf("failed to publish restored volume %s: %s", lvol.ID, err.Error())
+				continue
+			}
+		}
+		var volumeInfo map[string]string
+		volumeInfo, err = spdkNode.VolumeInfo(lvol.ID)
+		if err != nil {
+			klog.Errorf("failed to get info of restored volume %s: %s", lvol.ID, err.Error())
+			continue
+		}
+		setQosContext(volumeInfo, lvol.Qos)
+		cloneSnapshotID := ""
+		if cloneSnapshot, exists := lvolsByName[lvol.LvsName+"/"+cloneSnapshotLvolName(lvol.Name)]; exists {
+			cloneSnapshotID = cloneSnapshot.ID
+		}
+		cs.mtx.Lock()
+		cs.volumes[lvol.ID] = &volume{
+			name:     lvol.Name,
+			lvstore:  lvol.LvsName,
+			spdkNode: spdkNode,
+			csiVolume: csi.Volume{
+				VolumeId:           lvol.ID,
+				CapacityBytes:      lvol.SizeMiB * 1024 * 1024,
+				VolumeContext:      volumeInfo,
+				AccessibleTopology: spdkNode.accessibleTopology(),
+			},
+			cloneSnapshotID: cloneSnapshotID,
+			keyLost:         keyLost,
+		}
+		cs.volumesIdem[volumeIdemName(lvol.Name)] = lvol.ID
+		cs.mtx.Unlock()
+		klog.Infof("volume restored: %s, node %s", lvol.ID, spdkNode.Info())
+	}
+
+	for _, lvol := range snapshotLvols {
+		sourceVolumeID, creationTime := snapshotOrigin(lvol, lvolsByName)
+		cs.mtxSnapshot.Lock()
+		cs.snapshotsIdem[lvol.ID] = &snapshot{
+			name:     lvol.Name,
+			lvstore:  lvol.LvsName,
+			spdkNode: spdkNode,
+			csiSnapshot: csi.Snapshot{
+				SizeBytes:      lvol.SizeMiB * 1024 * 1024,
+				SnapshotId:     lvol.ID,
+				SourceVolumeId: sourceVolumeID,
+				CreationTime:   creationTime,
+				ReadyToUse:     true,
+			},
+		}
+		cs.mtxSnapshot.Unlock()
+		klog.Infof("snapshot restored: %s, source volume %s", lvol.ID, sourceVolumeID)
+	}
+
+	return nil
+}
+
+// find source volume of a snapshot, not recorded in its name, by walking down
+// its clones. a snapshot taken later from the same volume is inserted between
+// the volume and this snapshot, so snapshot clones are followed first.
+func snapshotSource(snapshot *util.Lvol, lvolsByName map[string]*util.Lvol) *util.Lvol {
+	lvol := snapshot
+	for lvol != nil && lvol.IsSnapshot {
+		var next *util.Lvol
+		for _, name := range lvol.Clones {
+			clone, exists := lvolsByName[lvol.LvsName+"/"+name]
+			if !exists {
+				continue
+			}
+			if next == nil || (clone.IsSnapshot && !next.IsSnapshot) {
+				next = clone
+			}
+		}
+		lvol = next
+	}
+	return lvol
+}
+
+// find node:lvstores with enough free space among nodes accessible per
+// topology requirement, and pick one per schedule policy. space of new volume
+// is reserved in picked lvstore, caller must unreserve it after creating lvol.
+//
+//nolint:cyclop // many checks per lvstore increases complexity
+func (cs *controllerServer) schedule(sizeMiB int64, requirement *csi.TopologyRequirement, params *volumeParams, excluded []lvstoreKey) (spdkNode *storageNode, lvstore string, err error) {
+	policy := params.schedulePolicy
+	if policy == "" {
+		policy = cs.schedulePolicy
+	}
+	sched, exists := cs.schedulers[policy]
+	if !exists {
+		return nil, "", status.Errorf(codes.InvalidArgument, "unknown schedule policy: %s", policy)
+	}
+
+	spdkNodes := cs.accessibleNodes(requirement)
+	if len(spdkNodes) == 0 {
+		return nil, "", status.Error(codes.ResourceExhausted, "no healthy spdk node accessible from requested topology")
+	}
+
+	// count volumes per node:lvstore for leastVolumes policy
+	volumeCounts := make(map[lvstoreKey]int)
+	cs.mtx.Lock()
+	for _, volume := range cs.volumes {
+		volumeCounts[lvstoreKey{volume.spdkNode, volume.lvstore}]++
+	}
+	cs.mtx.Unlock()
+
+	lvstoresMap := make(map[*storageNode][]util.LvStore)
+	for _, spdkNode := range spdkNodes {
+		// retrieve lastest lvstore info from spdk node
+		lvstores, err := spdkNode.LvStores()
+		if err != nil {
+			klog.Errorf("failed to get lvstores from node %s: %s", spdkNode.Info(), err.Error())
+			spdkNode.updateHealth(err)
+			continue
+		}
+		lvstoresMap[spdkNode] = lvstores
+	}
+
+	cs.mtxReservation.Lock()
+	defer cs.mtxReservation.Unlock()
+
+	var candidates []placement
+	for _, spdkNode := range spdkNodes {
+		// check if lvstore has enough free space, excluding space reserved by volumes in creation
+		found := false
+		for i := range lvstoresMap[spdkNode] {
+			lvstore := &lvstoresMap[spdkNode][i]
+			key := lvstoreKey{spdkNode, lvstore.Name}
+			freeSizeMiB := lvstore.FreeSizeMiB - cs.reservations[key]
+			if freeSizeMiB > sizeMiB && !containsLvstore(excluded, key) && params.allows(spdkNode, lvstore.Name) {
+				candidates = append(candidates, placement{
+					spdkNode:    spdkNode,
+					lvstore:     lvstore.Name,
+					freeSizeMiB: freeSizeMiB,
+					volumes:     volumeCounts[key] + cs.reservedVolumes[key],
+				})
+				found = true
+			}
+		}
+		if !found {
+			klog.Infof("not enough free space from node %s", spdkNode.Info())
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("failed to find node with enough free space")
+	}
+
+	picked := sched.pick(candidates)
+	key := lvstoreKey{picked.spdkNode, picked.lvstore}
+	cs.reservations[key] += sizeMiB
+	cs.reservedVolumes[key]++
+	klog.V(5).Infof("scheduled node %s, lvstore %s per policy %s", picked.spdkNode.Info(), picked.lvstore, policy)
+	return picked.spdkNode, picked.lvstore, nil
+}
+
+// release space and volume count reserved in schedule
+func (cs *controllerServer) unreserve(spdkNode *storageNode, lvstore string, sizeMiB int64) {
+	key := lvstoreKey{spdkNode, lvstore}
+	cs.mtxReservation.Lock()
+	defer cs.mtxReservation.Unlock()
+
+	cs.reservations[key] -= sizeMiB
+	if cs.reservations[key] <= 0 {
+		delete(cs.reservations, key)
+	}
+	cs.reservedVolumes[key]--
+	if cs.reservedVolumes[key] <= 0 {
+		delete(cs.reservedVolumes, key)
+	}
+}
+
+// bind volume in creation to the spdk node it's placed on, so the node is
+// not changed on config reload until CreateVolume finishes. False if the
+// node is already replaced or removed.
+func (cs *controllerServer) placeVolume(lvolName string, spdkNode *storageNode) bool {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	for _, current := range cs.storageNodes() {
+		if current == spdkNode {
+			cs.placements[lvolName] = spdkNode
+			return true
+		}
+	}
+	return false
+}
+
+func containsLvstore(lvstores []lvstoreKey, key lvstoreKey) bool {
+	for _, lvstore := range lvstores {
+		if lvstore == key {
+			return true
+		}
+	}
+	return false
+}
+
+// validate and parse StorageClass parameters
+//
+//nolint:cyclop // many parameters increases complexity
+func (cs *controllerServer) parseVolumeParams(parameters map[string]string) (*volumeParams, error) {
+	params := &volumeParams{
+		lvolOptions:    util.DefaultLvolOptions(),
+		schedulePolicy: parameters[paramSchedulePolicy],
+		lvstore:        parameters[paramLvstore],
+		spdkNode:       parameters[paramSpdkNode],
+	}
+
+	if value, exists := parameters[paramThinProvision]; exists {
+		thinProvision, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s", paramThinProvision, value)
+		}
+		params.lvolOptions.ThinProvision = thinProvision
+	}
+	if value, exists := parameters[paramClearMethod]; exists {
+		switch value {
+		case "none", "unmap", "write_zeroes":
+			params.lvolOptions.ClearMethod = value
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s, must be none, unmap or write_zeroes", paramClearMethod, value)
+		}
+	}
+	err := parseQos(parameters, &params.qos)
+	if err != nil {
+		return nil, err
+	}
+	if value, exists := parameters[paramEncryption]; exists {
+		var encryption bool
+		encryption, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s", paramEncryption, value)
+		}
+		if encryption {
+			params.keyProvider = keyProviderSecret
+		}
+	}
+	if value, exists := parameters[paramKeyProvider]; exists {
+		if _, found := cs.keyProviders[value]; !found {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown key provider: %s", value)
+		}
+		if params.keyProvider == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s requires %s to be true", paramKeyProvider, paramEncryption)
+		}
+		params.keyProvider = value
+	}
+	if params.schedulePolicy != "" {
+		if _, exists := cs.schedulers[params.schedulePolicy]; !exists {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown schedule policy: %s", params.schedulePolicy)
+		}
+	}
+	if params.spdkNode != "" {
+		found := false
+		for _, spdkNode := range cs.storageNodes() {
+			if spdkNode.name == params.spdkNode {
+				found = true
 				break
 			}
 		}
-		if !tokenFound {
-			klog.Errorf("failed to find secret for spdk node %s", node.Name)
+		if !found {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown spdk node: %s", params.spdkNode)
+		}
+	}
+
+	return params, nil
+}
+
+// only qos limits are mutable by VolumeAttributesClass
+func checkMutableParameters(parameters map[string]string) error {
+	for key := range parameters {
+		switch key {
+		case paramRWIOsPerSec, paramRWMBytesPerSec, paramRMBytesPerSec, paramWMBytesPerSec:
+		default:
+			return status.Errorf(codes.InvalidArgument, "parameter %s is not mutable", key)
+		}
+	}
+	return nil
+}
+
+// update qos limits present in parameters
+func parseQos(parameters map[string]string, qos *util.QosLimits) error {
+	for key, limit := range map[string]*int64{
+		paramRWIOsPerSec:    &qos.RWIOsPerSec,
+		paramRWMBytesPerSec: &qos.RWMBytesPerSec,
+		paramRMBytesPerSec:  &qos.RMBytesPerSec,
+		paramWMBytesPerSec:  &qos.WMBytesPerSec,
+	} {
+		value, exists := parameters[key]
+		if !exists {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid %s: %s", key, value)
+		}
+		*limit = parsed
+	}
+	// spdk limits iops in units of 1000
+	if qos.RWIOsPerSec%1000 != 0 {
+		return status.Errorf(codes.InvalidArgument, "%s must be multiple of 1000: %d", paramRWIOsPerSec, qos.RWIOsPerSec)
+	}
+	return nil
+}
+
+// reflect qos limits in volume context, unlimited ones are removed
+func setQosContext(volumeContext map[string]string, qos util.QosLimits) {
+	for key, limit := range map[string]int64{
+		paramRWIOsPerSec:    qos.RWIOsPerSec,
+		paramRWMBytesPerSec: qos.RWMBytesPerSec,
+		paramRMBytesPerSec:  qos.RMBytesPerSec,
+		paramWMBytesPerSec:  qos.WMBytesPerSec,
+	} {
+		if limit == 0 {
+			delete(volumeContext, key)
+		} else {
+			volumeContext[key] = strconv.FormatInt(limit, 10)
+		}
+	}
+}
+
+// check if node:lvstore is allowed if volume is pinned to spdk node or lvstore
+func (params *volumeParams) allows(spdkNode *storageNode, lvstore string) bool {
+	return (params.spdkNode == "" || params.spdkNode == spdkNode.name) &&
+		(params.lvstore == "" || params.lvstore == lvstore)
+}
+
+// nodes satisfying topology requirement, nodes accessible from preferred
+// topologies come first in order of preference
+func (cs *controllerServer) accessibleNodes(requirement *csi.TopologyRequirement) []*storageNode {
+	var spdkNodes []*storageNode
+	added := make(map[*storageNode]bool)
+	allNodes := cs.storageNodes()
+	for _, topology := range requirement.GetPreferred() {
+		for _, spdkNode := range allNodes {
+			if !spdkNode.schedulable() {
+				continue
+			}
+			if !added[spdkNode] && spdkNode.accessibleFrom(topology) && spdkNode.satisfies(requirement) {
+				spdkNodes = append(spdkNodes, spdkNode)
+				added[spdkNode] = true
+			}
+		}
+	}
+	for _, spdkNode := range allNodes {
+		if !spdkNode.schedulable() {
+			continue
+		}
+		if !added[spdkNode] && spdkNode.satisfies(requirement) {
+			spdkNodes = append(spdkNodes, spdkNode)
+			added[spdkNode] = true
+		}
+	}
+	return spdkNodes
+}
+
+// volume must be accessible from at least one requisite topology, if any
+func (node *storageNode) satisfies(requirement *csi.TopologyRequirement) bool {
+	if len(requirement.GetRequisite()) == 0 {
+		return true
+	}
+	for _, topology := range requirement.GetRequisite() {
+		if node.accessibleFrom(topology) {
+			return true
+		}
+	}
+	return false
+}
+
+// node is accessible from topology containing all its segments
+func (node *storageNode) accessibleFrom(topology *csi.Topology) bool {
+	node.mtx.RLock()
+	defer node.mtx.RUnlock()
+	for key, value := range node.topology {
+		if topology.GetSegments()[key] != value {
+			return false
 		}
 	}
-	if len(server.spdkNodes) == 0 {
+	return true
+}
+
+func (node *storageNode) accessibleTopology() []*csi.Topology {
+	node.mtx.RLock()
+	defer node.mtx.RUnlock()
+	if len(node.topology) == 0 {
+		return nil
+	}
+	return []*csi.Topology{{Segments: node.topology}}
+}
+
+func (node *storageNode) scheduleWeight() int {
+	node.mtx.RLock()
+	defer node.mtx.RUnlock()
+	return node.weight
+}
+
+func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
+	server := controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		volumes:                 make(map[string]*volume),
+		volumesIdem:             make(map[string]string),
+		snapshotsIdem:           make(map[string]*snapshot),
+		schedulers:              newSchedulers(),
+		reservations:            make(map[lvstoreKey]int64),
+		reservedVolumes:         make(map[lvstoreKey]int),
+		placements:              make(map[string]*storageNode),
+	}
+
+	config, tokens, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	server.keyProviders = newKeyProviders(config.KmsDir)
+	server.schedulePolicy = config.SchedulePolicy
+	if server.schedulePolicy == "" {
+		server.schedulePolicy = policyFirst
+	}
+	if _, exists := server.schedulers[server.schedulePolicy]; !exists {
+		return nil, fmt.Errorf("unknown schedule policy: %s", server.schedulePolicy)
+	}
+	server.iostatInterval = defaultIOStatInterval
+	if config.IOStatInterval != "" {
+		server.iostatInterval, err = time.ParseDuration(config.IOStatInterval)
+		if err != nil || server.iostatInterval < 0 {
+			return nil, fmt.Errorf("invalid iostat interval: %s", config.IOStatInterval)
+		}
+	}
+
+	if config.StorageNodeCRD {
+		server.nodeWatcher, err = newStorageNodeWatcher()
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch storage nodes: %w", err)
+		}
+		tokens, err = server.addResourceNodes(config, tokens)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server.updateNodes(config, tokens)
+	// storage node resources may be created later
+	if len(server.spdkNodes) == 0 && server.nodeWatcher == nil {
 		return nil, fmt.Errorf("no valid spdk node found")
 	}
 
+	server.restoreVolumes()
+
 	return &server, nil
 }
@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
 	"github.com/spdk/spdk-csi/pkg/util"
@@ -27,75 +30,913 @@ func TestNvmeofConcurrency(t *testing.T) {
 	testConcurrency("nvme-tcp", t)
 }
 
+func TestNvmeofRestart(t *testing.T) {
+	testRestart("nvme-tcp", t)
+}
+
+func TestNvmeofExpand(t *testing.T) {
+	testExpand("nvme-tcp", t)
+}
+
+func TestNvmeofRestoreSnapshot(t *testing.T) {
+	testRestoreSnapshot("nvme-tcp", t)
+}
+
+func TestNvmeofCloneVolume(t *testing.T) {
+	testCloneVolume("nvme-tcp", t)
+}
+
+func TestNvmeofListVolumes(t *testing.T) {
+	testListVolumes("nvme-tcp", t)
+}
+
+func TestNvmeofListSnapshots(t *testing.T) {
+	testListSnapshots("nvme-tcp", t)
+}
+
+func TestNvmeofTopology(t *testing.T) {
+	testTopology("nvme-tcp", t)
+}
+
+func TestNvmeofQos(t *testing.T) {
+	testQos("nvme-tcp", t)
+}
+
+func TestNvmeofEncryption(t *testing.T) {
+	testEncryption("nvme-tcp", t)
+}
+
+func TestNvmeofMultiNode(t *testing.T) {
+	testMultiNode("nvme-tcp", t)
+}
+
 func TestIscsiVolume(t *testing.T) {
 	testVolume("iscsi", t)
 }
 
-func TestIscsiIdempotency(t *testing.T) {
-	testIdempotency("iscsi", t)
+func TestIscsiIdempotency(t *testing.T) {
+	testIdempotency("iscsi", t)
+}
+
+func TestIscsiConcurrency(t *testing.T) {
+	testConcurrency("iscsi", t)
+}
+
+func TestIscsiRestart(t *testing.T) {
+	testRestart("iscsi", t)
+}
+
+func TestIscsiExpand(t *testing.T) {
+	testExpand("iscsi", t)
+}
+
+func TestIscsiRestoreSnapshot(t *testing.T) {
+	testRestoreSnapshot("iscsi", t)
+}
+
+func TestIscsiCloneVolume(t *testing.T) {
+	testCloneVolume("iscsi", t)
+}
+
+func TestIscsiListVolumes(t *testing.T) {
+	testListVolumes("iscsi", t)
+}
+
+func TestIscsiListSnapshots(t *testing.T) {
+	testListSnapshots("iscsi", t)
+}
+
+func TestIscsiTopology(t *testing.T) {
+	testTopology("iscsi", t)
+}
+
+func TestIscsiQos(t *testing.T) {
+	testQos("iscsi", t)
+}
+
+func TestIscsiEncryption(t *testing.T) {
+	testEncryption("iscsi", t)
+}
+
+func TestIscsiMultiNode(t *testing.T) {
+	testMultiNode("iscsi", t)
+}
+
+func testVolume(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeName = "test-volume"
+	const volumeSize = 256 * 1024 * 1024
+
+	// create volume#1
+	volumeID1, err := createTestVolume(cs, volumeName, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delete volume#1
+	err = deleteTestVolume(cs, volumeID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create volume#2 with same name
+	volumeID2, err := createTestVolume(cs, volumeName, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delete volume#2
+	err = deleteTestVolume(cs, volumeID2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure volumeID1 != volumeID2
+	if volumeID1 == volumeID2 {
+		t.Fatal("volume id should be different")
+	}
+
+	// make sure we didn't leave any garbage in lvstores
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+func testIdempotency(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeName = "test-volume-idem"
+	const requestCount = 50
+	const volumeSize = 256 * 1024 * 1024
+
+	volumeID, err := createSameVolumeInParallel(cs, volumeName, requestCount, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteSameVolumeInParallel(cs, volumeID, requestCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+func testConcurrency(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// count * size cannot exceed storage capacity
+	const volumeNamePrefix = "test-volume-con-"
+	const volumeCount = 20
+	const volumeSize = 16 * 1024 * 1024
+
+	// create/delete multiple volumes in parallel
+	var wg sync.WaitGroup
+	var errCount int32
+	for i := 0; i < volumeCount; i++ {
+		volumeName := fmt.Sprintf("%s%d", volumeNamePrefix, i)
+		wg.Add(1)
+		go func(volumeNameLocal string) {
+			defer wg.Done()
+
+			volumeIDLocal, errLocal := createTestVolume(cs, volumeNameLocal, volumeSize)
+			if errLocal != nil {
+				t.Logf("createTestVolume failed: %s", errLocal)
+				atomic.AddInt32(&errCount, 1)
+			}
+
+			errLocal = deleteTestVolume(cs, volumeIDLocal)
+			if errLocal != nil {
+				t.Logf("deleteTestVolume failed: %s", errLocal)
+				atomic.AddInt32(&errCount, 1)
+			}
+		}(volumeName)
+	}
+	wg.Wait()
+	if errCount != 0 {
+		t.Fatal("concurrency test failed")
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+//nolint:cyclop // testRestart exceeds cyclomatic complexity of 10
+func testRestart(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeName = "test-volume-restart"
+	const snapshotName = "test-snapshot-restart"
+	const volumeSize = 256 * 1024 * 1024
+
+	volumeID, err := createTestVolume(cs, volumeName, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotID, err := createTestSnapshot(cs, snapshotName, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start a new controller, it should pick up volume and snapshot
+	cs, _, err = createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetVolume().GetCapacityBytes() != volumeSize {
+		t.Fatal("restored volume size mismatch")
+	}
+	// duplicated request before restart should return same volume
+	volumeID2, err := createTestVolume(cs, volumeName, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volumeID2 != volumeID {
+		t.Fatal("volume id should be same")
+	}
+	snapshotID2, err := createTestSnapshot(cs, snapshotName, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshotID2 != snapshotID {
+		t.Fatal("snapshot id should be same")
+	}
+
+	_, err = cs.DeleteSnapshot(context.TODO(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+func testExpand(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeName = "test-volume-expand"
+	const volumeSize = 256 * 1024 * 1024
+
+	volumeID, err := createTestVolume(cs, volumeName, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// grow volume, then issue a smaller request which should be no-op
+	for _, size := range []int64{volumeSize * 2, volumeSize} {
+		reqExpand := csi.ControllerExpandVolumeRequest{
+			VolumeId:      volumeID,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		}
+		resp, errLocal := cs.ControllerExpandVolume(context.TODO(), &reqExpand)
+		if errLocal != nil {
+			t.Fatal(errLocal)
+		}
+		if resp.GetCapacityBytes() != volumeSize*2 {
+			t.Fatalf("expanded volume size mismatch: %d", resp.GetCapacityBytes())
+		}
+		if !resp.GetNodeExpansionRequired() {
+			t.Fatal("node expansion should be required")
+		}
+	}
+
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+//nolint:cyclop // testRestoreSnapshot exceeds cyclomatic complexity of 10
+func testRestoreSnapshot(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeName = "test-volume-source"
+	const snapshotName = "test-snapshot-source"
+	const volumeSize = 256 * 1024 * 1024
+
+	volumeID, err := createTestVolume(cs, volumeName, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotID, err := createTestSnapshot(cs, snapshotName, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	}
+	// volume cannot be smaller than snapshot
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:                "test-volume-restore-small",
+		CapacityRange:       &csi.CapacityRange{RequiredBytes: volumeSize / 2},
+		VolumeContentSource: source,
+	})
+	if status.Code(err) != codes.OutOfRange {
+		t.Fatalf("expect OutOfRange error, got: %v", err)
+	}
+
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:                "test-volume-restore",
+		CapacityRange:       &csi.CapacityRange{RequiredBytes: volumeSize * 2},
+		VolumeContentSource: source,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetVolume().GetCapacityBytes() != volumeSize*2 {
+		t.Fatalf("restored volume size mismatch: %d", resp.GetVolume().GetCapacityBytes())
+	}
+	if resp.GetVolume().GetContentSource().GetSnapshot().GetSnapshotId() != snapshotID {
+		t.Fatal("restored volume content source mismatch")
+	}
+
+	// source volume and creation time of snapshot are kept after controller
+	// restart, though volume restored from it is also a clone of it
+	restarted, _, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, exists := restarted.snapshotsIdem[snapshotID]
+	if !exists {
+		t.Fatal("snapshot not restored")
+	}
+	created := cs.snapshotsIdem[snapshotID].csiSnapshot.GetCreationTime()
+	if restored.csiSnapshot.GetSourceVolumeId() != volumeID || !restored.csiSnapshot.GetCreationTime().AsTime().Equal(created.AsTime()) {
+		t.Fatalf("restored snapshot mismatch: %v", &restored.csiSnapshot)
+	}
+
+	err = deleteTestVolume(cs, resp.GetVolume().GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.DeleteSnapshot(context.TODO(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+//nolint:cyclop // testCloneVolume exceeds cyclomatic complexity of 10
+func testCloneVolume(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeSize = 256 * 1024 * 1024
+	sourceID, err := createTestVolume(cs, "test-volume-golden", volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID},
+		},
+	}
+	// clone golden volume more than once
+	cloneIDs := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		var resp *csi.CreateVolumeResponse
+		resp, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:                fmt.Sprintf("test-volume-clone-%d", i),
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: volumeSize},
+			VolumeContentSource: source,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetVolume().GetContentSource().GetVolume().GetVolumeId() != sourceID {
+			t.Fatal("cloned volume content source mismatch")
+		}
+		cloneIDs = append(cloneIDs, resp.GetVolume().GetVolumeId())
+	}
+
+	// hidden snapshots must not be visible as snapshots
+	if len(cs.snapshotsIdem) != 0 {
+		t.Fatalf("hidden snapshot exposed: %d snapshots", len(cs.snapshotsIdem))
+	}
+
+	// hidden snapshots are found again after controller restart
+	cs, _, err = createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cloneID := range cloneIDs {
+		if cs.volumes[cloneID] == nil || cs.volumes[cloneID].cloneSnapshotID == "" {
+			t.Fatalf("clone snapshot not restored: %s", cloneID)
+		}
+	}
+
+	// delete source volume before clones
+	err = deleteTestVolume(cs, sourceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cloneID := range cloneIDs {
+		err = deleteTestVolume(cs, cloneID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, spdkNode := range cs.spdkNodes {
+		lvols, errLocal := spdkNode.Lvols()
+		if errLocal != nil {
+			t.Fatal(errLocal)
+		}
+		for i := range lvols {
+			if strings.HasPrefix(lvols[i].Name, clonePrefix) {
+				t.Fatalf("hidden snapshot not deleted: %s", lvols[i].Name)
+			}
+		}
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+//nolint:cyclop // testListVolumes exceeds cyclomatic complexity of 10
+func testListVolumes(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeCount = 3
+	const volumeSize = 64 * 1024 * 1024
+	volumeIDs := make(map[string]bool)
+	for i := 0; i < volumeCount; i++ {
+		var volumeID string
+		volumeID, err = createTestVolume(cs, fmt.Sprintf("test-volume-list-%d", i), volumeSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs[volumeID] = true
+	}
+	var publishedID string
+	for volumeID := range volumeIDs {
+		publishedID = volumeID
+		break
+	}
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         publishedID,
+		NodeId:           testNodeID("test-node-1"),
+		VolumeCapability: &csi.VolumeCapability{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// single node writer cannot be published to another node
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         publishedID,
+		NodeId:           testNodeID("test-node-2"),
+		VolumeCapability: &csi.VolumeCapability{},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition error, got: %v", err)
+	}
+
+	// list two entries per page
+	listed := make(map[string]bool)
+	token := ""
+	for {
+		var resp *csi.ListVolumesResponse
+		resp, err = cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.GetEntries()) > 2 {
+			t.Fatalf("too many entries: %d", len(resp.GetEntries()))
+		}
+		for _, entry := range resp.GetEntries() {
+			volumeID := entry.GetVolume().GetVolumeId()
+			listed[volumeID] = true
+			publishedNodes := entry.GetStatus().GetPublishedNodeIds()
+			if volumeID == publishedID && (len(publishedNodes) != 1 || publishedNodes[0] != testNodeID("test-node-1")) {
+				t.Fatalf("published nodes mismatch: %v", publishedNodes)
+			}
+			if volumeID != publishedID && len(publishedNodes) != 0 {
+				t.Fatalf("volume not published: %v", publishedNodes)
+			}
+		}
+		token = resp.GetNextToken()
+		if token == "" {
+			break
+		}
+	}
+	if len(listed) != volumeCount {
+		t.Fatalf("listed volumes mismatch: %v", listed)
+	}
+	for volumeID := range volumeIDs {
+		if !listed[volumeID] {
+			t.Fatalf("volume not listed: %s", volumeID)
+		}
+	}
+
+	_, err = cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{StartingToken: "invalid"})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("expect Aborted error, got: %v", err)
+	}
+
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: publishedID,
+		NodeId:   testNodeID("test-node-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for volumeID := range volumeIDs {
+		err = deleteTestVolume(cs, volumeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
+
+//nolint:cyclop // testListSnapshots exceeds cyclomatic complexity of 10
+func testListSnapshots(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const volumeSize = 64 * 1024 * 1024
+	volumeIDs := make([]string, 2)
+	snapshotIDs := make(map[string]string) // snapshot id to source volume id
+	for i := range volumeIDs {
+		volumeIDs[i], err = createTestVolume(cs, fmt.Sprintf("test-volume-snaplist-%d", i), volumeSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			var snapshotID string
+			snapshotID, err = createTestSnapshot(cs, fmt.Sprintf("test-snapshot-list-%d-%d", i, j), volumeIDs[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshotIDs[snapshotID] = volumeIDs[i]
+		}
+	}
+
+	// page through all snapshots
+	listed := make(map[string]bool)
+	token := ""
+	for {
+		var resp *csi.ListSnapshotsResponse
+		resp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{MaxEntries: 3, StartingToken: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range resp.GetEntries() {
+			snap := entry.GetSnapshot()
+			listed[snap.GetSnapshotId()] = true
+			if snap.GetSourceVolumeId() != snapshotIDs[snap.GetSnapshotId()] {
+				t.Fatalf("snapshot source mismatch: %s", snap.GetSnapshotId())
+			}
+			if snap.GetSizeBytes() != volumeSize || !snap.GetReadyToUse() || snap.GetCreationTime() == nil {
+				t.Fatalf("snapshot status mismatch: %v", snap)
+			}
+		}
+		token = resp.GetNextToken()
+		if token == "" {
+			break
+		}
+	}
+	if len(listed) != len(snapshotIDs) {
+		t.Fatalf("listed snapshots mismatch: %v", listed)
+	}
+
+	// filter by source volume id
+	resp, err := cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SourceVolumeId: volumeIDs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 2 {
+		t.Fatalf("expect 2 snapshots, got %d", len(resp.GetEntries()))
+	}
+	for _, entry := range resp.GetEntries() {
+		if entry.GetSnapshot().GetSourceVolumeId() != volumeIDs[0] {
+			t.Fatalf("snapshot source mismatch: %v", entry.GetSnapshot())
+		}
+	}
+
+	// filter by snapshot id
+	for snapshotID := range snapshotIDs {
+		resp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.GetEntries()) != 1 || resp.GetEntries()[0].GetSnapshot().GetSnapshotId() != snapshotID {
+			t.Fatalf("snapshot not listed: %s", snapshotID)
+		}
+	}
+	resp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SnapshotId: "no-such-snapshot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 0 {
+		t.Fatalf("expect no snapshots, got %d", len(resp.GetEntries()))
+	}
+
+	_, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{StartingToken: "invalid"})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("expect Aborted error, got: %v", err)
+	}
+
+	for snapshotID := range snapshotIDs {
+		_, err = cs.DeleteSnapshot(context.TODO(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, volumeID := range volumeIDs {
+		err = deleteTestVolume(cs, volumeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
 }
 
-func TestIscsiConcurrency(t *testing.T) {
-	testConcurrency("iscsi", t)
+func testTopology(targetType string, t *testing.T) {
+	cs, lvss, err := createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rack1 := map[string]string{"topology.spdk.io/rack": "rack1"}
+	cs.spdkNodes[0].topology = rack1
+
+	// no spdk node in rack2
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume-topology-rack2",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: map[string]string{"topology.spdk.io/rack": "rack2"}}},
+		},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expect ResourceExhausted error, got: %v", err)
+	}
+
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume-topology-rack1",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{
+				{Segments: map[string]string{"topology.spdk.io/rack": "rack2"}},
+				{Segments: map[string]string{"topology.spdk.io/rack": "rack1", "kubernetes.io/hostname": "node1"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topology := resp.GetVolume().GetAccessibleTopology()
+	if len(topology) != 1 || topology[0].GetSegments()["topology.spdk.io/rack"] != "rack1" {
+		t.Fatalf("accessible topology mismatch: %v", topology)
+	}
+
+	err = deleteTestVolume(cs, resp.GetVolume().GetVolumeId())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
 }
 
-func testVolume(targetType string, t *testing.T) {
+func testQos(targetType string, t *testing.T) {
 	cs, lvss, err := createTestController(targetType)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	const volumeName = "test-volume"
-	const volumeSize = 256 * 1024 * 1024
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume-qos",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		Parameters:    map[string]string{"rwIosPerSec": "10000", "wMBytesPerSec": "100"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	err = verifyQos(cs, volumeID, util.QosLimits{RWIOsPerSec: 10000, WMBytesPerSec: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// create volume#1
-	volumeID1, err := createTestVolume(cs, volumeName, volumeSize)
+	// mutable parameters at creation override StorageClass parameters
+	parameters := map[string]string{"wMBytesPerSec": "100"}
+	resp, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:              "test-volume-qos-vac",
+		CapacityRange:     &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		Parameters:        parameters,
+		MutableParameters: map[string]string{"wMBytesPerSec": "150", "rMBytesPerSec": "30"},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// delete volume#1
-	err = deleteTestVolume(cs, volumeID1)
+	err = verifyQos(cs, resp.GetVolume().GetVolumeId(), util.QosLimits{WMBytesPerSec: 150, RMBytesPerSec: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parameters["wMBytesPerSec"] != "100" || len(parameters) != 1 {
+		t.Fatalf("request parameters modified: %v", parameters)
+	}
+	err = deleteTestVolume(cs, resp.GetVolume().GetVolumeId())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// create volume#2 with same name
-	volumeID2, err := createTestVolume(cs, volumeName, volumeSize)
+	// retune write limit, remove iops limit, keep others
+	_, err = cs.ControllerModifyVolume(context.TODO(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{"rwIosPerSec": "0", "wMBytesPerSec": "200", "rMBytesPerSec": "50"},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// delete volume#2
-	err = deleteTestVolume(cs, volumeID2)
+	err = verifyQos(cs, volumeID, util.QosLimits{WMBytesPerSec: 200, RMBytesPerSec: 50})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// make sure volumeID1 != volumeID2
-	if volumeID1 == volumeID2 {
-		t.Fatal("volume id should be different")
+	_, err = cs.ControllerModifyVolume(context.TODO(), &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{"thinProvision": "false"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error, got: %v", err)
+	}
+
+	// qos restored after controller restart
+	cs, _, err = createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyQos(cs, volumeID, util.QosLimits{WMBytesPerSec: 200, RMBytesPerSec: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// make sure we didn't leave any garbage in lvstores
 	if !verifyLVSS(cs, lvss) {
 		t.Fatal("lvstore status doesn't match")
 	}
 }
 
-func testIdempotency(targetType string, t *testing.T) {
+// verify qos limits on spdk node and in ControllerGetVolume volume context
+func verifyQos(cs *controllerServer, volumeID string, qos util.QosLimits) error {
+	resp, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		return err
+	}
+	var contextQos util.QosLimits
+	err = parseQos(resp.GetVolume().GetVolumeContext(), &contextQos)
+	if err != nil {
+		return err
+	}
+	if contextQos != qos {
+		return fmt.Errorf("volume context qos mismatch: %+v", contextQos)
+	}
+
+	lvols, err := cs.volumes[volumeID].spdkNode.Lvols()
+	if err != nil {
+		return err
+	}
+	for i := range lvols {
+		if lvols[i].ID == volumeID {
+			if lvols[i].Qos != qos {
+				return fmt.Errorf("lvol qos mismatch: %+v", lvols[i].Qos)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("lvol not found: %s", volumeID)
+}
+
+//nolint:cyclop // many checks increases complexity
+func testEncryption(targetType string, t *testing.T) {
 	cs, lvss, err := createTestController(targetType)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	const volumeName = "test-volume-idem"
-	const requestCount = 50
-	const volumeSize = 256 * 1024 * 1024
+	req := &csi.CreateVolumeRequest{
+		Name:          "test-volume-encryption",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		Parameters:    map[string]string{"encryption": "true"},
+	}
+	_, err = cs.CreateVolume(context.TODO(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error without master key, got: %v", err)
+	}
 
-	volumeID, err := createSameVolumeInParallel(cs, volumeName, requestCount, volumeSize)
+	req.Secrets = map[string]string{"encryptionKey": strings.Repeat("0123456789abcdef", 4)}
+	resp, err := cs.CreateVolume(context.TODO(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = deleteSameVolumeInParallel(cs, volumeID, requestCount)
+	volumeID := resp.GetVolume().GetVolumeId()
+	err = verifyEncrypted(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cs.CreateSnapshot(context.TODO(), &csi.CreateSnapshotRequest{
+		Name:           "test-snapshot-encryption",
+		SourceVolumeId: volumeID,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error on snapshot, got: %v", err)
+	}
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name: "test-clone-encryption",
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID},
+			},
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error on clone, got: %v", err)
+	}
+
+	// encrypted volume restored and still idempotent after controller restart
+	cs, _, err = createTestController(targetType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyEncrypted(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = cs.CreateVolume(context.TODO(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetVolume().GetVolumeId() != volumeID {
+		t.Fatalf("volume id mismatch: %s", resp.GetVolume().GetVolumeId())
+	}
+
+	err = deleteTestVolume(cs, volumeID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,42 +946,172 @@ func testIdempotency(targetType string, t *testing.T) {
 	}
 }
 
-func testConcurrency(targetType string, t *testing.T) {
+// verify volume is tracked and exported through crypto bdev
+func verifyEncrypted(cs *controllerServer, volumeID string) error {
+	volume, exists := cs.volumes[volumeID]
+	if !exists {
+		return fmt.Errorf("volume not found: %s", volumeID)
+	}
+	lvols, err := volume.spdkNode.Lvols()
+	if err != nil {
+		return err
+	}
+	for i := range lvols {
+		if lvols[i].ID == volumeID {
+			if !lvols[i].Encrypted || !strings.HasPrefix(lvols[i].Name, encryptedPrefix) {
+				return fmt.Errorf("volume not encrypted: %+v", lvols[i])
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("lvol not found: %s", volumeID)
+}
+
+//nolint:cyclop // testMultiNode exceeds cyclomatic complexity of 10
+func testMultiNode(targetType string, t *testing.T) {
 	cs, lvss, err := createTestController(targetType)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// count * size cannot exceed storage capacity
-	const volumeNamePrefix = "test-volume-con-"
-	const volumeCount = 20
-	const volumeSize = 16 * 1024 * 1024
+	multiWriter := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: multiWriter,
+	}
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: multiWriter,
+	}
 
-	// create/delete multiple volumes in parallel
-	var wg sync.WaitGroup
-	var errCount int32
-	for i := 0; i < volumeCount; i++ {
-		volumeName := fmt.Sprintf("%s%d", volumeNamePrefix, i)
-		wg.Add(1)
-		go func(volumeNameLocal string) {
-			defer wg.Done()
+	// filesystem cannot be written from multiple nodes
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:               "test-volume-multi-node-fs",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error, got: %v", err)
+	}
 
-			volumeIDLocal, errLocal := createTestVolume(cs, volumeNameLocal, volumeSize)
-			if errLocal != nil {
-				t.Logf("createTestVolume failed: %s", errLocal)
-				atomic.AddInt32(&errCount, 1)
-			}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:               "test-volume-multi-node",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		VolumeCapabilities: []*csi.VolumeCapability{blockCap},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
 
-			errLocal = deleteTestVolume(cs, volumeIDLocal)
-			if errLocal != nil {
-				t.Logf("deleteTestVolume failed: %s", errLocal)
-				atomic.AddInt32(&errCount, 1)
-			}
-		}(volumeName)
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "test-node-0",
+		VolumeCapability: mountCap,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error, got: %v", err)
 	}
-	wg.Wait()
-	if errCount != 0 {
-		t.Fatal("concurrency test failed")
+
+	// node without host id cannot be allowed
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "test-node-0",
+		VolumeCapability: blockCap,
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition error, got: %v", err)
+	}
+
+	nodeIDs := make([]string, 2)
+	for i := range nodeIDs {
+		nodeIDs[i] = testNodeID(fmt.Sprintf("test-node-%d", i+1))
+		_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeIDs[i],
+			VolumeCapability: blockCap,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = verifyPublishedNodes(cs, volumeID, nodeIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// volume stays attached to remaining node
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeIDs[0],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyPublishedNodes(cs, volumeID, nodeIDs[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// single node access mode cannot join other nodes
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeIDs[0],
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: blockCap.AccessType,
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition error, got: %v", err)
+	}
+	// node re-registered with another host id is same node as its previous id
+	changedID := util.EncodeNodeID("test-node-2", util.HostID{
+		NQN: "nqn.2014-08.org.nvmexpress:uuid:test-node-2-changed",
+		IQN: "iqn.2016-06.io.spdk:test-node-2-changed",
+	})
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   changedID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: blockCap.AccessType,
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyPublishedNodes(cs, volumeID, []string{changedID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           nodeIDs[1],
+		VolumeCapability: blockCap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyPublishedNodes(cs, volumeID, nodeIDs[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeIDs[1],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyPublishedNodes(cs, volumeID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	if !verifyLVSS(cs, lvss) {
@@ -148,6 +1119,85 @@ func testConcurrency(targetType string, t *testing.T) {
 	}
 }
 
+// node id reported by NodeGetInfo of a node with host nqn and initiator name
+func testNodeID(name string) string {
+	return util.EncodeNodeID(name, util.HostID{
+		NQN: "nqn.2014-08.org.nvmexpress:uuid:" + name,
+		IQN: "iqn.2016-06.io.spdk:" + name,
+	})
+}
+
+// verify nodes of the volume reported by ListVolumes
+func verifyPublishedNodes(cs *controllerServer, volumeID string, nodeIDs []string) error {
+	resp, err := cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	if err != nil {
+		return err
+	}
+	for _, entry := range resp.GetEntries() {
+		if entry.GetVolume().GetVolumeId() != volumeID {
+			continue
+		}
+		publishedNodes := entry.GetStatus().GetPublishedNodeIds()
+		if len(publishedNodes) != len(nodeIDs) {
+			return fmt.Errorf("published nodes mismatch: %v", publishedNodes)
+		}
+		for i := range nodeIDs {
+			if publishedNodes[i] != nodeIDs[i] {
+				return fmt.Errorf("published nodes mismatch: %v", publishedNodes)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("volume not listed: %s", volumeID)
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	cs, _, err := createTestController("nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	})
+	multiWriter := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+
+	accessMode := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}
+	for _, tc := range []struct {
+		capability *csi.VolumeCapability
+		confirmed  bool
+	}{
+		{&csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: accessMode,
+		}, true},
+		{&csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: accessMode,
+		}, true},
+		{&csi.VolumeCapability{AccessMode: accessMode}, false}, // no access type
+		{&csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: multiWriter,
+		}, true},
+		{&csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: multiWriter,
+		}, false}, // filesystem of multiple writers
+	} {
+		resp, err := cs.ValidateVolumeCapabilities(context.TODO(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           "test-volume",
+			VolumeCapabilities: []*csi.VolumeCapability{tc.capability},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (resp.GetConfirmed() != nil) != tc.confirmed {
+			t.Fatalf("capability %v confirmed: %v", tc.capability, resp.GetConfirmed() != nil)
+		}
+	}
+}
+
 func createTestController(targetType string) (cs *controllerServer, lvss [][]util.LvStore, err error) {
 	err = createConfigFiles(targetType)
 	if err != nil {
@@ -259,6 +1309,25 @@ func createTestVolume(cs *controllerServer, name string, size int64) (string, er
 	return volumeID, nil
 }
 
+func createTestSnapshot(cs *controllerServer, name, volumeID string) (string, error) {
+	reqCreate := csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: volumeID,
+	}
+
+	resp, err := cs.CreateSnapshot(context.TODO(), &reqCreate)
+	if err != nil {
+		return "", err
+	}
+
+	snapshotID := resp.GetSnapshot().GetSnapshotId()
+	if snapshotID == "" {
+		return "", fmt.Errorf("empty snapshot id")
+	}
+
+	return snapshotID, nil
+}
+
 func deleteTestVolume(cs *controllerServer, volumeID string) error {
 	reqDelete := csi.DeleteVolumeRequest{VolumeId: volumeID}
 	_, err := cs.DeleteVolume(context.TODO(), &reqDelete)
@@ -18,6 +18,7 @@ package spdk
 
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
@@ -34,9 +35,21 @@ func Run(conf *util.Config) {
 		controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 		}
 		volumeModes = []csi.VolumeCapability_AccessMode_Mode{
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			// MULTI_NODE_MULTI_WRITER is for raw block volumes only
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		}
 	)
 
@@ -65,6 +78,21 @@ func Run(conf *util.Config) {
 		if err != nil {
 			klog.Fatalf("failed to create controller server: %s", err)
 		}
+		go cs.watchConfig(configReloadInterval)
+		go cs.watchHealth(healthCheckInterval)
+		prometheus.MustRegister(newControllerCollector(cs))
+		if cs.iostatInterval > 0 {
+			iostats := newIOStatCollector()
+			prometheus.MustRegister(iostats)
+			go cs.watchIOStats(cs.iostatInterval, iostats)
+		}
+	}
+
+	if conf.MetricsAddress != "" {
+		err := util.StartMetricsServer(conf.MetricsAddress)
+		if err != nil {
+			klog.Fatalf("failed to start metrics server: %s", err)
+		}
 	}
 
 	s := csicommon.NewNonBlockingGRPCServer()
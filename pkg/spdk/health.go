@@ -0,0 +1,197 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+const (
+	healthCheckInterval = 10 * time.Second
+	// hysteresis of health state, a node goes down after consecutive failed
+	// probes, and back to healthy after consecutive successful probes
+	healthDownThreshold = 3
+	healthUpThreshold   = 2
+)
+
+// health state of spdk node, only healthy node is scheduled new volumes
+type healthState int
+
+const (
+	nodeHealthy  healthState = iota
+	nodeDegraded             // failed recent probes, or recovering from down
+	nodeDown
+)
+
+func (state healthState) String() string {
+	switch state {
+	case nodeHealthy:
+		return "healthy"
+	case nodeDegraded:
+		return "degraded"
+	case nodeDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// nodeHealth tracks probe results of spdk node, a new node is assumed
+// healthy until probed
+type nodeHealth struct {
+	mtx       sync.Mutex
+	state     healthState
+	failures  int   // consecutive failed probes
+	successes int   // consecutive successful probes
+	lastErr   error // error of last failed probe
+	// lvstores queried in last probe, nil if it failed, served to metrics
+	// scrapes so they never query spdk nodes
+	lvstores []util.LvStore
+}
+
+// record a probe result, returns old and new state
+func (health *nodeHealth) record(err error) (oldState, newState healthState) {
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+
+	oldState = health.state
+	if err != nil {
+		health.failures++
+		health.successes = 0
+		health.lastErr = err
+		if health.failures >= healthDownThreshold {
+			health.state = nodeDown
+		} else if health.state == nodeHealthy {
+			health.state = nodeDegraded
+		}
+	} else {
+		health.successes++
+		health.failures = 0
+		if health.state == nodeDown {
+			// down node recovers through degraded
+			health.state = nodeDegraded
+		}
+		if health.successes >= healthUpThreshold {
+			health.state = nodeHealthy
+		}
+	}
+	return oldState, health.state
+}
+
+func (health *nodeHealth) get() (healthState, error) {
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+	return health.state, health.lastErr
+}
+
+func (health *nodeHealth) setLvStores(lvstores []util.LvStore) {
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+	health.lvstores = lvstores
+}
+
+func (health *nodeHealth) getLvStores() []util.LvStore {
+	health.mtx.Lock()
+	defer health.mtx.Unlock()
+	return health.lvstores
+}
+
+// node is skipped in scheduling if it's in maintenance or not healthy
+func (node *storageNode) schedulable() bool {
+	state, _ := node.health.get()
+	return state == nodeHealthy && !node.maintenance.Load()
+}
+
+// record probe result, or failure of other rpc calls so the node is excluded
+// from scheduling without waiting for next probe
+func (node *storageNode) updateHealth(err error) {
+	oldState, newState := node.health.record(err)
+	nodeHealthGauge.WithLabelValues(node.name).Set(float64(newState))
+	if oldState == newState {
+		return
+	}
+	if err != nil {
+		klog.Errorf("spdk node %s is %s: %s", node.name, newState, err.Error())
+	} else {
+		klog.Infof("spdk node %s is %s", node.name, newState)
+	}
+}
+
+// condition of volume hosted on spdk node, abnormal if node is not healthy
+func (node *storageNode) volumeCondition() *csi.VolumeCondition {
+	state, err := node.health.get()
+	if state == nodeHealthy {
+		return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	}
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("spdk node %s is %s: %v", node.name, state, err),
+	}
+}
+
+// condition of volume, abnormal if crypto bdev of encrypted volume is lost
+// or spdk node is not healthy, caller must hold cs.mtx
+func (volume *volume) condition() *csi.VolumeCondition {
+	if volume.keyLost {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "crypto bdev of encrypted volume is lost, volume is not published until key is provided",
+		}
+	}
+	return volume.spdkNode.volumeCondition()
+}
+
+// checkHealth probes all spdk nodes in parallel, so a down node doesn't
+// delay probing others. Lvstores of responsive nodes are cached for metrics.
+func (cs *controllerServer) checkHealth() {
+	var wg sync.WaitGroup
+	for _, spdkNode := range cs.storageNodes() {
+		wg.Add(1)
+		go func(spdkNode *storageNode) {
+			defer wg.Done()
+			spdkNode.probe()
+		}(spdkNode)
+	}
+	wg.Wait()
+}
+
+// probe spdk node and cache its lvstores
+func (node *storageNode) probe() {
+	var lvstores []util.LvStore
+	err := node.Ping()
+	if err == nil {
+		lvstores, err = node.LvStores()
+	}
+	node.updateHealth(err)
+	node.health.setLvStores(lvstores)
+}
+
+// watchHealth probes spdk nodes periodically, never returns
+func (cs *controllerServer) watchHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cs.checkHealth()
+	}
+}
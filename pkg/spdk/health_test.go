@@ -0,0 +1,96 @@
+package spdk
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeHealth(t *testing.T) {
+	errProbe := errors.New("probe failed")
+	var health nodeHealth
+	for i, c := range []struct {
+		err   error
+		state healthState
+	}{
+		{errProbe, nodeDegraded},
+		{nil, nodeDegraded},
+		{nil, nodeHealthy},
+		{errProbe, nodeDegraded},
+		{errProbe, nodeDegraded},
+		{errProbe, nodeDown},
+		{nil, nodeDegraded},
+		{errProbe, nodeDegraded},
+		{nil, nodeDegraded},
+		{nil, nodeHealthy},
+	} {
+		if _, state := health.record(c.err); state != c.state {
+			t.Fatalf("probe %d: expect %s, got %s", i, c.state, state)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	cs, _, err := createTestController("nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spdkNode := cs.storageNodes()[0]
+	volumeID, err := createTestVolume(cs, "test-volume-health", 64*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		spdkNode.SetRPCCredentials("spdkcsiuser", "spdkcsipass")
+		if err := deleteTestVolume(cs, volumeID); err != nil {
+			t.Error(err)
+		}
+	}()
+	verifyCondition := func(abnormal bool) {
+		resp, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetStatus().GetVolumeCondition().GetAbnormal() != abnormal {
+			t.Fatalf("unexpected volume condition: %v", resp.GetStatus().GetVolumeCondition())
+		}
+	}
+
+	cs.checkHealth()
+	verifyCondition(false)
+
+	// unreachable node is excluded from scheduling after first failed probe
+	spdkNode.SetRPCCredentials("spdkcsiuser", "wrong")
+	cs.checkHealth()
+	if state, _ := spdkNode.health.get(); state != nodeDegraded {
+		t.Fatalf("spdk node should be degraded: %s", state)
+	}
+	verifyCondition(true)
+	_, err = createTestVolume(cs, "test-volume-health-2", 64*1024*1024)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("volume should not be scheduled to unhealthy node: %v", err)
+	}
+	for i := 1; i < healthDownThreshold; i++ {
+		cs.checkHealth()
+	}
+	if state, _ := spdkNode.health.get(); state != nodeDown {
+		t.Fatalf("spdk node should be down: %s", state)
+	}
+
+	// and back to scheduling after consecutive successful probes
+	spdkNode.SetRPCCredentials("spdkcsiuser", "spdkcsipass")
+	for i := 0; i < healthUpThreshold; i++ {
+		if spdkNode.schedulable() {
+			t.Fatal("spdk node should not be schedulable before recovery")
+		}
+		cs.checkHealth()
+	}
+	if !spdkNode.schedulable() {
+		t.Fatal("spdk node should be schedulable")
+	}
+	verifyCondition(false)
+}
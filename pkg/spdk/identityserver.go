@@ -44,10 +44,17 @@ func (ids *identityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPl
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_UNKNOWN,
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 					},
 				},
 			},
@@ -0,0 +1,225 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+const defaultIOStatInterval = 30 * time.Second
+
+// pvc of volume, passed in CreateVolume parameters by external-provisioner
+// with --extra-create-metadata
+const (
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// I/O statistics of a volume, labelled by volume id, pvc and spdk node
+type volumeIOStat struct {
+	volumeID     string
+	pvcName      string
+	pvcNamespace string
+	node         string
+	stat         util.IOStat
+}
+
+// iostatCollector exports I/O statistics of volumes collected in last round
+// on each scrape, volumes deleted since then are dropped in next round
+type iostatCollector struct {
+	mtx   sync.Mutex
+	stats []volumeIOStat
+
+	readOps      *prometheus.Desc
+	readBytes    *prometheus.Desc
+	writeOps     *prometheus.Desc
+	writeBytes   *prometheus.Desc
+	readLatency  *prometheus.Desc
+	writeLatency *prometheus.Desc
+}
+
+func newIOStatCollector() *iostatCollector {
+	labels := []string{"volume_id", "pvc", "namespace", "node"}
+	return &iostatCollector{
+		readOps: prometheus.NewDesc("spdkcsi_volume_read_ops_total",
+			"Read operations completed on volume.", labels, nil),
+		readBytes: prometheus.NewDesc("spdkcsi_volume_read_bytes_total",
+			"Bytes read from volume.", labels, nil),
+		writeOps: prometheus.NewDesc("spdkcsi_volume_write_ops_total",
+			"Write operations completed on volume.", labels, nil),
+		writeBytes: prometheus.NewDesc("spdkcsi_volume_write_bytes_total",
+			"Bytes written to volume.", labels, nil),
+		readLatency: prometheus.NewDesc("spdkcsi_volume_read_latency_seconds_total",
+			"Total time spent on reads of volume.", labels, nil),
+		writeLatency: prometheus.NewDesc("spdkcsi_volume_write_latency_seconds_total",
+			"Total time spent on writes of volume.", labels, nil),
+	}
+}
+
+func (collector *iostatCollector) update(stats []volumeIOStat) {
+	collector.mtx.Lock()
+	defer collector.mtx.Unlock()
+	collector.stats = stats
+}
+
+func (collector *iostatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.readOps
+	ch <- collector.readBytes
+	ch <- collector.writeOps
+	ch <- collector.writeBytes
+	ch <- collector.readLatency
+	ch <- collector.writeLatency
+}
+
+func (collector *iostatCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.mtx.Lock()
+	defer collector.mtx.Unlock()
+	for i := range collector.stats {
+		s := &collector.stats[i]
+		labels := []string{s.volumeID, s.pvcName, s.pvcNamespace, s.node}
+		ch <- prometheus.MustNewConstMetric(collector.readOps, prometheus.CounterValue, float64(s.stat.ReadOps), labels...)
+		ch <- prometheus.MustNewConstMetric(collector.readBytes, prometheus.CounterValue, float64(s.stat.ReadBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(collector.writeOps, prometheus.CounterValue, float64(s.stat.WriteOps), labels...)
+		ch <- prometheus.MustNewConstMetric(collector.writeBytes, prometheus.CounterValue, float64(s.stat.WriteBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(collector.readLatency, prometheus.CounterValue, s.stat.ReadLatencySeconds, labels...)
+		ch <- prometheus.MustNewConstMetric(collector.writeLatency, prometheus.CounterValue, s.stat.WriteLatencySeconds, labels...)
+	}
+}
+
+// collectIOStats queries bdev iostat of healthy spdk nodes hosting volumes,
+// one rpc call per node
+func (cs *controllerServer) collectIOStats() []volumeIOStat {
+	volumesByNode := make(map[*storageNode][]volumeIOStat)
+	cs.mtx.Lock()
+	for volumeID, volume := range cs.volumes {
+		volumesByNode[volume.spdkNode] = append(volumesByNode[volume.spdkNode], volumeIOStat{
+			volumeID:     volumeID,
+			pvcName:      volume.pvcName,
+			pvcNamespace: volume.pvcNamespace,
+			node:         volume.spdkNode.name,
+		})
+	}
+	cs.mtx.Unlock()
+
+	var stats []volumeIOStat
+	for spdkNode, volumes := range volumesByNode {
+		if state, _ := spdkNode.health.get(); state != nodeHealthy {
+			continue
+		}
+		bdevStats, err := spdkNode.IOStats()
+		if err != nil {
+			klog.Errorf("failed to get iostat from node %s: %s", spdkNode.Info(), err.Error())
+			spdkNode.updateHealth(err)
+			continue
+		}
+		for i := range volumes {
+			stat, exists := bdevStats[volumes[i].volumeID]
+			if !exists {
+				continue
+			}
+			volumes[i].stat = stat
+			stats = append(stats, volumes[i])
+		}
+	}
+	return stats
+}
+
+// resolvePVCs looks up pvc of volumes restored after controller restart from
+// claimRef of their PersistentVolumes, each volume is looked up once
+func (cs *controllerServer) resolvePVCs(client kubernetes.Interface) {
+	var unresolved []string
+	cs.mtx.Lock()
+	for volumeID, volume := range cs.volumes {
+		if !volume.pvcResolved {
+			unresolved = append(unresolved, volumeID)
+		}
+	}
+	cs.mtx.Unlock()
+	if len(unresolved) == 0 {
+		return
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("failed to list persistent volumes: %s", err.Error())
+		return
+	}
+	claims := make(map[string]*corev1.ObjectReference) // volume id to pvc
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.ClaimRef != nil {
+			claims[pv.Spec.CSI.VolumeHandle] = pv.Spec.ClaimRef
+		}
+	}
+
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for _, volumeID := range unresolved {
+		volume, exists := cs.volumes[volumeID]
+		if !exists {
+			continue
+		}
+		if claim, found := claims[volumeID]; found {
+			volume.pvcName = claim.Name
+			volume.pvcNamespace = claim.Namespace
+		}
+		volume.pvcResolved = true
+	}
+}
+
+// kubernetes client to look up pvc of restored volumes, nil if controller is
+// not running in cluster
+func (cs *controllerServer) pvcClient() kubernetes.Interface {
+	if cs.nodeWatcher != nil {
+		return cs.nodeWatcher.clientset
+	}
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		var clientset *kubernetes.Clientset
+		clientset, err = kubernetes.NewForConfig(config)
+		if err == nil {
+			return clientset
+		}
+	}
+	klog.Warningf("pvc of volumes restored after controller restart is unknown: %s", err.Error())
+	return nil
+}
+
+// watchIOStats collects I/O statistics of volumes periodically, never returns
+func (cs *controllerServer) watchIOStats(interval time.Duration, collector *iostatCollector) {
+	client := cs.pvcClient()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if client != nil {
+			cs.resolvePVCs(client)
+		}
+		collector.update(cs.collectIOStats())
+		<-ticker.C
+	}
+}
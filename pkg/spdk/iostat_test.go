@@ -0,0 +1,180 @@
+package spdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// fake spdk json rpc server, replies bdev_get_iostat with fixed statistics
+// of given bdevs
+func newFakeIOStatServer(t *testing.T, bdevs ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID     int32  `json:"id"`
+			Method string `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+		if request.Method == "bdev_get_iostat" {
+			stats := make([]map[string]interface{}, 0, len(bdevs))
+			for _, bdev := range bdevs {
+				stats = append(stats, map[string]interface{}{
+					"name":                bdev,
+					"bytes_read":          8192,
+					"num_read_ops":        2,
+					"bytes_written":       4096,
+					"num_write_ops":       1,
+					"read_latency_ticks":  3000,
+					"write_latency_ticks": 1000,
+				})
+			}
+			response["result"] = map[string]interface{}{"tick_rate": 1000, "ticks": 1, "bdevs": stats}
+		} else {
+			response["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+		}
+		json.NewEncoder(w).Encode(response) //nolint:errcheck // only for test
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newFakeIOStatNode(t *testing.T, name string, bdevs ...string) *storageNode {
+	server := newFakeIOStatServer(t, bdevs...)
+	spdkNode, err := newStorageNode(
+		&spdkNodeConfig{Name: name, URL: server.URL, TargetType: "nvme-tcp", TargetAddr: "127.0.0.1"},
+		&rpcToken{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spdkNode
+}
+
+//nolint:cyclop // TestIOStats exceeds cyclomatic complexity of 10
+func TestIOStats(t *testing.T) {
+	node1 := newFakeIOStatNode(t, "node1", "volume-1", "volume-2", "other-bdev")
+	node2 := newFakeIOStatNode(t, "node2", "volume-3")
+	cs := &controllerServer{
+		spdkNodes: []*storageNode{node1, node2},
+		volumes: map[string]*volume{
+			"volume-1": {spdkNode: node1, pvcName: "pvc-1", pvcNamespace: "default"},
+			"volume-2": {spdkNode: node1}, // restored, pvc unknown
+			"volume-3": {spdkNode: node2, pvcName: "pvc-3", pvcNamespace: "default"},
+			"volume-4": {spdkNode: node1}, // not found on node
+		},
+	}
+
+	// volumes on unhealthy node are skipped
+	for i := 0; i < healthDownThreshold; i++ {
+		node2.updateHealth(errors.New("probe failed"))
+	}
+	collector := newIOStatCollector()
+	collector.update(cs.collectIOStats())
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]map[string]float64) // metric name to volume id to value
+	for _, family := range families {
+		values[family.GetName()] = make(map[string]float64)
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["volume_id"] == "volume-1" && (labels["pvc"] != "pvc-1" || labels["namespace"] != "default" || labels["node"] != "node1") {
+				t.Fatalf("unexpected labels of volume-1: %v", labels)
+			}
+			values[family.GetName()][labels["volume_id"]] = metric.GetCounter().GetValue()
+		}
+	}
+
+	readOps := values["spdkcsi_volume_read_ops_total"]
+	if len(readOps) != 2 || readOps["volume-1"] != 2 || readOps["volume-2"] != 2 {
+		t.Fatalf("unexpected read ops: %v", readOps)
+	}
+	if values["spdkcsi_volume_write_bytes_total"]["volume-1"] != 4096 {
+		t.Fatalf("unexpected write bytes: %v", values["spdkcsi_volume_write_bytes_total"])
+	}
+	// latency ticks per tick rate
+	if values["spdkcsi_volume_read_latency_seconds_total"]["volume-1"] != 3 ||
+		values["spdkcsi_volume_write_latency_seconds_total"]["volume-1"] != 1 {
+		t.Fatalf("unexpected latency: %v", values)
+	}
+
+	// pvc of restored volumes is looked up from persistent volumes
+	client := kubefake.NewSimpleClientset(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-2"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{VolumeHandle: "volume-2"}},
+			ClaimRef:               &corev1.ObjectReference{Name: "pvc-2", Namespace: "default"},
+		},
+	})
+	cs.volumes["volume-1"].pvcResolved = true
+	cs.resolvePVCs(client)
+	for volumeID, volume := range cs.volumes {
+		if !volume.pvcResolved {
+			t.Fatalf("pvc of %s not resolved", volumeID)
+		}
+	}
+	if volume := cs.volumes["volume-2"]; volume.pvcName != "pvc-2" || volume.pvcNamespace != "default" {
+		t.Fatalf("unexpected pvc of volume-2: %s/%s", volume.pvcNamespace, volume.pvcName)
+	}
+	if volume := cs.volumes["volume-1"]; volume.pvcName != "pvc-1" {
+		t.Fatalf("pvc of volume-1 changed: %s", volume.pvcName)
+	}
+}
+
+func TestVolumePVC(t *testing.T) {
+	cs, _, err := createTestController("nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parameters := map[string]string{paramPVCName: "pvc-1", paramPVCNamespace: "default"}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume-pvc",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+		Parameters:    parameters,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	defer func() {
+		if err := deleteTestVolume(cs, volumeID); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	cs.mtx.Lock()
+	volume := cs.volumes[volumeID]
+	cs.mtx.Unlock()
+	if volume.pvcName != "pvc-1" || volume.pvcNamespace != "default" || !volume.pvcResolved {
+		t.Fatalf("unexpected pvc of volume: %s/%s", volume.pvcNamespace, volume.pvcName)
+	}
+	// volume info is not merged into request parameters
+	if len(parameters) != 2 || len(resp.GetVolume().GetVolumeContext()) <= 2 {
+		t.Fatalf("request parameters modified: %v", parameters)
+	}
+	for _, stat := range cs.collectIOStats() {
+		if stat.volumeID == volumeID && stat.pvcName == "pvc-1" {
+			return
+		}
+	}
+	t.Fatal("iostat of volume not collected")
+}
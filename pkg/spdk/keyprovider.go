@@ -0,0 +1,181 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// sources of volume encryption keys, selected by "keyProvider" parameter of
+// StorageClass
+const (
+	keyProviderSecret = "secret" // derived from master key in provisioner secrets
+	keyProviderFile   = "file"   // random keys stored in "kmsDir" of config map
+)
+
+const (
+	// provisioner secret holding hex encoded master key of "secret" provider
+	secretEncryptionKey = "encryptionKey"
+	minMasterKeyBytes   = 32
+	// spdk software crypto, 256 bits key and tweak key
+	cryptoCipher   = "AES_XTS"
+	cryptoKeyBytes = 32
+)
+
+// keyProvider supplies data encryption keys of encrypted volumes
+//   - volumeKey returns the key of the volume named lvolName, same key must
+//     be returned for same volume and secrets.
+//   - existingKey returns the key of an existing volume to re-create its
+//     crypto bdev, a key is never generated. FailedPrecondition error if
+//     the key cannot be recovered from secrets or the provider.
+//   - deleteKey forgets the key of a deleted volume, no error if the key
+//     doesn't exist.
+type keyProvider interface {
+	volumeKey(lvolName string, secrets map[string]string) (util.CryptoKey, error)
+	existingKey(lvolName string, secrets map[string]string) (util.CryptoKey, error)
+	deleteKey(lvolName string) error
+}
+
+// key providers of all kinds, file provider is available only if kmsDir is
+// configured
+func newKeyProviders(kmsDir string) map[string]keyProvider {
+	providers := map[string]keyProvider{
+		keyProviderSecret: secretKeyProvider{},
+	}
+	if kmsDir != "" {
+		providers[keyProviderFile] = fileKeyProvider{dir: kmsDir}
+	}
+	return providers
+}
+
+// derive per volume keys from master key with HMAC-SHA256, so nothing is
+// stored and keys are recovered from the same secret
+type secretKeyProvider struct{}
+
+func (secretKeyProvider) volumeKey(lvolName string, secrets map[string]string) (util.CryptoKey, error) {
+	value, exists := secrets[secretEncryptionKey]
+	if !exists {
+		return util.CryptoKey{}, status.Errorf(codes.InvalidArgument, "provisioner secret %s must be provided", secretEncryptionKey)
+	}
+	masterKey, err := hex.DecodeString(value)
+	if err != nil || len(masterKey) < minMasterKeyBytes {
+		return util.CryptoKey{}, status.Errorf(codes.InvalidArgument, "%s must be at least %d bytes hex encoded", secretEncryptionKey, minMasterKeyBytes)
+	}
+
+	derive := func(purpose string) string {
+		mac := hmac.New(sha256.New, masterKey)
+		mac.Write([]byte(lvolName + "/" + purpose))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	return util.CryptoKey{
+		Cipher: cryptoCipher,
+		Key:    derive("key"),
+		Key2:   derive("key2"),
+	}, nil
+}
+
+func (provider secretKeyProvider) existingKey(lvolName string, secrets map[string]string) (util.CryptoKey, error) {
+	if _, exists := secrets[secretEncryptionKey]; !exists {
+		return util.CryptoKey{}, status.Errorf(codes.FailedPrecondition, "secret %s must be provided to recover key of %s", secretEncryptionKey, lvolName)
+	}
+	return provider.volumeKey(lvolName, secrets)
+}
+
+func (secretKeyProvider) deleteKey(string) error {
+	return nil
+}
+
+// stand-in of an external KMS, random keys are generated per volume and
+// stored in files under dir, accessible only by owner
+type fileKeyProvider struct {
+	dir string
+}
+
+func (provider fileKeyProvider) volumeKey(lvolName string, _ map[string]string) (util.CryptoKey, error) {
+	key, err := provider.storedKey(lvolName)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return util.CryptoKey{}, err
+	}
+
+	random := make([]byte, 2*cryptoKeyBytes)
+	_, err = rand.Read(random)
+	if err != nil {
+		return util.CryptoKey{}, err
+	}
+	key = util.CryptoKey{
+		Cipher: cryptoCipher,
+		Key:    hex.EncodeToString(random[:cryptoKeyBytes]),
+		Key2:   hex.EncodeToString(random[cryptoKeyBytes:]),
+	}
+	data, err := json.Marshal(&key)
+	if err != nil {
+		return util.CryptoKey{}, err
+	}
+	err = os.WriteFile(provider.keyPath(lvolName), data, 0o600)
+	if err != nil {
+		return util.CryptoKey{}, fmt.Errorf("failed to store key of %s: %w", lvolName, err)
+	}
+	return key, nil
+}
+
+// key of existing volume, os.ErrNotExist if the volume has no stored key
+func (provider fileKeyProvider) storedKey(lvolName string) (util.CryptoKey, error) {
+	var key util.CryptoKey
+	err := util.ParseJSONFile(provider.keyPath(lvolName), &key)
+	return key, err
+}
+
+// key file that cannot be read is not lost, it must be fixed rather than
+// replaced by a new key
+func (provider fileKeyProvider) existingKey(lvolName string, _ map[string]string) (util.CryptoKey, error) {
+	key, err := provider.storedKey(lvolName)
+	if errors.Is(err, os.ErrNotExist) {
+		return util.CryptoKey{}, status.Errorf(codes.FailedPrecondition, "key of %s not found in %s", lvolName, provider.dir)
+	}
+	if err != nil {
+		return util.CryptoKey{}, status.Errorf(codes.Internal, "failed to read key of %s: %s", lvolName, err.Error())
+	}
+	return key, nil
+}
+
+func (provider fileKeyProvider) deleteKey(lvolName string) error {
+	err := os.Remove(provider.keyPath(lvolName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (provider fileKeyProvider) keyPath(lvolName string) string {
+	return filepath.Join(provider.dir, lvolName+".key")
+}
@@ -0,0 +1,267 @@
+package spdk
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+)
+
+func TestSecretKeyProvider(t *testing.T) {
+	provider := newKeyProviders("")[keyProviderSecret]
+	secrets := map[string]string{secretEncryptionKey: strings.Repeat("0123456789abcdef", 4)}
+
+	key1, err := provider.volumeKey("csi-enc-1", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1.Cipher != cryptoCipher || len(key1.Key) != 2*cryptoKeyBytes || key1.Key == key1.Key2 {
+		t.Fatalf("invalid key: %+v", key1)
+	}
+	again, err := provider.volumeKey("csi-enc-1", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != key1 {
+		t.Fatal("key of same volume changed")
+	}
+	key2, err := provider.volumeKey("csi-enc-2", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key2.Key == key1.Key || key2.Key2 == key1.Key2 {
+		t.Fatal("volumes share same key")
+	}
+
+	for _, secrets := range []map[string]string{
+		{},
+		{secretEncryptionKey: "not-hex"},
+		{secretEncryptionKey: "0123456789abcdef"}, // too short
+	} {
+		_, err = provider.volumeKey("csi-enc-1", secrets)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expect InvalidArgument error for %v, got: %v", secrets, err)
+		}
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	provider := newKeyProviders(dir)[keyProviderFile]
+
+	key1, err := provider.volumeKey("csi-enc-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1.Cipher != cryptoCipher || len(key1.Key) != 2*cryptoKeyBytes || key1.Key == key1.Key2 {
+		t.Fatalf("invalid key: %+v", key1)
+	}
+	info, err := os.Stat(filepath.Join(dir, "csi-enc-1.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file accessible by others: %v", info.Mode())
+	}
+	again, err := provider.volumeKey("csi-enc-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != key1 {
+		t.Fatal("key of same volume changed")
+	}
+
+	err = provider.deleteKey("csi-enc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no error if already deleted
+	err = provider.deleteKey("csi-enc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new key generated after deletion
+	key2, err := provider.volumeKey("csi-enc-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key2 == key1 {
+		t.Fatal("deleted key reused")
+	}
+}
+
+// lose crypto bdevs of volumes as if spdk target restarted, volumes are
+// unpublished and crypto bdevs and keys are deleted
+func loseCryptoBdevs(t *testing.T, cs *controllerServer, volumeIDs ...string) {
+	for _, volumeID := range volumeIDs {
+		spdkNode := cs.volumes[volumeID].spdkNode
+		if err := spdkNode.UnpublishVolume(volumeID); err != nil {
+			t.Fatal(err)
+		}
+		name := "csi-crypto-" + volumeID
+		// key in use by crypto bdev cannot be destroyed
+		for _, call := range [][2]string{
+			{"bdev_crypto_delete", `{"name": "` + name + `"}`},
+			{"accel_crypto_key_destroy", `{"key_name": "` + name + `"}`},
+		} {
+			body := `{"jsonrpc": "2.0", "id": 1, "method": "` + call[0] + `", "params": ` + call[1] + `}`
+			req, err := http.NewRequestWithContext(context.TODO(), http.MethodPost, "http://127.0.0.1:9009", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.SetBasicAuth("spdkcsiuser", "spdkcsipass")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+}
+
+//nolint:cyclop // TestEncryptedVolumeRecovery exceeds cyclomatic complexity of 10
+func TestEncryptedVolumeRecovery(t *testing.T) {
+	kmsDir := t.TempDir()
+	config := `{"nodes": [{"name": "localhost", "rpcURL": "http://127.0.0.1:9009", "targetType": "nvme-tcp", "targetAddr": "127.0.0.1"}], "kmsDir": "` + kmsDir + `"}`
+	writeConfigFiles(t, config, testNodeSecret)
+	cd := csicommon.NewCSIDriver("test-driver", "test-version", "test-node")
+	cs, err := newControllerServer(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lvss, err := getLVSS(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := map[string]string{secretEncryptionKey: strings.Repeat("0123456789abcdef", 4)}
+	volumeIDs := make(map[string]string) // key provider to volume id
+	for _, provider := range []string{keyProviderFile, keyProviderSecret} {
+		resp, errCreate := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:          "test-volume-recovery-" + provider,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1024 * 1024},
+			Parameters:    map[string]string{paramEncryption: "true", paramKeyProvider: provider},
+			Secrets:       secrets,
+		})
+		if errCreate != nil {
+			t.Fatal(errCreate)
+		}
+		volumeIDs[provider] = resp.GetVolume().GetVolumeId()
+	}
+	defer func() {
+		for _, volumeID := range volumeIDs {
+			if err := deleteTestVolume(cs, volumeID); err != nil {
+				t.Error(err)
+			}
+		}
+		if !verifyLVSS(cs, lvss) {
+			t.Error("lvstore status doesn't match")
+		}
+	}()
+
+	loseCryptoBdevs(t, cs, volumeIDs[keyProviderFile], volumeIDs[keyProviderSecret])
+	cs, err = newControllerServer(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crypto bdev re-created with stored key of file provider
+	err = verifyEncrypted(cs, volumeIDs[keyProviderFile])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.volumes[volumeIDs[keyProviderFile]].keyLost {
+		t.Fatal("volume of file key provider not recovered")
+	}
+
+	// volume of secret provider is abnormal until secrets are provided
+	volumeID := volumeIDs[keyProviderSecret]
+	resp, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetStatus().GetVolumeCondition().GetAbnormal() {
+		t.Fatalf("volume with lost crypto bdev should be abnormal: %v", resp.GetStatus().GetVolumeCondition())
+	}
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   testNodeID("test-node-1"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+	_, err = cs.ControllerPublishVolume(context.TODO(), publishReq)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expect FailedPrecondition error without secrets, got: %v", err)
+	}
+	publishReq.Secrets = secrets
+	_, err = cs.ControllerPublishVolume(context.TODO(), publishReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyEncrypted(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetStatus().GetVolumeCondition().GetAbnormal() || resp.GetVolume().GetVolumeContext()["nqn"] == "" {
+		t.Fatalf("volume not recovered: %v", resp)
+	}
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: testNodeID("test-node-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// key of file provider cannot be read, secrets never replace it
+	volumeID = volumeIDs[keyProviderFile]
+	keyPath := filepath.Join(kmsDir, cs.volumes[volumeID].name+".key")
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyPath, []byte("corrupted"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loseCryptoBdevs(t, cs, volumeID)
+	cs, err = newControllerServer(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.volumes[volumeID].keyLost {
+		t.Fatal("volume with unreadable key recovered")
+	}
+	publishReq.VolumeId = volumeID
+	_, err = cs.ControllerPublishVolume(context.TODO(), publishReq)
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("expect Internal error with unreadable key, got: %v", err)
+	}
+	err = os.WriteFile(keyPath, keyData, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.ControllerPublishVolume(context.TODO(), publishReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyEncrypted(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: testNodeID("test-node-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
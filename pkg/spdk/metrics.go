@@ -0,0 +1,107 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are registered to prometheus default registry
+var (
+	nodeHealthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spdkcsi_storage_node_health",
+		Help: "Health state of spdk node, 0: healthy, 1: degraded, 2: down.",
+	}, []string{"node"})
+
+	// node server, connecting to target and mounting volume
+	connectDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spdkcsi_node_connect_duration_seconds",
+		Help:    "Latency of connecting initiator to target per target type.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"target_type"})
+	mountDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spdkcsi_node_mount_duration_seconds",
+		Help:    "Latency of mounting volume per operation, stage or publish.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"operation"})
+)
+
+// controllerCollector reports capacity of lvstores and number of volumes
+// and snapshots per spdk node on each scrape. Lvstores are cached by
+// watchHealth, and not reported for nodes not healthy.
+type controllerCollector struct {
+	cs            *controllerServer
+	lvstoreTotal  *prometheus.Desc
+	lvstoreFree   *prometheus.Desc
+	volumeCount   *prometheus.Desc
+	snapshotCount *prometheus.Desc
+}
+
+func newControllerCollector(cs *controllerServer) *controllerCollector {
+	return &controllerCollector{
+		cs: cs,
+		lvstoreTotal: prometheus.NewDesc("spdkcsi_lvstore_total_bytes",
+			"Total capacity of lvstore on spdk node.", []string{"node", "lvstore"}, nil),
+		lvstoreFree: prometheus.NewDesc("spdkcsi_lvstore_free_bytes",
+			"Free capacity of lvstore on spdk node.", []string{"node", "lvstore"}, nil),
+		volumeCount: prometheus.NewDesc("spdkcsi_volumes",
+			"Number of volumes on spdk node.", []string{"node"}, nil),
+		snapshotCount: prometheus.NewDesc("spdkcsi_snapshots",
+			"Number of snapshots on spdk node.", []string{"node"}, nil),
+	}
+}
+
+func (collector *controllerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.lvstoreTotal
+	ch <- collector.lvstoreFree
+	ch <- collector.volumeCount
+	ch <- collector.snapshotCount
+}
+
+func (collector *controllerCollector) Collect(ch chan<- prometheus.Metric) {
+	cs := collector.cs
+	volumeCounts := make(map[*storageNode]int)
+	snapshotCounts := make(map[*storageNode]int)
+	cs.mtx.Lock()
+	for _, volume := range cs.volumes {
+		volumeCounts[volume.spdkNode]++
+	}
+	cs.mtx.Unlock()
+	cs.mtxSnapshot.RLock()
+	for _, snapshot := range cs.snapshotsIdem {
+		snapshotCounts[snapshot.spdkNode]++
+	}
+	cs.mtxSnapshot.RUnlock()
+
+	for _, spdkNode := range cs.storageNodes() {
+		ch <- prometheus.MustNewConstMetric(collector.volumeCount, prometheus.GaugeValue,
+			float64(volumeCounts[spdkNode]), spdkNode.name)
+		ch <- prometheus.MustNewConstMetric(collector.snapshotCount, prometheus.GaugeValue,
+			float64(snapshotCounts[spdkNode]), spdkNode.name)
+
+		if state, _ := spdkNode.health.get(); state != nodeHealthy {
+			continue
+		}
+		for _, lvs := range spdkNode.health.getLvStores() {
+			ch <- prometheus.MustNewConstMetric(collector.lvstoreTotal, prometheus.GaugeValue,
+				float64(lvs.TotalSizeMiB*1024*1024), spdkNode.name, lvs.Name)
+			ch <- prometheus.MustNewConstMetric(collector.lvstoreFree, prometheus.GaugeValue,
+				float64(lvs.FreeSizeMiB*1024*1024), spdkNode.name, lvs.Name)
+		}
+	}
+}
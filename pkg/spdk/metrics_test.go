@@ -0,0 +1,67 @@
+package spdk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestControllerMetrics(t *testing.T) {
+	cs, _, err := createTestController("nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID, err := createTestVolume(cs, "test-volume-metrics", 64*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := deleteTestVolume(cs, volumeID); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// lvstores are cached by health probes, scrapes don't query spdk node
+	cs.checkHealth()
+	spdkNode := cs.storageNodes()[0]
+	spdkNode.SetRPCCredentials("spdkcsiuser", "wrong")
+	defer spdkNode.SetRPCCredentials("spdkcsiuser", "spdkcsipass")
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newControllerCollector(cs))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			values[family.GetName()] += metric.GetGauge().GetValue()
+		}
+	}
+	if values["spdkcsi_volumes"] != 1 || values["spdkcsi_snapshots"] != 0 {
+		t.Fatalf("unexpected volume and snapshot counts: %v", values)
+	}
+	if values["spdkcsi_lvstore_free_bytes"] <= 0 || values["spdkcsi_lvstore_total_bytes"] < values["spdkcsi_lvstore_free_bytes"] {
+		t.Fatalf("unexpected lvstore capacity: %v", values)
+	}
+	if state, _ := spdkNode.health.get(); state != nodeHealthy {
+		t.Fatalf("health should not be changed by scrapes: %s", state)
+	}
+	spdkNode.SetRPCCredentials("spdkcsiuser", "spdkcsipass")
+
+	// lvstores of unhealthy node are not reported
+	for i := 0; i < healthDownThreshold; i++ {
+		spdkNode.updateHealth(errors.New("probe failed"))
+	}
+	defer func() {
+		for i := 0; i < healthUpThreshold; i++ {
+			spdkNode.updateHealth(nil)
+		}
+	}()
+	if n := testutil.CollectAndCount(newControllerCollector(cs), "spdkcsi_lvstore_free_bytes"); n != 0 {
+		t.Fatalf("lvstores of unhealthy node collected: %d", n)
+	}
+}
@@ -0,0 +1,380 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// interval to reload config map and secret, kubelet updates mounted files
+// in place when they change
+const configReloadInterval = 30 * time.Second
+
+// controller config, see deploy/kubernetes/config-map.yaml
+// schedulePolicy, kmsDir, storageNodeCRD and iostatInterval take effect after
+// controller restart, nodes are reloaded live.
+//
+//nolint:tagliatelle // not using json:snake case
+type controllerConfig struct {
+	Nodes          []spdkNodeConfig `json:"Nodes"`
+	SchedulePolicy string           `json:"schedulePolicy"`
+	KmsDir         string           `json:"kmsDir"`
+	// discover more nodes from SpdkStorageNode resources, see storagenode.go
+	StorageNodeCRD bool `json:"storageNodeCRD"`
+	// duration string, see iostat.go
+	IOStatInterval string `json:"iostatInterval"`
+}
+
+// spdk node in config map
+type spdkNodeConfig struct {
+	Name       string            `json:"name"`
+	URL        string            `json:"rpcURL"`
+	TargetType string            `json:"targetType"`
+	TargetAddr string            `json:"targetAddr"`
+	Topology   map[string]string `json:"topology"`
+	Weight     int               `json:"weight"`
+	KeyDir     string            `json:"keyDir"`
+	// NVMe-oF multipath, changed in place for volumes published afterwards
+	TargetAddrs []string              `json:"targetAddrs"`
+	AnaStates   map[string]string     `json:"anaStates"`
+	Transport   util.TransportOptions `json:"transport"`
+	// no new volume is scheduled to node in maintenance, changed in place
+	Maintenance bool `json:"maintenance"`
+
+	fromResource bool // discovered from SpdkStorageNode resource
+}
+
+// compare configs of rpc connection and target, node is re-created if they
+// change, other fields are changed in place
+func (config *spdkNodeConfig) connectionEquals(other *spdkNodeConfig) bool {
+	return config.URL == other.URL && config.TargetType == other.TargetType &&
+		config.TargetAddr == other.TargetAddr && config.KeyDir == other.KeyDir &&
+		config.Transport == other.Transport
+}
+
+func (config *spdkNodeConfig) weight() int {
+	if config.Weight <= 0 {
+		return 1
+	}
+	return config.Weight
+}
+
+// spdk json rpc credentials per node, see deploy/kubernetes/secret.yaml
+type rpcToken struct {
+	Name     string `json:"name"`
+	UserName string `json:"username"`
+	Password string `json:"password"`
+}
+
+func loadConfig() (*controllerConfig, []rpcToken, error) {
+	var config controllerConfig
+	configFile := util.FromEnv("SPDKCSI_CONFIG", "/etc/spdkcsi-config/config.json")
+	err := util.ParseJSONFile(configFile, &config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//nolint:tagliatelle // not using json:snake case
+	var secret struct {
+		Tokens []rpcToken `json:"rpcTokens"`
+	}
+	secretFile := util.FromEnv("SPDKCSI_SECRET", "/etc/spdkcsi-secret/secret.json")
+	err = util.ParseJSONFile(secretFile, &secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &config, secret.Tokens, nil
+}
+
+func newStorageNode(config *spdkNodeConfig, token *rpcToken) (*storageNode, error) {
+	for key := range config.Topology {
+		if !strings.HasPrefix(key, util.TopologyKeyPrefix) {
+			klog.Warningf("topology key %s of spdk node %s has no prefix %s, no kubernetes node will match it", key, config.Name, util.TopologyKeyPrefix)
+		}
+	}
+	spdkNode, err := util.NewSpdkNode(config.URL, token.UserName, token.Password, config.TargetType, config.TargetAddr,
+		util.NodeOptions{
+			KeyDir:      config.KeyDir,
+			TargetAddrs: config.TargetAddrs,
+			AnaStates:   config.AnaStates,
+			Transport:   config.Transport,
+		})
+	if err != nil {
+		return nil, err
+	}
+	node := &storageNode{
+		SpdkNode: spdkNode,
+		name:     config.Name,
+		topology: config.Topology,
+		weight:   config.weight(),
+		config:   *config,
+		token:    *token,
+	}
+	node.maintenance.Store(config.Maintenance)
+	return node, nil
+}
+
+// snapshot of spdk nodes, the slice is replaced but never modified on
+// config reload
+func (cs *controllerServer) storageNodes() []*storageNode {
+	cs.mtxNodes.RLock()
+	defer cs.mtxNodes.RUnlock()
+	return cs.spdkNodes
+}
+
+// updateNodes creates, re-creates or removes spdk nodes per config and rpc
+// tokens, and returns created nodes. Node is re-created if its connection
+// changes, unless it hosts volumes or snapshots and is bound to them. Other
+// config and rpc credentials are changed in place. Node without rpc token
+// is kept as is, the secret may be in update.
+// Called by newControllerServer and watchConfig only, not thread safe.
+//
+//nolint:cyclop // many cases per node increases complexity
+func (cs *controllerServer) updateNodes(config *controllerConfig, tokens []rpcToken) []*storageNode {
+	type nodeUpdate struct {
+		config   *spdkNodeConfig
+		token    *rpcToken
+		existing *storageNode // nil for new node
+		created  *storageNode // nil if existing node is kept
+	}
+
+	// spdkNodes is only replaced by us, it's safe to read it without lock
+	current := make(map[string]*storageNode)
+	for _, spdkNode := range cs.storageNodes() {
+		current[spdkNode.name] = spdkNode
+	}
+
+	// create nodes without holding locks, as it may take long talking to
+	// spdk nodes, and volume requests should not be blocked
+	var updates []nodeUpdate
+	for i := range config.Nodes {
+		nodeConfig := &config.Nodes[i]
+		existing := current[nodeConfig.Name]
+		delete(current, nodeConfig.Name)
+		token := findToken(tokens, nodeConfig.Name)
+		if token == nil {
+			if existing == nil {
+				klog.Errorf("failed to find secret for spdk node %s", nodeConfig.Name)
+				continue
+			}
+			klog.Errorf("failed to find secret for spdk node %s, node is kept as is", nodeConfig.Name)
+			nodeConfig, token = &existing.config, &existing.token
+		}
+		update := nodeUpdate{config: nodeConfig, token: token, existing: existing}
+		if existing != nil && !existing.config.connectionEquals(nodeConfig) && cs.hostsVolumes(existing) {
+			existing.refuseChange(nodeConfig)
+		} else if existing == nil || !existing.config.connectionEquals(nodeConfig) {
+			spdkNode, err := newStorageNode(nodeConfig, token)
+			if err != nil {
+				klog.Errorf("failed to create spdk node %s: %s", nodeConfig.Name, err.Error())
+				if update.existing == nil {
+					continue
+				}
+			}
+			update.created = spdkNode
+		}
+		updates = append(updates, update)
+	}
+
+	// swap in created nodes, no volume is created or scheduled on a node
+	// being changed
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.mtxSnapshot.RLock()
+	defer cs.mtxSnapshot.RUnlock()
+
+	var spdkNodes, created []*storageNode
+	for _, update := range updates {
+		existing := update.existing
+		if existing != nil && update.created != nil && cs.hostsVolumesLocked(existing) {
+			existing.refuseChange(update.config)
+			update.created = nil
+		}
+		if update.created == nil {
+			existing.applyConfig(update.config, update.token)
+			spdkNodes = append(spdkNodes, existing)
+			continue
+		}
+		klog.Infof("spdk node created: name=%s, url=%s, topology=%v", update.config.Name, update.config.URL, update.config.Topology)
+		spdkNodes = append(spdkNodes, update.created)
+		created = append(created, update.created)
+	}
+
+	// nodes dropped from config, in original order
+	for _, spdkNode := range cs.spdkNodes {
+		if _, dropped := current[spdkNode.name]; !dropped {
+			continue
+		}
+		if cs.hostsVolumesLocked(spdkNode) {
+			klog.Errorf("spdk node %s hosts volumes, cannot be removed", spdkNode.name)
+			spdkNodes = append(spdkNodes, spdkNode)
+			continue
+		}
+		nodeHealthGauge.DeleteLabelValues(spdkNode.name)
+		klog.Infof("spdk node removed: %s", spdkNode.name)
+	}
+
+	cs.mtxNodes.Lock()
+	cs.spdkNodes = spdkNodes
+	cs.mtxNodes.Unlock()
+	return created
+}
+
+// log refused connection change once, not on every reload
+func (node *storageNode) refuseChange(config *spdkNodeConfig) {
+	if node.refused == nil || !node.refused.connectionEquals(config) {
+		klog.Errorf("spdk node %s hosts volumes, connection change is not applied: url=%s, targetType=%s, targetAddr=%s",
+			node.name, config.URL, config.TargetType, config.TargetAddr)
+		refused := *config
+		node.refused = &refused
+	}
+}
+
+// applyConfig changes rpc credentials and config except connection of
+// existing node in place
+func (node *storageNode) applyConfig(config *spdkNodeConfig, token *rpcToken) {
+	if node.config.connectionEquals(config) {
+		node.refused = nil
+	}
+	if node.token != *token {
+		node.SetRPCCredentials(token.UserName, token.Password)
+		node.token = *token
+		klog.Infof("rpc credentials of spdk node %s updated", node.name)
+	}
+	if node.maintenance.Swap(config.Maintenance) != config.Maintenance {
+		klog.Infof("spdk node %s maintenance: %v", node.name, config.Maintenance)
+	}
+	if !reflect.DeepEqual(node.config.Topology, config.Topology) || node.config.weight() != config.weight() {
+		node.mtx.Lock()
+		node.topology = config.Topology
+		node.weight = config.weight()
+		node.mtx.Unlock()
+		node.config.Topology, node.config.Weight = config.Topology, config.Weight
+		klog.Infof("spdk node %s updated: topology=%v, weight=%d", node.name, config.Topology, config.weight())
+	}
+	if !multipathEquals(&node.config, config) && (node.refusedPaths == nil || !multipathEquals(node.refusedPaths, config)) {
+		err := node.SetMultipath(config.TargetAddrs, config.AnaStates)
+		if err != nil {
+			// logged once, like refused connection change
+			klog.Errorf("failed to update multipath of spdk node %s: %s", node.name, err.Error())
+			refused := *config
+			node.refusedPaths = &refused
+		} else {
+			node.refusedPaths = nil
+			node.config.TargetAddrs, node.config.AnaStates = config.TargetAddrs, config.AnaStates
+			klog.Infof("spdk node %s updated: targetAddrs=%v, anaStates=%v", node.name, config.TargetAddrs, config.AnaStates)
+		}
+	}
+	node.config.Maintenance = config.Maintenance
+	node.config.fromResource = config.fromResource
+}
+
+func multipathEquals(a, b *spdkNodeConfig) bool {
+	return reflect.DeepEqual(a.TargetAddrs, b.TargetAddrs) && reflect.DeepEqual(a.AnaStates, b.AnaStates)
+}
+
+func (cs *controllerServer) hostsVolumes(spdkNode *storageNode) bool {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.mtxSnapshot.RLock()
+	defer cs.mtxSnapshot.RUnlock()
+	return cs.hostsVolumesLocked(spdkNode)
+}
+
+// check if volumes or snapshots are on the spdk node, or volumes in creation
+// are placed on it, caller must hold cs.mtx and mtxSnapshot
+func (cs *controllerServer) hostsVolumesLocked(spdkNode *storageNode) bool {
+	for _, placed := range cs.placements {
+		if placed == spdkNode {
+			return true
+		}
+	}
+	for _, volume := range cs.volumes {
+		if volume.spdkNode == spdkNode {
+			return true
+		}
+	}
+	for _, snapshot := range cs.snapshotsIdem {
+		if snapshot.spdkNode == spdkNode {
+			return true
+		}
+	}
+	return false
+}
+
+func findToken(tokens []rpcToken, name string) *rpcToken {
+	for i := range tokens {
+		if tokens[i].Name == name {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+// reloadConfig applies changes of spdk nodes and rpc tokens, created nodes
+// are probed and volumes on them are restored
+func (cs *controllerServer) reloadConfig() error {
+	config, tokens, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cs.nodeWatcher != nil {
+		tokens, err = cs.addResourceNodes(config, tokens)
+		if err != nil {
+			return err
+		}
+	}
+	for _, spdkNode := range cs.updateNodes(config, tokens) {
+		spdkNode.probe()
+		err = cs.restoreNodeVolumes(spdkNode)
+		if err != nil {
+			klog.Errorf("failed to restore volumes from node %s: %s", spdkNode.Info(), err.Error())
+		}
+	}
+	if cs.nodeWatcher != nil {
+		cs.reportNodeStatus()
+	}
+	return nil
+}
+
+// watchConfig reloads config periodically, and on changes of storage node
+// resources, never returns
+func (cs *controllerServer) watchConfig(interval time.Duration) {
+	var changed <-chan struct{} // nil channel blocks forever
+	if cs.nodeWatcher != nil {
+		changed = cs.nodeWatcher.changed
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-changed:
+		}
+		err := cs.reloadConfig()
+		if err != nil {
+			klog.Errorf("failed to reload config: %s", err.Error())
+		}
+	}
+}
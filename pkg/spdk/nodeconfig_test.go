@@ -0,0 +1,171 @@
+package spdk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	testNodeConfig = `{"nodes": [{"name": "localhost", "rpcURL": "http://127.0.0.1:9009", "targetType": "nvme-tcp", "targetAddr": "127.0.0.1"}]}`
+	//nolint:gosec // only for test
+	testNodeSecret = `{"rpcTokens": [{"name": "localhost", "username": "spdkcsiuser", "password": "spdkcsipass"}]}`
+)
+
+func writeConfigFiles(t *testing.T, config, secret string) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	secretFile := filepath.Join(dir, "secret.json")
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secretFile, []byte(secret), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SPDKCSI_CONFIG", configFile)
+	t.Setenv("SPDKCSI_SECRET", secretFile)
+}
+
+//nolint:cyclop // TestReloadConfig exceeds cyclomatic complexity of 10
+func TestReloadConfig(t *testing.T) {
+	cs, lvss, err := createTestController("nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spdkNode := cs.storageNodes()[0]
+	volumeID, err := createTestVolume(cs, "test-volume-reload", 64*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node hosting volumes is neither re-created nor removed
+	writeConfigFiles(t, `{"nodes": [{"name": "localhost", "rpcURL": "http://127.0.0.1:9009", "targetType": "nvme-tcp", "targetAddr": "127.0.0.2"}]}`, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] != spdkNode || spdkNode.refused == nil {
+		t.Fatalf("spdk node hosting volumes changed: %v", nodes)
+	}
+	// but config other than connection is changed in place
+	writeConfigFiles(t, `{"nodes": [{"name": "localhost", "rpcURL": "http://127.0.0.1:9009", "targetType": "nvme-tcp", "targetAddr": "127.0.0.1",
+		"topology": {"topology.spdk.io/zone": "zone1"}, "weight": 3, "targetAddrs": ["127.0.0.2"], "anaStates": {"127.0.0.2": "non_optimized"}}]}`, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] != spdkNode || spdkNode.refused != nil {
+		t.Fatalf("spdk node hosting volumes changed: %v", nodes)
+	}
+	if spdkNode.scheduleWeight() != 3 || spdkNode.accessibleFrom(&csi.Topology{Segments: map[string]string{"topology.spdk.io/zone": "zone2"}}) {
+		t.Fatalf("topology and weight not updated: %v, %d", spdkNode.accessibleTopology(), spdkNode.scheduleWeight())
+	}
+	if len(spdkNode.config.TargetAddrs) != 1 || len(spdkNode.config.AnaStates) != 1 {
+		t.Fatalf("multipath not updated: %v", spdkNode.config)
+	}
+	writeConfigFiles(t, `{"nodes": []}`, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] != spdkNode {
+		t.Fatalf("spdk node hosting volumes removed: %v", nodes)
+	}
+
+	// rpc credentials are rotated in place
+	writeConfigFiles(t, testNodeConfig, `{"rpcTokens": [{"name": "localhost", "username": "spdkcsiuser", "password": "wrong"}]}`)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = spdkNode.LvStores(); err == nil {
+		t.Fatal("should fail with wrong rpc password")
+	}
+	writeConfigFiles(t, testNodeConfig, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] != spdkNode {
+		t.Fatalf("spdk node changed: %v", nodes)
+	}
+	if _, err = spdkNode.LvStores(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = deleteTestVolume(cs, volumeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// empty node is kept if its rpc token is missing, e.g. secret in update
+	writeConfigFiles(t, testNodeConfig, `{"rpcTokens": []}`)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] != spdkNode {
+		t.Fatalf("spdk node without rpc token removed: %v", nodes)
+	}
+
+	// empty node is removed, and created again
+	writeConfigFiles(t, `{"nodes": []}`, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 0 {
+		t.Fatalf("spdk node not removed: %v", nodes)
+	}
+	writeConfigFiles(t, testNodeConfig, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] == spdkNode {
+		t.Fatalf("spdk node not created: %v", nodes)
+	}
+
+	// node is changed if volumes in creation are placed on other nodes only,
+	// volume cannot be placed on replaced node
+	spdkNode = cs.storageNodes()[0]
+	cs.volumesIdem["test-volume-creating"] = creatingTag
+	writeConfigFiles(t, `{"nodes": []}`, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 0 {
+		t.Fatalf("spdk node not removed: %v", nodes)
+	}
+	if cs.placeVolume("test-volume-creating", spdkNode) {
+		t.Fatal("volume placed on removed spdk node")
+	}
+	writeConfigFiles(t, testNodeConfig, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node with volume in creation placed on it is not changed
+	spdkNode = cs.storageNodes()[0]
+	if !cs.placeVolume("test-volume-creating", spdkNode) {
+		t.Fatal("failed to place volume")
+	}
+	writeConfigFiles(t, `{"nodes": []}`, testNodeSecret)
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := cs.storageNodes(); len(nodes) != 1 || nodes[0] != spdkNode {
+		t.Fatalf("spdk node with volume in creation removed: %v", nodes)
+	}
+	delete(cs.placements, "test-volume-creating")
+	delete(cs.volumesIdem, "test-volume-creating")
+
+	if !verifyLVSS(cs, lvss) {
+		t.Fatal("lvstore status doesn't match")
+	}
+}
@@ -20,17 +20,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
 	smarpc "github.com/spdk/sma-goapi/v1alpha1"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 	"k8s.io/utils/exec"
 	"k8s.io/utils/mount"
@@ -50,6 +55,7 @@ type nodeServer struct {
 
 type nodeVolume struct {
 	initiator   util.SpdkCsiInitiator
+	devicePath  string
 	stagingPath string
 	tryLock     util.TryLock
 }
@@ -130,6 +136,12 @@ func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
 }
 
 func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	// node stage secrets of StorageClass
+	creds, err := util.CredentialsFromSecrets(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	volume, err := func() (*nodeVolume, error) {
 		volumeID := req.GetVolumeId()
 		ns.mtx.Lock()
@@ -140,9 +152,9 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 			var initiator util.SpdkCsiInitiator
 			var err error
 			if ns.smaClient != nil && ns.smaTargetType != "" {
-				initiator, err = util.NewSpdkCsiSmaInitiator(req.GetVolumeContext(), ns.smaClient, ns.smaTargetType)
+				initiator, err = util.NewSpdkCsiSmaInitiator(req.GetVolumeContext(), creds, ns.smaClient, ns.smaTargetType)
 			} else {
-				initiator, err = util.NewSpdkCsiInitiator(req.GetVolumeContext())
+				initiator, err = util.NewSpdkCsiInitiator(req.GetVolumeContext(), creds)
 			}
 			if err != nil {
 				return nil, err
@@ -166,7 +178,9 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 			klog.Warning("volume already staged")
 			return &csi.NodeStageVolumeResponse{}, nil
 		}
+		timer := prometheus.NewTimer(connectDuration.WithLabelValues(req.GetVolumeContext()["targetType"]))
 		devicePath, err := volume.initiator.Connect() // idempotent
+		timer.ObserveDuration()
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -175,6 +189,7 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 			volume.initiator.Disconnect() //nolint:errcheck // ignore error
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+		volume.devicePath = devicePath
 		volume.stagingPath = stagingPath
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
@@ -236,7 +251,12 @@ func (ns *nodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 		if volume.stagingPath == "" {
 			return nil, status.Error(codes.Aborted, "volume unstaged")
 		}
-		err := ns.publishVolume(volume.stagingPath, req) // idempotent
+		var err error
+		if req.GetVolumeCapability().GetBlock() != nil {
+			err = ns.publishBlockVolume(volume.devicePath, req) // idempotent
+		} else {
+			err = ns.publishVolume(volume.stagingPath, req) // idempotent
+		}
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -266,6 +286,119 @@ func (ns *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubl
 	return nil, status.Error(codes.Aborted, "concurrent request ongoing")
 }
 
+func (ns *nodeServer) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	ns.mtx.Lock()
+	volume, exists := ns.volumes[volumeID]
+	ns.mtx.Unlock()
+	if !exists {
+		return nil, status.Error(codes.NotFound, volumeID)
+	}
+
+	if volume.tryLock.Lock() {
+		defer volume.tryLock.Unlock()
+
+		if volume.stagingPath == "" {
+			return nil, status.Error(codes.FailedPrecondition, "volume unstaged")
+		}
+		err := volume.initiator.Rescan() // idempotent
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		block, err := ns.isBlockVolume(volume.stagingPath, req.GetVolumeCapability())
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if !block {
+			err = ns.expandFilesystem(volume.devicePath, volume.stagingPath) // idempotent
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		return &csi.NodeExpandVolumeResponse{
+			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+		}, nil
+	}
+	return nil, status.Error(codes.Aborted, "concurrent request ongoing")
+}
+
+func (ns *nodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	if volumeID == "" || volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and volume path must be provided")
+	}
+
+	ns.mtx.Lock()
+	volume, exists := ns.volumes[volumeID]
+	ns.mtx.Unlock()
+	if !exists {
+		return nil, status.Error(codes.NotFound, volumeID)
+	}
+
+	if volume.tryLock.Lock() {
+		defer volume.tryLock.Unlock()
+
+		if volume.stagingPath == "" {
+			return nil, status.Error(codes.NotFound, "volume unstaged")
+		}
+		info, err := os.Stat(volumePath)
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path not found: %s", volumePath)
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		// usage is not reported if device is gone or unreachable
+		err = util.CheckDeviceHealth(volume.devicePath)
+		if err != nil {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: err.Error()},
+			}, nil
+		}
+
+		var usage []*csi.VolumeUsage
+		if info.IsDir() {
+			usage, err = filesystemUsage(volumePath)
+		} else {
+			usage, err = blockUsage(volumePath)
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage:           usage,
+			VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
+		}, nil
+	}
+	return nil, status.Error(codes.Aborted, "concurrent request ongoing")
+}
+
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// controller server allows only this node to connect to published
+	// volumes per host nqn and initiator name carried in node id
+	nodeName := resp.GetNodeId()
+	resp.NodeId = util.EncodeNodeID(nodeName, util.LocalHostID())
+
+	// report topology from labels of kubernetes node, see util.TopologyKeyPrefix
+	topology, err := util.GetNodeTopology(nodeName)
+	if errors.Is(err, rest.ErrNotInCluster) {
+		klog.Warningf("not running in kubernetes cluster, no topology reported")
+		return resp, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get topology of node %s: %s", nodeName, err.Error())
+	}
+	if len(topology) > 0 {
+		resp.AccessibleTopology = &csi.Topology{Segments: topology}
+	}
+	return resp, nil
+}
+
 func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
@@ -276,6 +409,27 @@ func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapab
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -292,6 +446,11 @@ func (ns *nodeServer) stageVolume(devicePath string, req *csi.NodeStageVolumeReq
 	if mounted {
 		return stagingPath, nil
 	}
+	// raw block volume is not formatted, device is bind mounted to target
+	// path in NodePublishVolume, staging path only marks volume staged
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return stagingPath, nil
+	}
 
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	mntFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
@@ -300,9 +459,10 @@ func (ns *nodeServer) stageVolume(devicePath string, req *csi.NodeStageVolumeReq
 	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
 		mntFlags = append(mntFlags, "ro")
-	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-		return "", errors.New("unsupport MULTI_NODE_MULTI_WRITER AccessMode")
-	case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+		// only raw block volumes can be written from multiple nodes
+		return "", fmt.Errorf("unsupport %s AccessMode of filesystem volume", req.VolumeCapability.AccessMode.Mode)
 	case csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
 	case csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER:
 	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
@@ -311,7 +471,9 @@ func (ns *nodeServer) stageVolume(devicePath string, req *csi.NodeStageVolumeReq
 
 	klog.Infof("mount %s to %s, fstype: %s, flags: %v", devicePath, stagingPath, fsType, mntFlags)
 	mounter := mount.SafeFormatAndMount{Interface: ns.mounter, Exec: exec.New()}
+	timer := prometheus.NewTimer(mountDuration.WithLabelValues("stage"))
 	err = mounter.FormatAndMount(devicePath, stagingPath, fsType, mntFlags)
+	timer.ObserveDuration()
 	if err != nil {
 		return "", err
 	}
@@ -333,9 +495,126 @@ func (ns *nodeServer) publishVolume(stagingPath string, req *csi.NodePublishVolu
 	mntFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 	mntFlags = append(mntFlags, "bind")
 	klog.Infof("mount %s to %s, fstype: %s, flags: %v", stagingPath, targetPath, fsType, mntFlags)
+	defer prometheus.NewTimer(mountDuration.WithLabelValues("publish")).ObserveDuration()
 	return ns.mounter.Mount(stagingPath, targetPath, fsType, mntFlags)
 }
 
+// bind mount device of raw block volume to target file, must be idempotent
+func (ns *nodeServer) publishBlockVolume(devicePath string, req *csi.NodePublishVolumeRequest) error {
+	targetPath := req.GetTargetPath()
+	mounted, err := ns.createMountFile(targetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	mntFlags := []string{"bind"}
+	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		mntFlags = append(mntFlags, "ro")
+	default:
+		if req.GetReadonly() {
+			mntFlags = append(mntFlags, "ro")
+		}
+	}
+	klog.Infof("mount %s to %s, flags: %v", devicePath, targetPath, mntFlags)
+	defer prometheus.NewTimer(mountDuration.WithLabelValues("publish")).ObserveDuration()
+	return ns.mounter.Mount(devicePath, targetPath, "", mntFlags)
+}
+
+// grow filesystem on staged device to device size, must be idempotent
+func (ns *nodeServer) expandFilesystem(devicePath, stagingPath string) error {
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		return err
+	}
+	fsType := ""
+	for i := range mountPoints {
+		if mountPoints[i].Path == stagingPath {
+			fsType = mountPoints[i].Type
+			break
+		}
+	}
+
+	var cmdLine []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmdLine = []string{"resize2fs", devicePath}
+	case "xfs":
+		cmdLine = []string{"xfs_growfs", stagingPath}
+	default:
+		return fmt.Errorf("unsupported filesystem %q at %s", fsType, stagingPath)
+	}
+
+	klog.Infof("expand filesystem %s on %s", fsType, devicePath)
+	output, err := exec.New().Command(cmdLine[0], cmdLine[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v failed: %w, output: %s", cmdLine, err, output)
+	}
+	return nil
+}
+
+// bytes and inodes usage of filesystem mounted at path
+func filesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return nil, fmt.Errorf("statfs %s failed: %w", path, err)
+	}
+
+	blockSize := int64(stat.Bsize) //nolint:unconvert // int32 on some platforms
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(stat.Blocks) * blockSize,
+			Available: int64(stat.Bavail) * blockSize,
+			Used:      int64(stat.Blocks-stat.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(stat.Files),
+			Available: int64(stat.Ffree),
+			Used:      int64(stat.Files - stat.Ffree),
+		},
+	}, nil
+}
+
+// size of block device at path
+func blockUsage(path string) ([]*csi.VolumeUsage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get size of %s: %w", path, err)
+	}
+	return []*csi.VolumeUsage{
+		{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: size,
+		},
+	}, nil
+}
+
+// volume capability is optional in NodeExpandVolume, without it raw block
+// volume is detected by nothing mounted at staging path, see stageVolume
+func (ns *nodeServer) isBlockVolume(stagingPath string, capability *csi.VolumeCapability) (bool, error) {
+	if capability != nil {
+		return capability.GetBlock() != nil, nil
+	}
+	unmounted, err := mount.IsNotMountPoint(ns.mounter, stagingPath)
+	if err != nil {
+		return false, err
+	}
+	return unmounted, nil
+}
+
 // create mount point if not exists, return whether already mounted
 func (ns *nodeServer) createMountPoint(path string) (bool, error) {
 	unmounted, err := mount.IsNotMountPoint(ns.mounter, path)
@@ -349,6 +628,27 @@ func (ns *nodeServer) createMountPoint(path string) (bool, error) {
 	return !unmounted, err
 }
 
+// create file as mount point of block device if not exists, return whether
+// already mounted
+func (ns *nodeServer) createMountFile(path string) (bool, error) {
+	unmounted, err := mount.IsNotMountPoint(ns.mounter, path)
+	if os.IsNotExist(err) {
+		unmounted = true
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			var file *os.File
+			file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+			if err == nil {
+				err = file.Close()
+			}
+		}
+	}
+	if !unmounted {
+		klog.Infof("%s already mounted", path)
+	}
+	return !unmounted, err
+}
+
 // unmount and delete mount point, must be idempotent
 func (ns *nodeServer) deleteMountPoint(path string) error {
 	unmounted, err := mount.IsNotMountPoint(ns.mounter, path)
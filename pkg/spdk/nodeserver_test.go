@@ -0,0 +1,69 @@
+package spdk
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/utils/mount"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+)
+
+// initiator stand-in, counts rescans
+type fakeInitiator struct {
+	rescans int
+}
+
+func (initiator *fakeInitiator) Connect() (string, error) { return "/dev/fake", nil }
+func (initiator *fakeInitiator) Disconnect() error        { return nil }
+func (initiator *fakeInitiator) Rescan() error {
+	initiator.rescans++
+	return nil
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	stagingPath := t.TempDir()
+	initiator := &fakeInitiator{}
+	mounter := mount.NewFakeMounter(nil)
+	ns := &nodeServer{
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(csicommon.NewCSIDriver("test-driver", "test-version", "test-node")),
+		mounter:           mounter,
+		volumes: map[string]*nodeVolume{
+			"volume-1": {initiator: initiator, devicePath: "/dev/fake", stagingPath: stagingPath},
+		},
+	}
+	expand := func(capability *csi.VolumeCapability) error {
+		_, err := ns.NodeExpandVolume(context.TODO(), &csi.NodeExpandVolumeRequest{
+			VolumeId:         "volume-1",
+			VolumePath:       stagingPath,
+			CapacityRange:    &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024},
+			VolumeCapability: capability,
+		})
+		return err
+	}
+
+	// raw block volume is rescanned, no filesystem to grow, with or without
+	// volume capability
+	blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	for _, capability := range []*csi.VolumeCapability{blockCapability, nil} {
+		if err := expand(capability); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if initiator.rescans != 2 {
+		t.Fatalf("raw block volume should be rescanned: %d", initiator.rescans)
+	}
+
+	// filesystem mounted at staging path is grown if volume capability is
+	// not provided
+	mounter.MountPoints = append(mounter.MountPoints, mount.MountPoint{Device: "/dev/fake", Path: stagingPath, Type: "fakefs"})
+	err := expand(nil)
+	if err == nil || !strings.Contains(err.Error(), "unsupported filesystem") {
+		t.Fatalf("filesystem should be grown: %v", err)
+	}
+	if initiator.rescans != 3 {
+		t.Fatalf("filesystem volume should be rescanned: %d", initiator.rescans)
+	}
+}
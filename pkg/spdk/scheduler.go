@@ -0,0 +1,136 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"sync"
+)
+
+// volume placement policies, selected by "schedulePolicy" in config map and
+// overridden by "schedulePolicy" parameter of StorageClass
+const (
+	policyFirst         = "first"         // first node:lvstore with enough free space
+	policyMostFreeSpace = "mostFreeSpace" // node:lvstore with most free space
+	policyRoundRobin    = "roundRobin"    // node:lvstores in turn
+	policyWeighted      = "weighted"      // node:lvstores in proportion to node weight
+	policyLeastVolumes  = "leastVolumes"  // node:lvstore with least volumes
+)
+
+// max times to re-schedule a volume if picked lvstore has no space left
+const maxScheduleRetries = 3
+
+// identify an lvstore among spdk nodes
+type lvstoreKey struct {
+	spdkNode *storageNode
+	lvstore  string
+}
+
+// node:lvstore with enough free space for new volume
+type placement struct {
+	spdkNode    *storageNode
+	lvstore     string
+	freeSizeMiB int64
+	volumes     int // volumes created by us or in creation on this node:lvstore
+}
+
+// scheduler picks one placement from non empty candidates, candidates are
+// in order of spdk nodes in config map, with nodes of preferred topology first
+type scheduler interface {
+	pick(candidates []placement) *placement
+}
+
+// schedulers of all policies, stateful ones are shared by requests
+func newSchedulers() map[string]scheduler {
+	return map[string]scheduler{
+		policyFirst:         firstScheduler{},
+		policyMostFreeSpace: mostFreeSpaceScheduler{},
+		policyRoundRobin:    &roundRobinScheduler{},
+		policyWeighted:      &weightedScheduler{currentWeights: make(map[string]int)},
+		policyLeastVolumes:  leastVolumesScheduler{},
+	}
+}
+
+type firstScheduler struct{}
+
+func (firstScheduler) pick(candidates []placement) *placement {
+	return &candidates[0]
+}
+
+type mostFreeSpaceScheduler struct{}
+
+func (mostFreeSpaceScheduler) pick(candidates []placement) *placement {
+	picked := &candidates[0]
+	for i := range candidates {
+		if candidates[i].freeSizeMiB > picked.freeSizeMiB {
+			picked = &candidates[i]
+		}
+	}
+	return picked
+}
+
+type leastVolumesScheduler struct{}
+
+func (leastVolumesScheduler) pick(candidates []placement) *placement {
+	picked := &candidates[0]
+	for i := range candidates {
+		if candidates[i].volumes < picked.volumes {
+			picked = &candidates[i]
+		}
+	}
+	return picked
+}
+
+type roundRobinScheduler struct {
+	next int
+	mtx  sync.Mutex // protect next
+}
+
+func (s *roundRobinScheduler) pick(candidates []placement) *placement {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	picked := &candidates[s.next%len(candidates)]
+	s.next++
+	return picked
+}
+
+// smooth weighted round robin, each node:lvstore is picked in proportion to
+// weight of its node, and picks of different node:lvstores are interleaved
+type weightedScheduler struct {
+	currentWeights map[string]int // node:lvstore to current weight
+	mtx            sync.Mutex     // protect currentWeights
+}
+
+func (s *weightedScheduler) pick(candidates []placement) *placement {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var picked *placement
+	totalWeight := 0
+	for i := range candidates {
+		candidate := &candidates[i]
+		key := candidate.spdkNode.name + ":" + candidate.lvstore
+		weight := candidate.spdkNode.scheduleWeight()
+		s.currentWeights[key] += weight
+		totalWeight += weight
+		if picked == nil || s.currentWeights[key] > s.currentWeights[picked.spdkNode.name+":"+picked.lvstore] {
+			picked = candidate
+		}
+	}
+	s.currentWeights[picked.spdkNode.name+":"+picked.lvstore] -= totalWeight
+	return picked
+}
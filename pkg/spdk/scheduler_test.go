@@ -0,0 +1,324 @@
+package spdk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fake spdk node only reporting lvstores and creating volumes
+type fakeSpdkNode struct {
+	util.SpdkNode
+	name     string
+	lvstores []util.LvStore
+	err      error
+	full     map[string]bool  // lvstores failing volume creation with no space left
+	opts     util.LvolOptions // options of last created volume
+}
+
+func (node *fakeSpdkNode) Info() string {
+	return node.name
+}
+
+func (node *fakeSpdkNode) LvStores() ([]util.LvStore, error) {
+	return node.lvstores, node.err
+}
+
+func (node *fakeSpdkNode) CreateVolume(lvolName, lvsName string, _ int64, opts util.LvolOptions) (string, error) {
+	if node.full[lvsName] {
+		return "", util.ErrJSONNoSpaceLeft
+	}
+	node.opts = opts
+	return lvsName + "/" + lvolName, nil
+}
+
+func newFakeStorageNode(name string, weight int, lvstores ...util.LvStore) *storageNode {
+	return &storageNode{
+		SpdkNode: &fakeSpdkNode{name: name, lvstores: lvstores},
+		name:     name,
+		weight:   weight,
+	}
+}
+
+func newFakeController(spdkNodes ...*storageNode) *controllerServer {
+	return &controllerServer{
+		spdkNodes:       spdkNodes,
+		schedulers:      newSchedulers(),
+		schedulePolicy:  policyFirst,
+		keyProviders:    newKeyProviders(""),
+		volumes:         make(map[string]*volume),
+		reservations:    make(map[lvstoreKey]int64),
+		reservedVolumes: make(map[lvstoreKey]int),
+		placements:      make(map[string]*storageNode),
+	}
+}
+
+// schedule count volumes of sizeMiB per policy, return picked count per node:lvstore
+func scheduleVolumes(t *testing.T, cs *controllerServer, policy string, count int, sizeMiB int64) map[string]int {
+	picked := make(map[string]int)
+	for i := 0; i < count; i++ {
+		spdkNode, lvstore, err := cs.schedule(sizeMiB, nil, &volumeParams{schedulePolicy: policy}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.unreserve(spdkNode, lvstore, sizeMiB)
+		picked[spdkNode.name+":"+lvstore]++
+	}
+	return picked
+}
+
+func TestScheduleFirst(t *testing.T) {
+	cs := newFakeController(
+		newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+		newFakeStorageNode("node2", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 1000}),
+	)
+
+	picked := scheduleVolumes(t, cs, "", 3, 10)
+	if picked["node1:lvs0"] != 3 {
+		t.Fatalf("unexpected placement: %v", picked)
+	}
+	// node1 has not enough free space
+	picked = scheduleVolumes(t, cs, policyFirst, 1, 200)
+	if picked["node2:lvs0"] != 1 {
+		t.Fatalf("unexpected placement: %v", picked)
+	}
+}
+
+func TestScheduleMostFreeSpace(t *testing.T) {
+	cs := newFakeController(
+		newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+		newFakeStorageNode("node2", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 300}, util.LvStore{Name: "lvs1", FreeSizeMiB: 500}),
+	)
+
+	picked := scheduleVolumes(t, cs, policyMostFreeSpace, 1, 10)
+	if picked["node2:lvs1"] != 1 {
+		t.Fatalf("unexpected placement: %v", picked)
+	}
+}
+
+func TestScheduleRoundRobin(t *testing.T) {
+	cs := newFakeController(
+		newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+		newFakeStorageNode("node2", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+		newFakeStorageNode("node3", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+	)
+
+	picked := scheduleVolumes(t, cs, policyRoundRobin, 6, 10)
+	for _, name := range []string{"node1:lvs0", "node2:lvs0", "node3:lvs0"} {
+		if picked[name] != 2 {
+			t.Fatalf("unexpected placement: %v", picked)
+		}
+	}
+}
+
+func TestScheduleWeighted(t *testing.T) {
+	cs := newFakeController(
+		newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+		newFakeStorageNode("node2", 3, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}),
+	)
+
+	picked := scheduleVolumes(t, cs, policyWeighted, 8, 10)
+	if picked["node1:lvs0"] != 2 || picked["node2:lvs0"] != 6 {
+		t.Fatalf("unexpected placement: %v", picked)
+	}
+}
+
+func TestScheduleLeastVolumes(t *testing.T) {
+	node1 := newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	node2 := newFakeStorageNode("node2", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	cs := newFakeController(node1, node2)
+	cs.volumes["vol1"] = &volume{spdkNode: node1, lvstore: "lvs0"}
+	cs.volumes["vol2"] = &volume{spdkNode: node1, lvstore: "lvs0"}
+	cs.volumes["vol3"] = &volume{spdkNode: node2, lvstore: "lvs0"}
+
+	picked := scheduleVolumes(t, cs, policyLeastVolumes, 1, 10)
+	if picked["node2:lvs0"] != 1 {
+		t.Fatalf("unexpected placement: %v", picked)
+	}
+
+	// volumes in creation are counted, concurrent creations are spread
+	node3 := newFakeStorageNode("node3", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	node4 := newFakeStorageNode("node4", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	cs = newFakeController(node3, node4)
+	first, _, err := cs.schedule(10, nil, &volumeParams{schedulePolicy: policyLeastVolumes}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := cs.schedule(10, nil, &volumeParams{schedulePolicy: policyLeastVolumes}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("volumes in creation scheduled to same node %s", first.name)
+	}
+	cs.unreserve(first, "lvs0", 10)
+	cs.unreserve(second, "lvs0", 10)
+	if len(cs.reservedVolumes) != 0 {
+		t.Fatalf("reserved volumes not released: %v", cs.reservedVolumes)
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	node1 := newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	node2 := newFakeStorageNode("node2", 1)
+	node2.SpdkNode.(*fakeSpdkNode).err = errors.New("node down")
+	cs := newFakeController(node1, node2)
+
+	_, _, err := cs.schedule(10, nil, &volumeParams{schedulePolicy: "noSuchPolicy"}, nil)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expect InvalidArgument error, got: %v", err)
+	}
+
+	// unreachable node is skipped
+	spdkNode, _, err := cs.schedule(10, nil, &volumeParams{schedulePolicy: policyRoundRobin}, nil)
+	if err != nil || spdkNode != node1 {
+		t.Fatalf("unexpected placement: %v, %v", spdkNode, err)
+	}
+
+	_, _, err = cs.schedule(1000, nil, &volumeParams{schedulePolicy: policyMostFreeSpace}, nil)
+	if err == nil {
+		t.Fatal("expect no enough free space error")
+	}
+
+	// node1 is not accessible from requisite topology, node2 is down
+	node1.topology = map[string]string{"topology.spdk.io/rack": "rack1"}
+	_, _, err = cs.schedule(10, &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{{Segments: map[string]string{"topology.spdk.io/rack": "rack2"}}},
+	}, &volumeParams{}, nil)
+	if err == nil {
+		t.Fatal("expect no accessible node error")
+	}
+}
+
+func TestScheduleReservation(t *testing.T) {
+	node1 := newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}, util.LvStore{Name: "lvs1", FreeSizeMiB: 100})
+	cs := newFakeController(node1)
+
+	// space of volumes in creation is reserved
+	_, lvstore, err := cs.schedule(60, nil, &volumeParams{schedulePolicy: policyFirst}, nil)
+	if err != nil || lvstore != "lvs0" {
+		t.Fatalf("unexpected placement: %s, %v", lvstore, err)
+	}
+	_, lvstore, err = cs.schedule(60, nil, &volumeParams{schedulePolicy: policyFirst}, nil)
+	if err != nil || lvstore != "lvs1" {
+		t.Fatalf("unexpected placement: %s, %v", lvstore, err)
+	}
+	_, _, err = cs.schedule(60, nil, &volumeParams{schedulePolicy: policyFirst}, nil)
+	if err == nil {
+		t.Fatal("expect no enough free space error")
+	}
+
+	cs.unreserve(node1, "lvs0", 60)
+	_, lvstore, err = cs.schedule(60, nil, &volumeParams{schedulePolicy: policyFirst}, nil)
+	if err != nil || lvstore != "lvs0" {
+		t.Fatalf("unexpected placement: %s, %v", lvstore, err)
+	}
+
+	// excluded lvstore is not picked
+	cs.unreserve(node1, "lvs0", 60)
+	cs.unreserve(node1, "lvs1", 60)
+	_, lvstore, err = cs.schedule(60, nil, &volumeParams{schedulePolicy: policyFirst}, []lvstoreKey{{node1, "lvs0"}})
+	if err != nil || lvstore != "lvs1" {
+		t.Fatalf("unexpected placement: %s, %v", lvstore, err)
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	node1 := newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	node2 := newFakeStorageNode("node2", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	node1.SpdkNode.(*fakeSpdkNode).full = map[string]bool{"lvs0": true}
+	cs := newFakeController(node1, node2)
+
+	// re-scheduled to node2 if node1 has no space left
+	req := &csi.CreateVolumeRequest{
+		Name:          "test-volume-retry",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024},
+	}
+	volume, err := cs.createVolume(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.spdkNode != node2 {
+		t.Fatalf("unexpected placement: %s", volume.spdkNode.name)
+	}
+	if len(cs.reservations) != 0 {
+		t.Fatalf("reservations not released: %v", cs.reservations)
+	}
+
+	// fail if all lvstores have no space left
+	node2.SpdkNode.(*fakeSpdkNode).full = map[string]bool{"lvs0": true}
+	_, err = cs.createVolume(req)
+	if err == nil {
+		t.Fatal("expect no enough free space error")
+	}
+	if len(cs.reservations) != 0 {
+		t.Fatalf("reservations not released: %v", cs.reservations)
+	}
+}
+
+func TestCreateVolumeParams(t *testing.T) {
+	node1 := newFakeStorageNode("node1", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100})
+	node2 := newFakeStorageNode("node2", 1, util.LvStore{Name: "lvs0", FreeSizeMiB: 100}, util.LvStore{Name: "lvs1", FreeSizeMiB: 100})
+	cs := newFakeController(node1, node2)
+
+	// thick zeroed volume pinned to node2:lvs1
+	volume, err := cs.createVolume(&csi.CreateVolumeRequest{
+		Name:          "test-volume-params",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024},
+		Parameters: map[string]string{
+			"thinProvision": "false",
+			"clearMethod":   "write_zeroes",
+			"spdkNode":      "node2",
+			"lvstore":       "lvs1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.spdkNode != node2 || volume.lvstore != "lvs1" {
+		t.Fatalf("unexpected placement: %s:%s", volume.spdkNode.name, volume.lvstore)
+	}
+	opts := node2.SpdkNode.(*fakeSpdkNode).opts
+	if opts.ThinProvision || opts.ClearMethod != "write_zeroes" {
+		t.Fatalf("unexpected lvol options: %v", opts)
+	}
+
+	// default options
+	_, err = cs.createVolume(&csi.CreateVolumeRequest{
+		Name:          "test-volume-default-params",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node1.SpdkNode.(*fakeSpdkNode).opts != util.DefaultLvolOptions() {
+		t.Fatalf("unexpected lvol options: %v", node1.SpdkNode.(*fakeSpdkNode).opts)
+	}
+
+	for _, parameters := range []map[string]string{
+		{"thinProvision": "maybe"},
+		{"clearMethod": "shred"},
+		{"spdkNode": "node3"},
+		{"schedulePolicy": "random"},
+		{"rwIosPerSec": "1500"},
+		{"wMBytesPerSec": "-1"},
+		{"encryption": "yes"},
+		{"encryption": "true", "keyProvider": "file"}, // no kmsDir configured
+		{"keyProvider": "secret"},                     // encryption not enabled
+		{"encryption": "false", "keyProvider": "secret"},
+	} {
+		_, err = cs.createVolume(&csi.CreateVolumeRequest{
+			Name:          "test-volume-invalid-params",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * 1024 * 1024},
+			Parameters:    parameters,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expect InvalidArgument error for %v, got: %v", parameters, err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// SpdkStorageNode custom resource, see deploy/kubernetes/storagenode-crd.yaml
+var storageNodeGVR = schema.GroupVersionResource{
+	Group:    "csi.spdk.io",
+	Version:  "v1alpha1",
+	Resource: "spdkstoragenodes",
+}
+
+const (
+	storageNodeResync      = 10 * time.Minute
+	storageNodeSyncTimeout = time.Minute
+	// keys of rpc credentials in secret referenced by storage node
+	secretRPCUser = "username"
+	secretRPCPass = "password"
+)
+
+type storageNodeResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              storageNodeSpec `json:"spec"`
+}
+
+type storageNodeSpec struct {
+	RPCURL     string `json:"rpcURL"`
+	TargetType string `json:"targetType"`
+	TargetAddr string `json:"targetAddr"`
+	SecretRef  struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"secretRef"`
+	Topology    map[string]string     `json:"topology,omitempty"`
+	Weight      int                   `json:"weight,omitempty"`
+	KeyDir      string                `json:"keyDir,omitempty"`
+	TargetAddrs []string              `json:"targetAddrs,omitempty"`
+	AnaStates   map[string]string     `json:"anaStates,omitempty"`
+	Transport   util.TransportOptions `json:"transport"`
+	Maintenance bool                  `json:"maintenance,omitempty"`
+}
+
+// status reported back to storage node resource on each config reload, it's
+// not written if nothing but LastUpdateTime changes
+type storageNodeStatus struct {
+	Reachable         bool            `json:"reachable"`
+	Health            string          `json:"health"` // see health.go
+	Message           string          `json:"message,omitempty"`
+	Lvstores          []lvstoreStatus `json:"lvstores,omitempty"`
+	FreeCapacityBytes int64           `json:"freeCapacityBytes"`
+	VolumeCount       int64           `json:"volumeCount"`
+	LastUpdateTime    string          `json:"lastUpdateTime"`
+}
+
+type lvstoreStatus struct {
+	Name          string `json:"name"`
+	CapacityBytes int64  `json:"capacityBytes"`
+	FreeBytes     int64  `json:"freeBytes"`
+}
+
+// storageNodeWatcher discovers spdk nodes from SpdkStorageNode resources
+// with an informer, and notifies changed on resource events
+type storageNodeWatcher struct {
+	client    dynamic.Interface
+	clientset kubernetes.Interface
+	lister    cache.GenericLister
+	changed   chan struct{}
+}
+
+func newStorageNodeWatcher() (*storageNodeWatcher, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return startStorageNodeWatcher(client, clientset, wait.NeverStop)
+}
+
+func startStorageNodeWatcher(client dynamic.Interface, clientset kubernetes.Interface, stopCh <-chan struct{}) (*storageNodeWatcher, error) {
+	watcher := &storageNodeWatcher{
+		client:    client,
+		clientset: clientset,
+		changed:   make(chan struct{}, 1),
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, storageNodeResync)
+	informer := factory.ForResource(storageNodeGVR)
+	notify := func() {
+		select {
+		case watcher.changed <- struct{}{}:
+		default: // reload pending
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// status written by reportNodeStatus doesn't change generation,
+			// reloading on it would loop forever
+			if generationChanged(oldObj, newObj) {
+				notify()
+			}
+		},
+		DeleteFunc: func(interface{}) { notify() },
+	})
+	watcher.lister = informer.Lister()
+
+	factory.Start(stopCh)
+	ctx, cancel := context.WithTimeout(context.Background(), storageNodeSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync %s", storageNodeGVR.Resource)
+	}
+	return watcher, nil
+}
+
+func generationChanged(oldObj, newObj interface{}) bool {
+	oldU, ok1 := oldObj.(*unstructured.Unstructured)
+	newU, ok2 := newObj.(*unstructured.Unstructured)
+	if !ok1 || !ok2 {
+		return true
+	}
+	return oldU.GetGeneration() != newU.GetGeneration()
+}
+
+// nodes returns config and rpc token of storage nodes, node whose secret is
+// not available is skipped
+func (watcher *storageNodeWatcher) nodes() ([]spdkNodeConfig, []rpcToken, error) {
+	objs, err := watcher.lister.List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var configs []spdkNodeConfig
+	var tokens []rpcToken
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		var resource storageNodeResource
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &resource)
+		if err != nil {
+			klog.Errorf("invalid storage node %s: %s", u.GetName(), err.Error())
+			continue
+		}
+		spec := &resource.Spec
+		secret, err := watcher.clientset.CoreV1().Secrets(spec.SecretRef.Namespace).Get(context.TODO(), spec.SecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("failed to get secret of storage node %s: %s", resource.Name, err.Error())
+			continue
+		}
+		configs = append(configs, spdkNodeConfig{
+			Name:         resource.Name,
+			URL:          spec.RPCURL,
+			TargetType:   spec.TargetType,
+			TargetAddr:   spec.TargetAddr,
+			Topology:     spec.Topology,
+			Weight:       spec.Weight,
+			KeyDir:       spec.KeyDir,
+			TargetAddrs:  spec.TargetAddrs,
+			AnaStates:    spec.AnaStates,
+			Transport:    spec.Transport,
+			Maintenance:  spec.Maintenance,
+			fromResource: true,
+		})
+		tokens = append(tokens, rpcToken{
+			Name:     resource.Name,
+			UserName: string(secret.Data[secretRPCUser]),
+			Password: string(secret.Data[secretRPCPass]),
+		})
+	}
+	return configs, tokens, nil
+}
+
+func (watcher *storageNodeWatcher) updateStatus(name string, status *storageNodeStatus) error {
+	obj, err := watcher.lister.Get(name)
+	if err != nil {
+		return err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected storage node object: %T", obj)
+	}
+	if current, found := u.Object["status"].(map[string]interface{}); found {
+		var reported storageNodeStatus
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(current, &reported)
+		if err == nil {
+			reported.LastUpdateTime = status.LastUpdateTime
+			if reflect.DeepEqual(&reported, status) {
+				return nil
+			}
+		}
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return err
+	}
+	u = u.DeepCopy()
+	u.Object["status"] = content
+	_, err = watcher.client.Resource(storageNodeGVR).UpdateStatus(context.TODO(), u, metav1.UpdateOptions{})
+	return err
+}
+
+// append nodes of storage node resources to config, node of same name in
+// config map takes precedence
+func (cs *controllerServer) addResourceNodes(config *controllerConfig, tokens []rpcToken) ([]rpcToken, error) {
+	configs, resourceTokens, err := cs.nodeWatcher.nodes()
+	if err != nil {
+		return nil, err
+	}
+	for i := range configs {
+		if configured(config.Nodes, configs[i].Name) {
+			klog.Errorf("storage node %s is ignored, spdk node of same name exists in config map", configs[i].Name)
+			continue
+		}
+		config.Nodes = append(config.Nodes, configs[i])
+		tokens = append(tokens, resourceTokens[i])
+	}
+	return tokens, nil
+}
+
+func configured(nodes []spdkNodeConfig, name string) bool {
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// report status of spdk nodes created from storage node resources, lvstores
+// are taken from last probe, see health.go
+func (cs *controllerServer) reportNodeStatus() {
+	volumeCounts := make(map[*storageNode]int64)
+	cs.mtx.Lock()
+	for _, volume := range cs.volumes {
+		volumeCounts[volume.spdkNode]++
+	}
+	cs.mtx.Unlock()
+
+	for _, spdkNode := range cs.storageNodes() {
+		if !spdkNode.config.fromResource {
+			continue
+		}
+		state, lastErr := spdkNode.health.get()
+		status := storageNodeStatus{
+			Health:         state.String(),
+			VolumeCount:    volumeCounts[spdkNode],
+			LastUpdateTime: time.Now().UTC().Format(time.RFC3339),
+		}
+		lvstores := spdkNode.health.getLvStores()
+		if lvstores == nil {
+			if lastErr != nil {
+				status.Message = lastErr.Error()
+			}
+		} else {
+			status.Reachable = true
+			for _, lvs := range lvstores {
+				status.Lvstores = append(status.Lvstores, lvstoreStatus{
+					Name:          lvs.Name,
+					CapacityBytes: lvs.TotalSizeMiB * 1024 * 1024,
+					FreeBytes:     lvs.FreeSizeMiB * 1024 * 1024,
+				})
+				status.FreeCapacityBytes += lvs.FreeSizeMiB * 1024 * 1024
+			}
+		}
+		err := cs.nodeWatcher.updateStatus(spdkNode.name, &status)
+		if err != nil {
+			klog.Errorf("failed to update status of storage node %s: %s", spdkNode.name, err.Error())
+		}
+	}
+}
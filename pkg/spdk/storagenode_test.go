@@ -0,0 +1,200 @@
+package spdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func testStorageNode(name string, maintenance bool) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "csi.spdk.io/v1alpha1",
+		"kind":       "SpdkStorageNode",
+		"metadata": map[string]interface{}{
+			"name": name,
+		},
+		"spec": map[string]interface{}{
+			"rpcURL":      "http://127.0.0.1:9009",
+			"targetType":  "nvme-tcp",
+			"targetAddr":  "127.0.0.1",
+			"targetAddrs": []interface{}{"127.0.0.2"},
+			"transport":   map[string]interface{}{"maxQueueDepth": int64(128)},
+			"maintenance": maintenance,
+			"secretRef": map[string]interface{}{
+				"name":      "spdkcsi-storage-node",
+				"namespace": "default",
+			},
+		},
+	}}
+}
+
+// wait until informer cache of storage nodes satisfies check
+func waitStorageNodes(t *testing.T, watcher *storageNodeWatcher, check func([]spdkNodeConfig) bool) {
+	for i := 0; i < 100; i++ {
+		configs, _, err := watcher.nodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check(configs) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("storage nodes not synced")
+}
+
+//nolint:cyclop // TestStorageNodeResource exceeds cyclomatic complexity of 10
+func TestStorageNodeResource(t *testing.T) {
+	cs, _, err := createTestController("nvme-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfigFiles(t, testNodeConfig, testNodeSecret)
+
+	//nolint:gosec // only for test
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "spdkcsi-storage-node", Namespace: "default"},
+		Data: map[string][]byte{
+			secretRPCUser: []byte("spdkcsiuser"),
+			secretRPCPass: []byte("spdkcsipass"),
+		},
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{storageNodeGVR: "SpdkStorageNodeList"},
+		testStorageNode("storage-a", false),
+		// conflicts with node in config map, ignored
+		testStorageNode("localhost", false))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cs.nodeWatcher, err = startStorageNodeWatcher(client, kubefake.NewSimpleClientset(secret), stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cs.nodeWatcher.changed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no storage node event")
+	}
+
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := cs.storageNodes()
+	if len(nodes) != 2 || nodes[0].config.fromResource || !nodes[1].config.fromResource || nodes[1].name != "storage-a" {
+		t.Fatalf("unexpected spdk nodes: %v", nodes)
+	}
+	spdkNode := nodes[1]
+	if len(spdkNode.config.TargetAddrs) != 1 || spdkNode.config.Transport.MaxQueueDepth != 128 {
+		t.Fatalf("unexpected storage node config: %+v", spdkNode.config)
+	}
+
+	// status is reported to resource of created node only
+	obj, err := client.Resource(storageNodeGVR).Get(context.TODO(), "storage-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reachable, _, _ := unstructured.NestedBool(obj.Object, "status", "reachable")
+	free, _, _ := unstructured.NestedInt64(obj.Object, "status", "freeCapacityBytes")
+	if !reachable || free <= 0 {
+		t.Fatalf("unexpected storage node status: %v", obj.Object["status"])
+	}
+	obj, err = client.Resource(storageNodeGVR).Get(context.TODO(), "localhost", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := obj.Object["status"]; found {
+		t.Fatal("status should not be reported to ignored storage node")
+	}
+
+	// unchanged status is not written again, and status change doesn't
+	// trigger reload
+	statusUpdates := func() int {
+		count := 0
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+				count++
+			}
+		}
+		return count
+	}
+	for i := 0; ; i++ {
+		obj, err := cs.nodeWatcher.lister.Get("storage-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found := obj.(*unstructured.Unstructured).Object["status"]; found {
+			break
+		}
+		if i >= 100 {
+			t.Fatal("storage node status not synced")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	updates := statusUpdates()
+	cs.reportNodeStatus()
+	if statusUpdates() != updates {
+		t.Fatal("unchanged status should not be written")
+	}
+	oldObj := testStorageNode("storage-a", false)
+	newObj := oldObj.DeepCopy()
+	newObj.Object["status"] = map[string]interface{}{"reachable": true}
+	if generationChanged(oldObj, newObj) {
+		t.Fatal("status change should not trigger reload")
+	}
+	newObj.SetGeneration(oldObj.GetGeneration() + 1)
+	if !generationChanged(oldObj, newObj) {
+		t.Fatal("spec change should trigger reload")
+	}
+
+	// maintenance is changed in place, node is excluded from scheduling
+	_, err = client.Resource(storageNodeGVR).Update(context.TODO(), testStorageNode("storage-a", true), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStorageNodes(t, cs.nodeWatcher, func(configs []spdkNodeConfig) bool {
+		for i := range configs {
+			if configs[i].Name == "storage-a" {
+				return configs[i].Maintenance
+			}
+		}
+		return false
+	})
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes = cs.storageNodes()
+	if len(nodes) != 2 || nodes[1] != spdkNode || !spdkNode.maintenance.Load() {
+		t.Fatalf("spdk node not in maintenance: %v", nodes)
+	}
+	for _, accessible := range cs.accessibleNodes(nil) {
+		if accessible == spdkNode {
+			t.Fatal("spdk node in maintenance should not be accessible")
+		}
+	}
+
+	// node is removed with resource
+	err = client.Resource(storageNodeGVR).Delete(context.TODO(), "storage-a", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStorageNodes(t, cs.nodeWatcher, func(configs []spdkNodeConfig) bool {
+		return len(configs) == 1
+	})
+	err = cs.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes = cs.storageNodes(); len(nodes) != 1 || nodes[0].name != "localhost" {
+		t.Fatalf("spdk node not removed: %v", nodes)
+	}
+}
@@ -18,13 +18,13 @@ package util
 
 const (
 	// TODO: move hardcoded settings to config map
-	cfgRPCTimeoutSeconds = 20
-	cfgLvolClearMethod   = "unmap" // none, unmap, write_zeroes
-	cfgLvolThinProvision = true
-	cfgNVMfSvcPort       = "4420"
-	cfgISCSISvcPort      = "3260"
-	cfgAllowAnyHost      = true
-	cfgAddrFamily        = "IPv4" // IPv4, IPv6, IB, FC
+	cfgRPCTimeoutSeconds  = 20
+	cfgPingTimeoutSeconds = 3       // health check of spdk node
+	cfgLvolClearMethod    = "unmap" // none, unmap, write_zeroes, overridden by StorageClass "clearMethod"
+	cfgLvolThinProvision  = true    // overridden by StorageClass "thinProvision"
+	cfgNVMfSvcPort        = "4420"
+	cfgISCSISvcPort       = "3260"
+	cfgAllowAnyHost       = false // hosts are allowed per ControllerPublishVolume
 )
 
 // Config stores parsed command line parameters
@@ -36,4 +36,6 @@ type Config struct {
 
 	IsControllerServer bool
 	IsNodeServer       bool
+
+	MetricsAddress string // serve prometheus metrics if not empty
 }
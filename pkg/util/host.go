@@ -0,0 +1,202 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// keys of iSCSI CHAP credentials in csi secrets, mapped to iscsiadm node
+// settings by initiator
+const (
+	SecretChapUser         = "chap-user"
+	SecretChapSecret       = "chap-secret"
+	SecretMutualChapUser   = "mutual-chap-user"   // authenticates target
+	SecretMutualChapSecret = "mutual-chap-secret" // authenticates target
+)
+
+// keys of NVMe-oF authentication in csi secrets, named after nvme-cli options
+const (
+	SecretDHChapSecret     = "dhchap-secret"      // DHHC-1:xx:...:
+	SecretDHChapCtrlSecret = "dhchap-ctrl-secret" // DHHC-1:xx:...:
+	SecretTLSKey           = "tls-key"            // NVMeTLSkey-1:xx:...:
+
+	dhchapSecretPrefix = "DHHC-1:"
+	tlsKeyPrefix       = "NVMeTLSkey-1:"
+)
+
+const (
+	hostNQNFile       = "/etc/nvme/hostnqn"
+	initiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	// initiator name of the host, mounted read-only by node daemonset apart
+	// from /etc/iscsi, where iscsiadm keeps its node records
+	hostInitiatorNameFile = "/host" + initiatorNameFile
+	// kubernetes rejects CSINode with longer node id
+	maxNodeIDLength = 192
+)
+
+// HostID identifies a client node to spdk targets, so only the node a volume
+// is published to can connect to it. Empty field means the node has no such
+// identity, and volumes cannot be published to it through that transport.
+type HostID struct {
+	NQN string `json:"nqn,omitempty"` // nvme host nqn
+	IQN string `json:"iqn,omitempty"` // iscsi initiator name
+}
+
+// csi node id reported by node server, controller server decodes host id
+// from node id passed in ControllerPublishVolume
+type nodeID struct {
+	Name string `json:"name"`
+	HostID
+}
+
+// EncodeNodeID encodes node name and host id to csi node id, node name is
+// returned as is if host id is empty or encoded node id is too long
+func EncodeNodeID(name string, host HostID) string {
+	if host == (HostID{}) {
+		return name
+	}
+	data, err := json.Marshal(nodeID{Name: name, HostID: host})
+	if err != nil || len(data) > maxNodeIDLength {
+		klog.Warningf("cannot encode host id to node id of %s, volumes cannot be published to it", name)
+		return name
+	}
+	return string(data)
+}
+
+// DecodeNodeID decodes node name and host id from csi node id. Plain node id,
+// reported by nodes without host id or by older releases, is taken as node
+// name with empty host id, and so is any node id not encoded by EncodeNodeID.
+func DecodeNodeID(id string) (name string, host HostID) {
+	var decoded nodeID
+	if strings.HasPrefix(id, "{") && json.Unmarshal([]byte(id), &decoded) == nil && decoded.Name != "" {
+		return decoded.Name, decoded.HostID
+	}
+	return id, HostID{}
+}
+
+// SameNode checks if two csi node ids are of same node, node id changes from
+// plain node name to encoded one after the node is upgraded
+func SameNode(id1, id2 string) bool {
+	name1, _ := DecodeNodeID(id1)
+	name2, _ := DecodeNodeID(id2)
+	return name1 == name2
+}
+
+// LocalHostID returns host nqn and initiator name used by nvme-cli and
+// iscsiadm on this node, field is empty if not configured
+func LocalHostID() HostID {
+	var host HostID
+	if data, err := os.ReadFile(hostNQNFile); err == nil {
+		host.NQN = strings.TrimSpace(string(data))
+	}
+	host.IQN = readInitiatorName(hostInitiatorNameFile)
+	if host.IQN == "" {
+		host.IQN = readInitiatorName(initiatorNameFile)
+	}
+	return host
+}
+
+func readInitiatorName(file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	// InitiatorName=iqn.2005-03.org.open-iscsi:xxx
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "InitiatorName=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "InitiatorName="))
+		}
+	}
+	return ""
+}
+
+// Credentials authenticates client host to spdk target, controller server
+// configures target with it per ControllerPublishVolume secrets, and node
+// server connects target with it per NodeStageVolume secrets
+type Credentials struct {
+	// iSCSI CHAP, mutual CHAP also authenticates target to initiator
+	ChapUser         string
+	ChapSecret       string
+	MutualChapUser   string
+	MutualChapSecret string
+	// NVMe-oF DH-HMAC-CHAP, controller secret also authenticates target to host
+	DHChapSecret     string
+	DHChapCtrlSecret string
+	// NVMe/TCP TLS pre-shared key
+	TLSKey string
+}
+
+// CredentialsFromSecrets parses credentials from csi secrets, empty
+// credentials are returned if no related keys are found
+func CredentialsFromSecrets(secrets map[string]string) (Credentials, error) {
+	creds := Credentials{
+		ChapUser:         secrets[SecretChapUser],
+		ChapSecret:       secrets[SecretChapSecret],
+		MutualChapUser:   secrets[SecretMutualChapUser],
+		MutualChapSecret: secrets[SecretMutualChapSecret],
+		DHChapSecret:     secrets[SecretDHChapSecret],
+		DHChapCtrlSecret: secrets[SecretDHChapCtrlSecret],
+		TLSKey:           secrets[SecretTLSKey],
+	}
+	if (creds.ChapUser == "") != (creds.ChapSecret == "") {
+		return Credentials{}, fmt.Errorf("both %s and %s must be provided", SecretChapUser, SecretChapSecret)
+	}
+	if (creds.MutualChapUser == "") != (creds.MutualChapSecret == "") {
+		return Credentials{}, fmt.Errorf("both %s and %s must be provided", SecretMutualChapUser, SecretMutualChapSecret)
+	}
+	if creds.MutualChapUser != "" && creds.ChapUser == "" {
+		return Credentials{}, fmt.Errorf("mutual CHAP requires %s", SecretChapUser)
+	}
+	if creds.DHChapCtrlSecret != "" && creds.DHChapSecret == "" {
+		return Credentials{}, fmt.Errorf("%s requires %s", SecretDHChapCtrlSecret, SecretDHChapSecret)
+	}
+	for key, value := range map[string]string{
+		SecretDHChapSecret:     creds.DHChapSecret,
+		SecretDHChapCtrlSecret: creds.DHChapCtrlSecret,
+	} {
+		if value != "" && !strings.HasPrefix(value, dhchapSecretPrefix) {
+			return Credentials{}, fmt.Errorf("%s must be in format %s...", key, dhchapSecretPrefix)
+		}
+	}
+	if creds.TLSKey != "" && !strings.HasPrefix(creds.TLSKey, tlsKeyPrefix) {
+		return Credentials{}, fmt.Errorf("%s must be in format %s...", SecretTLSKey, tlsKeyPrefix)
+	}
+	return creds, nil
+}
+
+func (creds *Credentials) empty() bool {
+	return *creds == Credentials{}
+}
+
+func (creds *Credentials) chapEnabled() bool {
+	return creds.ChapUser != ""
+}
+
+func (creds *Credentials) mutualChapEnabled() bool {
+	return creds.MutualChapUser != ""
+}
+
+func (creds *Credentials) nvmeAuthEnabled() bool {
+	return creds.DHChapSecret != "" || creds.TLSKey != ""
+}
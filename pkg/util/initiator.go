@@ -20,42 +20,69 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"k8s.io/klog"
 )
 
+var nvmeNamespaceRegex = regexp.MustCompile(`^(/dev/nvme\d+)n\d+$`)
+
+// sysfs directory of block devices, replaced in tests
+var sysBlockDir = "/sys/block"
+
 // SpdkCsiInitiator defines interface for NVMeoF/iSCSI initiator
 //   - Connect initiates target connection and returns local block device filename
 //     e.g., /dev/disk/by-id/nvme-SPDK_Controller1_SPDK00000000000001
 //   - Disconnect terminates target connection
+//   - Rescan refreshes local block device size after target volume resized
 //   - Caller(node service) should serialize calls to same initiator
 //   - Implementation should be idempotent to duplicated requests
 type SpdkCsiInitiator interface {
 	Connect() (string, error)
 	Disconnect() error
+	Rescan() error
 }
 
-func NewSpdkCsiInitiator(volumeContext map[string]string) (SpdkCsiInitiator, error) {
+// NewSpdkCsiInitiator creates initiator per volume context, initiator
+// authenticates to target with the credentials if not empty
+func NewSpdkCsiInitiator(volumeContext map[string]string, creds Credentials) (SpdkCsiInitiator, error) {
 	targetType := strings.ToLower(volumeContext["targetType"])
 	switch targetType {
 	case "rdma", "tcp":
+		if creds.chapEnabled() {
+			return nil, fmt.Errorf("iSCSI CHAP is not supported by NVMe-oF initiator")
+		}
+		// see util/nvmf.go VolumeInfo(), volumes published before multipath
+		// support have only targetAddr
+		targetAddrs := []string{volumeContext["targetAddr"]}
+		if volumeContext["targetAddrs"] != "" {
+			targetAddrs = strings.Split(volumeContext["targetAddrs"], ",")
+		}
 		return &initiatorNVMf{
-			// see util/nvmf.go VolumeInfo()
-			targetType: volumeContext["targetType"],
-			targetAddr: volumeContext["targetAddr"],
-			targetPort: volumeContext["targetPort"],
-			nqn:        volumeContext["nqn"],
-			model:      volumeContext["model"],
+			targetType:  volumeContext["targetType"],
+			targetAddrs: targetAddrs,
+			targetPort:  volumeContext["targetPort"],
+			nqn:         volumeContext["nqn"],
+			model:       volumeContext["model"],
+			hdrDigest:   volumeContext["headerDigest"] == "true",
+			dataDigest:  volumeContext["dataDigest"] == "true",
+			creds:       creds,
 		}, nil
 	case "iscsi":
+		if creds.nvmeAuthEnabled() {
+			return nil, fmt.Errorf("NVMe-oF authentication is not supported by iSCSI initiator")
+		}
 		return &initiatorISCSI{
 			targetAddr: volumeContext["targetAddr"],
 			targetPort: volumeContext["targetPort"],
 			iqn:        volumeContext["iqn"],
+			creds:      creds,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown initiator: %s", targetType)
@@ -64,23 +91,32 @@ func NewSpdkCsiInitiator(volumeContext map[string]string) (SpdkCsiInitiator, err
 
 // NVMf initiator implementation
 type initiatorNVMf struct {
-	targetType string
-	targetAddr string
-	targetPort string
-	nqn        string
-	model      string
+	targetType  string
+	targetAddrs []string
+	targetPort  string
+	nqn         string
+	model       string
+	hdrDigest   bool // TCP PDU header digest
+	dataDigest  bool // TCP PDU data digest
+	creds       Credentials
 }
 
+// connect all paths of the volume, native nvme multipath merges them into
+// one namespace device and handles failover
 func (nvmf *initiatorNVMf) Connect() (string, error) {
-	// nvme connect -t tcp -a 192.168.1.100 -s 4420 -n "nqn"
-	cmdLine := []string{
-		"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
-		"-a", nvmf.targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn,
-	}
-	err := execWithTimeout(cmdLine, 40)
-	if err != nil {
-		// go on checking device status in case caused by duplicated request
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+	hostNQN := LocalHostID().NQN
+	sensitive := []string{nvmf.creds.DHChapSecret, nvmf.creds.DHChapCtrlSecret, nvmf.creds.TLSKey}
+	for _, targetAddr := range nvmf.targetAddrs {
+		cmdLine, err := nvmf.connectCmdLine(targetAddr, hostNQN)
+		if err != nil {
+			return "", err
+		}
+		err = execWithTimeoutMasked(cmdLine, 40, sensitive...)
+		if err != nil {
+			// go on checking device status in case caused by duplicated
+			// request or other paths are available
+			klog.Errorf("command %v failed: %s", maskArgs(cmdLine, sensitive...), err)
+		}
 	}
 
 	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
@@ -91,6 +127,39 @@ func (nvmf *initiatorNVMf) Connect() (string, error) {
 	return devicePath, nil
 }
 
+func (nvmf *initiatorNVMf) connectCmdLine(targetAddr, hostNQN string) ([]string, error) {
+	// nvme connect -t tcp -a 192.168.1.100 -s 4420 -n "nqn"
+	cmdLine := []string{
+		"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
+		"-a", targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn,
+	}
+	// must match host nqn reported in node id, see EncodeNodeID
+	if hostNQN != "" {
+		cmdLine = append(cmdLine, "--hostnqn", hostNQN)
+	} else if nvmf.creds.nvmeAuthEnabled() {
+		return nil, fmt.Errorf("NVMe-oF authentication requires host nqn in %s", hostNQNFile)
+	}
+	if nvmf.creds.DHChapSecret != "" {
+		cmdLine = append(cmdLine, "--dhchap-secret", nvmf.creds.DHChapSecret)
+	}
+	if nvmf.creds.DHChapCtrlSecret != "" {
+		cmdLine = append(cmdLine, "--dhchap-ctrl-secret", nvmf.creds.DHChapCtrlSecret)
+	}
+	if nvmf.creds.TLSKey != "" {
+		if strings.ToLower(nvmf.targetType) != "tcp" {
+			return nil, fmt.Errorf("TLS is not supported by %s transport", nvmf.targetType)
+		}
+		cmdLine = append(cmdLine, "--tls", "--tls_key", nvmf.creds.TLSKey)
+	}
+	if nvmf.hdrDigest {
+		cmdLine = append(cmdLine, "--hdr-digest")
+	}
+	if nvmf.dataDigest {
+		cmdLine = append(cmdLine, "--data-digest")
+	}
+	return cmdLine, nil
+}
+
 func (nvmf *initiatorNVMf) Disconnect() error {
 	// nvme disconnect -n "nqn"
 	cmdLine := []string{"nvme", "disconnect", "-n", nvmf.nqn}
@@ -104,20 +173,46 @@ func (nvmf *initiatorNVMf) Disconnect() error {
 	return waitForDeviceGone(deviceGlob, 20)
 }
 
+func (nvmf *initiatorNVMf) Rescan() error {
+	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
+	devicePath, err := waitForDeviceReady(deviceGlob, 0)
+	if err != nil {
+		return err
+	}
+	// /dev/nvme0n1 -> /dev/nvme0
+	devicePath, err = filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return err
+	}
+	controller := nvmeNamespaceRegex.ReplaceAllString(devicePath, "$1")
+	if controller == devicePath {
+		return fmt.Errorf("unknown nvme namespace device: %s", devicePath)
+	}
+
+	// nvme ns-rescan /dev/nvme0
+	cmdLine := []string{"nvme", "ns-rescan", controller}
+	return execWithTimeout(cmdLine, 40)
+}
+
 type initiatorISCSI struct {
 	targetAddr string
 	targetPort string
 	iqn        string
+	creds      Credentials
 }
 
 func (iscsi *initiatorISCSI) Connect() (string, error) {
 	// iscsiadm -m discovery -t sendtargets -p ip:port
-	target := iscsi.targetAddr + ":" + iscsi.targetPort
+	target := net.JoinHostPort(iscsi.targetAddr, iscsi.targetPort)
 	cmdLine := []string{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", target}
 	err := execWithTimeout(cmdLine, 40)
 	if err != nil {
 		klog.Errorf("command %v failed: %s", cmdLine, err)
 	}
+	err = iscsi.setChap(target)
+	if err != nil {
+		return "", err
+	}
 	// iscsiadm -m node -T "iqn" -p ip:port --login
 	cmdLine = []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--login"}
 	err = execWithTimeout(cmdLine, 40)
@@ -133,8 +228,39 @@ func (iscsi *initiatorISCSI) Connect() (string, error) {
 	return devicePath, nil
 }
 
+// iscsiadm node settings of CHAP credentials
+func chapSettings(creds *Credentials) [][2]string {
+	if !creds.chapEnabled() {
+		return nil
+	}
+	settings := [][2]string{
+		{"node.session.auth.authmethod", "CHAP"},
+		{"node.session.auth.username", creds.ChapUser},
+		{"node.session.auth.password", creds.ChapSecret},
+	}
+	if creds.mutualChapEnabled() {
+		settings = append(settings,
+			[2]string{"node.session.auth.username_in", creds.MutualChapUser},
+			[2]string{"node.session.auth.password_in", creds.MutualChapSecret})
+	}
+	return settings
+}
+
+// set CHAP credentials of the discovered node record before login
+func (iscsi *initiatorISCSI) setChap(target string) error {
+	for _, setting := range chapSettings(&iscsi.creds) {
+		// iscsiadm -m node -T "iqn" -p ip:port -o update -n name -v value
+		cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "-o", "update", "-n", setting[0], "-v", setting[1]}
+		err := execWithTimeoutMasked(cmdLine, 40, iscsi.creds.ChapSecret, iscsi.creds.MutualChapSecret)
+		if err != nil {
+			return fmt.Errorf("failed to set %s: %w", setting[0], err)
+		}
+	}
+	return nil
+}
+
 func (iscsi *initiatorISCSI) Disconnect() error {
-	target := iscsi.targetAddr + ":" + iscsi.targetPort
+	target := net.JoinHostPort(iscsi.targetAddr, iscsi.targetPort)
 	// iscsiadm -m node -T "iqn" -p ip:port --logout
 	cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--logout"}
 	err := execWithTimeout(cmdLine, 40)
@@ -146,6 +272,75 @@ func (iscsi *initiatorISCSI) Disconnect() error {
 	return waitForDeviceGone(deviceGlob, 20)
 }
 
+func (iscsi *initiatorISCSI) Rescan() error {
+	target := net.JoinHostPort(iscsi.targetAddr, iscsi.targetPort)
+	// iscsiadm -m node -T "iqn" -p ip:port --rescan
+	cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--rescan"}
+	return execWithTimeout(cmdLine, 40)
+}
+
+// CheckDeviceHealth checks if a connected device is present and reachable,
+// error describes the abnormal condition
+//   - NVMe namespace: at least one of its controllers is live
+//   - SCSI disk(iSCSI): device is running
+func CheckDeviceHealth(devicePath string) error {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("device %s not found: %w", devicePath, err)
+	}
+	name := filepath.Base(realPath)
+	if strings.HasPrefix(name, "nvme") {
+		return checkNvmeControllers(name)
+	}
+
+	state, err := readSysfsAttr(filepath.Join(sysBlockDir, name, "device", "state"))
+	if err != nil {
+		klog.Warningf("state of device %s unknown: %s", name, err)
+		return nil
+	}
+	if state != "running" {
+		return fmt.Errorf("device %s is %s", name, state)
+	}
+	return nil
+}
+
+func checkNvmeControllers(name string) error {
+	// with native nvme multipath, namespace head has a hidden namespace per
+	// controller, e.g., nvme0c0n1 and nvme0c1n1 of nvme0n1
+	paths := []string{name}
+	if entries, err := os.ReadDir(filepath.Join(sysBlockDir, name, "multipath")); err == nil && len(entries) > 0 {
+		paths = paths[:0]
+		for _, entry := range entries {
+			paths = append(paths, entry.Name())
+		}
+	}
+
+	var states []string
+	for _, path := range paths {
+		state, err := readSysfsAttr(filepath.Join(sysBlockDir, path, "device", "state"))
+		if err != nil {
+			klog.Warningf("state of nvme controller of %s unknown: %s", path, err)
+			continue
+		}
+		if state == "live" {
+			return nil
+		}
+		states = append(states, path+": "+state)
+	}
+	if len(states) == 0 {
+		return nil
+	}
+	return fmt.Errorf("no live nvme controller of %s (%s)", name, strings.Join(states, ", "))
+}
+
+func readSysfsAttr(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 // wait for device file comes up or timeout
 func waitForDeviceReady(deviceGlob string, seconds int) (string, error) {
 	for i := 0; i <= seconds; i++ {
@@ -179,10 +374,29 @@ func waitForDeviceGone(deviceGlob string, seconds int) error {
 
 // exec shell command with timeout(in seconds)
 func execWithTimeout(cmdLine []string, timeout int) error {
+	return execWithTimeoutMasked(cmdLine, timeout)
+}
+
+// replace sensitive arguments for logging
+func maskArgs(cmdLine []string, sensitive ...string) []string {
+	masked := make([]string, len(cmdLine))
+	for i, arg := range cmdLine {
+		masked[i] = arg
+		for _, value := range sensitive {
+			if value != "" && arg == value {
+				masked[i] = "******"
+			}
+		}
+	}
+	return masked
+}
+
+// execWithTimeout, sensitive arguments are masked in logs
+func execWithTimeoutMasked(cmdLine []string, timeout int, sensitive ...string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
 
-	klog.Infof("running command: %v", cmdLine)
+	klog.Infof("running command: %v", maskArgs(cmdLine, sensitive...))
 	//nolint:gosec // execWithTimeout assumes valid cmd arguments
 	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
 	output, err := cmd.CombinedOutput()
@@ -18,6 +18,9 @@ limitations under the License.
 package util
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -52,6 +55,156 @@ func TestExecWithTimeoutTimeout(t *testing.T) {
 	}
 }
 
+func TestNVMfConnectCmdLine(t *testing.T) {
+	nvmf := &initiatorNVMf{
+		targetType:  "TCP",
+		targetAddrs: []string{"192.168.1.100", "192.168.2.100"},
+		targetPort:  "4420",
+		nqn:         "nqn.2020-04.io.spdk.csi:uuid:test",
+		hdrDigest:   true,
+		dataDigest:  true,
+		creds: Credentials{
+			DHChapSecret:     "DHHC-1:00:host:",
+			DHChapCtrlSecret: "DHHC-1:00:ctrl:",
+			TLSKey:           "NVMeTLSkey-1:01:psk:",
+		},
+	}
+	cmdLine, err := nvmf.connectCmdLine("192.168.2.100", "nqn.2014-08.org.nvmexpress:uuid:host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"nvme", "connect", "-t", "tcp", "-a", "192.168.2.100", "-s", "4420", "-n", "nqn.2020-04.io.spdk.csi:uuid:test",
+		"--hostnqn", "nqn.2014-08.org.nvmexpress:uuid:host",
+		"--dhchap-secret", "DHHC-1:00:host:", "--dhchap-ctrl-secret", "DHHC-1:00:ctrl:",
+		"--tls", "--tls_key", "NVMeTLSkey-1:01:psk:",
+		"--hdr-digest", "--data-digest",
+	}
+	if !reflect.DeepEqual(cmdLine, expected) {
+		t.Fatalf("command line mismatch: %v", cmdLine)
+	}
+	masked := maskArgs(cmdLine, nvmf.creds.DHChapSecret, nvmf.creds.DHChapCtrlSecret, nvmf.creds.TLSKey)
+	for _, arg := range masked {
+		if arg == nvmf.creds.DHChapSecret || arg == nvmf.creds.DHChapCtrlSecret || arg == nvmf.creds.TLSKey {
+			t.Fatalf("secret not masked: %v", masked)
+		}
+	}
+
+	// authentication requires host nqn
+	_, err = nvmf.connectCmdLine("192.168.1.100", "")
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	// TLS over RDMA
+	nvmf.targetType = "RDMA"
+	_, err = nvmf.connectCmdLine("192.168.1.100", "nqn.2014-08.org.nvmexpress:uuid:host")
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestChapSettings(t *testing.T) {
+	creds := Credentials{ChapUser: "user", ChapSecret: "secret", MutualChapUser: "muser", MutualChapSecret: "msecret"}
+	expected := [][2]string{
+		{"node.session.auth.authmethod", "CHAP"},
+		{"node.session.auth.username", "user"},
+		{"node.session.auth.password", "secret"},
+		{"node.session.auth.username_in", "muser"},
+		{"node.session.auth.password_in", "msecret"},
+	}
+	if settings := chapSettings(&creds); !reflect.DeepEqual(settings, expected) {
+		t.Fatalf("unexpected iscsiadm settings: %v", settings)
+	}
+	if settings := chapSettings(&Credentials{}); settings != nil {
+		t.Fatalf("unexpected iscsiadm settings: %v", settings)
+	}
+
+	// SMA initiator cannot pass credentials
+	_, err := NewSpdkCsiSmaInitiator(nil, creds, nil, "xpu-sma-nvmftcp")
+	if err == nil {
+		t.Fatal("SMA initiator should reject credentials")
+	}
+	_, err = NewSpdkCsiSmaInitiator(nil, Credentials{}, nil, "xpu-sma-nvmftcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckDeviceHealth(t *testing.T) {
+	root := t.TempDir()
+	sysBlockDir = filepath.Join(root, "sys", "block")
+	defer func() { sysBlockDir = "/sys/block" }()
+
+	// device file and sysfs state attribute of block device
+	createDevice := func(name, state string) string {
+		devicePath := filepath.Join(root, "dev", name)
+		err := os.MkdirAll(filepath.Dir(devicePath), 0o755)
+		if err == nil {
+			err = os.WriteFile(devicePath, nil, 0o600)
+		}
+		if err == nil && state != "" {
+			err = os.MkdirAll(filepath.Join(sysBlockDir, name, "device"), 0o755)
+		}
+		if err == nil && state != "" {
+			err = os.WriteFile(filepath.Join(sysBlockDir, name, "device", "state"), []byte(state+"\n"), 0o600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return devicePath
+	}
+
+	err := CheckDeviceHealth(createDevice("nvme0n1", "live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckDeviceHealth(createDevice("sda", "running"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckDeviceHealth(createDevice("nvme1n1", "connecting"))
+	if err == nil {
+		t.Fatal("should fail if nvme controller is not live")
+	}
+	err = CheckDeviceHealth(createDevice("sdb", "offline"))
+	if err == nil {
+		t.Fatal("should fail if scsi device is not running")
+	}
+
+	// multipath namespace is healthy if any path is live
+	devicePath := createDevice("nvme2n1", "")
+	createDevice("nvme2c0n1", "dead")
+	createDevice("nvme2c1n1", "live")
+	for _, path := range []string{"nvme2c0n1", "nvme2c1n1"} {
+		err = os.MkdirAll(filepath.Join(sysBlockDir, "nvme2n1", "multipath", path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = CheckDeviceHealth(devicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(sysBlockDir, "nvme2c1n1", "device", "state"), []byte("resetting\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckDeviceHealth(devicePath)
+	if err == nil {
+		t.Fatal("should fail if no nvme path is live")
+	}
+
+	// device disappeared
+	err = os.Remove(devicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckDeviceHealth(devicePath)
+	if err == nil {
+		t.Fatal("should fail if device is gone")
+	}
+}
+
 func runExecWithTimeout(cmdLine []string, timeout int) (int, error) {
 	start := time.Now()
 	err := execWithTimeout(cmdLine, timeout)
@@ -17,6 +17,7 @@ package util
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 
 	"k8s.io/klog"
@@ -28,6 +29,10 @@ const (
 	targetQueueDepth        = 64
 	// SPDK ISCSI Iqn fixed prefix
 	iqnPrefixName = "iqn.2016-06.io.spdk:"
+	// negated ANY matches no initiator, target node must have at least one
+	// portal group to initiator group map, it's mapped to the initiator
+	// group of this sole initiator until a host is allowed
+	noHostInitiator = "!ANY"
 )
 
 type nodeISCSI struct {
@@ -36,10 +41,41 @@ type nodeISCSI struct {
 	targetPort string
 	lvols      map[string]*lvolISCSI
 	mtx        sync.Mutex // for concurrent access to lvols map
+	mtxTag     sync.Mutex // for allocating initiator group and auth group tags
+}
+
+// portal group to initiator group mapping of a target node
+type pgIgMap struct {
+	PgTag int `json:"pg_tag"`
+	IgTag int `json:"ig_tag"`
+}
+
+type targetNode struct {
+	Name      string    `json:"name"`
+	PgIgMaps  []pgIgMap `json:"pg_ig_maps"`
+	ChapGroup int       `json:"chap_group"`
+}
+
+type authSecret struct {
+	User    string `json:"user"`
+	Secret  string `json:"secret"`
+	MUser   string `json:"muser,omitempty"`
+	MSecret string `json:"msecret,omitempty"`
+}
+
+type authGroup struct {
+	Tag     int          `json:"tag"`
+	Secrets []authSecret `json:"secrets"`
+}
+
+type initiatorGroup struct {
+	Tag        int      `json:"tag"`
+	Initiators []string `json:"initiators"`
 }
 
 type lvolISCSI struct {
 	published bool
+	encrypted bool // exported through crypto bdev, kept after unpublish
 }
 
 func (lvol *lvolISCSI) reset() {
@@ -59,10 +95,29 @@ func (node *nodeISCSI) Info() string {
 	return node.client.info()
 }
 
+func (node *nodeISCSI) SetRPCCredentials(rpcUser, rpcPass string) {
+	node.client.setCredentials(rpcUser, rpcPass)
+}
+
+func (node *nodeISCSI) Ping() error {
+	return node.client.ping()
+}
+
+func (node *nodeISCSI) IOStats() (map[string]IOStat, error) {
+	return node.client.ioStats()
+}
+
 func (node *nodeISCSI) LvStores() ([]LvStore, error) {
 	return node.client.lvStores()
 }
 
+func (node *nodeISCSI) SetMultipath(targetAddrs []string, anaStates map[string]string) error {
+	if len(targetAddrs) > 0 || len(anaStates) > 0 {
+		return fmt.Errorf("multipath is not supported by iSCSI target")
+	}
+	return nil
+}
+
 // VolumeInfo returns a string:string map containing information necessary
 // for CSI node(initiator) to connect to this target and identify the disk.
 func (node *nodeISCSI) VolumeInfo(lvolID string) (map[string]string, error) {
@@ -82,9 +137,13 @@ func (node *nodeISCSI) VolumeInfo(lvolID string) (map[string]string, error) {
 	}, nil
 }
 
+func (node *nodeISCSI) Lvols() ([]Lvol, error) {
+	return node.client.lvols()
+}
+
 // CreateVolume creates a logical volume and returns volume ID
-func (node *nodeISCSI) CreateVolume(lvsName string, sizeMiB int64) (string, error) {
-	lvolID, err := node.client.createVolume(lvsName, sizeMiB)
+func (node *nodeISCSI) CreateVolume(lvolName, lvsName string, sizeMiB int64, opts LvolOptions) (string, error) {
+	lvolID, err := node.client.createVolume(lvolName, lvsName, sizeMiB, opts)
 	if err != nil {
 		return "", err
 	}
@@ -112,7 +171,39 @@ func (node *nodeISCSI) CreateSnapshot(lvolName, snapshotName string) (string, er
 	return snapshotID, nil
 }
 
+// CloneSnapshot creates a logical volume from snapshot and returns volume ID
+func (node *nodeISCSI) CloneSnapshot(lvolName, snapshotID string) (string, error) {
+	lvolID, err := node.client.clone(lvolName, snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	_, exists := node.lvols[lvolID]
+	if exists {
+		return "", fmt.Errorf("volume ID already exists: %s", lvolID)
+	}
+	node.lvols[lvolID] = &lvolISCSI{}
+
+	klog.V(5).Infof("volume cloned: %s, from snapshot: %s", lvolID, snapshotID)
+	return lvolID, nil
+}
+
 func (node *nodeISCSI) DeleteVolume(lvolID string) error {
+	node.mtx.Lock()
+	lvol, exists := node.lvols[lvolID]
+	node.mtx.Unlock()
+
+	if exists && lvol.encrypted {
+		err := node.client.deleteCryptoBdev(lvolID)
+		if err != nil {
+			return err
+		}
+		lvol.encrypted = false
+	}
+
 	err := node.client.deleteVolume(lvolID)
 	if err != nil {
 		return err
@@ -127,6 +218,55 @@ func (node *nodeISCSI) DeleteVolume(lvolID string) error {
 	return nil
 }
 
+// ResizeVolume grows a logical volume, client node needs to rescan the
+// device to see the new size
+func (node *nodeISCSI) ResizeVolume(lvolID string, sizeMiB int64) error {
+	err := node.client.resizeVolume(lvolID, sizeMiB)
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("volume resized: %s, %d MiB", lvolID, sizeMiB)
+	return nil
+}
+
+// SetQos sets rate limits of a logical volume
+func (node *nodeISCSI) SetQos(lvolID string, qos QosLimits) error {
+	err := node.client.setQos(lvolID, qos)
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("volume qos set: %s, %+v", lvolID, qos)
+	return nil
+}
+
+// EncryptVolume stacks a crypto bdev on an unpublished volume
+func (node *nodeISCSI) EncryptVolume(lvolID string, key CryptoKey) error {
+	node.mtx.Lock()
+	lvol, exists := node.lvols[lvolID]
+	node.mtx.Unlock()
+
+	if !exists {
+		return ErrVolumeDeleted
+	}
+	if lvol.encrypted {
+		return nil
+	}
+	if lvol.published {
+		return ErrVolumePublished
+	}
+
+	_, err := node.client.createCryptoBdev(lvolID, key)
+	if err != nil {
+		return err
+	}
+	lvol.encrypted = true
+
+	klog.V(5).Infof("volume encrypted: %s", lvolID)
+	return nil
+}
+
 // PublishVolume exports a volume through ISCSI target
 func (node *nodeISCSI) PublishVolume(lvolID string) error {
 	var err error
@@ -147,13 +287,13 @@ func (node *nodeISCSI) PublishVolume(lvolID string) error {
 		return err
 	}
 
-	err = node.createInitiatorGroup()
+	noHostTag, err := node.createNoHostGroup()
 	if err != nil {
 		return err
 	}
 	// lvolID is unique and can be used as the target name
 	targetName := lvolID
-	err = node.iscsiCreateTargetNode(targetName, lvolID)
+	err = node.iscsiCreateTargetNode(targetName, exportedBdevName(lvolID, lvol.encrypted), noHostTag)
 	if err != nil {
 		return err
 	}
@@ -162,6 +302,270 @@ func (node *nodeISCSI) PublishVolume(lvolID string) error {
 	return nil
 }
 
+// AllowHost allows an initiator to connect to the target node of a published
+// volume, through an initiator group created for the volume. Other initiators
+// are not allowed. Initiator must authenticate with CHAP if provided, through
+// an auth group created for the volume.
+func (node *nodeISCSI) AllowHost(lvolID string, host HostID, creds Credentials) error {
+	if creds.nvmeAuthEnabled() {
+		return fmt.Errorf("NVMe-oF authentication is not supported by iSCSI target")
+	}
+	if host.IQN == "" {
+		return fmt.Errorf("%w: initiator name of host is unknown", ErrHostIDRequired)
+	}
+
+	err := node.checkPublished(lvolID)
+	if err != nil {
+		return err
+	}
+
+	err = node.setChap(lvolID, creds)
+	if err != nil {
+		return err
+	}
+
+	err = node.addHostMap(lvolID, host.IQN)
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("host allowed: %s, iqn: %s", lvolID, host.IQN)
+	return nil
+}
+
+// DisallowHost reverts AllowHost, empty initiator name revokes any initiator
+// access granted by older releases to hosts without initiator name
+func (node *nodeISCSI) DisallowHost(lvolID string, host HostID) error {
+	err := node.checkPublished(lvolID)
+	if err != nil {
+		return err
+	}
+
+	if host.IQN == "" {
+		err = node.iscsiTargetNodeRemoveMap(lvolID, pgIgMap{numberPortalGroupTag, numberInitiatorGroupTag})
+	} else {
+		err = node.removeHostMap(lvolID, host.IQN)
+	}
+	if err != nil {
+		return err
+	}
+	// CHAP is shared by hosts of the volume, keep it until the last host
+	// is disallowed
+	target, err := node.iscsiGetTargetNode(lvolID)
+	if err != nil {
+		return err
+	}
+	sharedTags, err := node.sharedGroupTags()
+	if err != nil {
+		return err
+	}
+	hostAllowed := false
+	for _, m := range target.PgIgMaps {
+		if m.IgTag == numberInitiatorGroupTag || !sharedTags[m.IgTag] {
+			hostAllowed = true
+		}
+	}
+	if !hostAllowed {
+		err = node.setChap(lvolID, Credentials{})
+		if err != nil {
+			return err
+		}
+	}
+
+	klog.V(5).Infof("host disallowed: %s, iqn: %s", lvolID, host.IQN)
+	return nil
+}
+
+func (node *nodeISCSI) checkPublished(lvolID string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	lvol, exists := node.lvols[lvolID]
+	if !exists {
+		return ErrVolumeDeleted
+	}
+	if !lvol.published {
+		return ErrVolumeUnpublished
+	}
+	return nil
+}
+
+// returns initiator groups created for the volume which contain the initiator
+func (node *nodeISCSI) hostMaps(lvolID, iqn string) ([]pgIgMap, error) {
+	target, err := node.iscsiGetTargetNode(lvolID)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := node.iscsiListInitiatorGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	var hostMaps []pgIgMap
+	for _, m := range target.PgIgMaps {
+		if m.IgTag == numberInitiatorGroupTag {
+			continue
+		}
+		for _, group := range groups {
+			if group.Tag == m.IgTag && len(group.Initiators) == 1 && group.Initiators[0] == iqn {
+				hostMaps = append(hostMaps, m)
+			}
+		}
+	}
+	return hostMaps, nil
+}
+
+func (node *nodeISCSI) addHostMap(lvolID, iqn string) error {
+	// serialize initiator group tag allocation
+	node.mtxTag.Lock()
+	defer node.mtxTag.Unlock()
+
+	hostMaps, err := node.hostMaps(lvolID, iqn)
+	if err != nil {
+		return err
+	}
+	if len(hostMaps) > 0 {
+		return nil // already allowed
+	}
+
+	groups, err := node.iscsiListInitiatorGroups()
+	if err != nil {
+		return err
+	}
+	tag := nextInitiatorGroupTag(groups)
+	err = node.iscsiCreateInitiatorGroup(tag, []string{iqn}, []string{"ANY"})
+	if err != nil {
+		return err
+	}
+	err = node.iscsiTargetNodeAddMap(lvolID, pgIgMap{numberPortalGroupTag, tag})
+	if err != nil {
+		node.iscsiDeleteInitiatorGroup(tag) //nolint:errcheck // we can do few
+		return err
+	}
+	return nil
+}
+
+func (node *nodeISCSI) removeHostMap(lvolID, iqn string) error {
+	node.mtxTag.Lock()
+	defer node.mtxTag.Unlock()
+
+	hostMaps, err := node.hostMaps(lvolID, iqn)
+	if err != nil {
+		return err
+	}
+	for _, m := range hostMaps {
+		err = node.iscsiTargetNodeRemoveMap(lvolID, m)
+		if err != nil {
+			return err
+		}
+		err = node.iscsiDeleteInitiatorGroup(m.IgTag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// require CHAP authentication to the target node per credentials, or disable
+// CHAP if credentials are empty
+func (node *nodeISCSI) setChap(lvolID string, creds Credentials) error {
+	node.mtxTag.Lock()
+	defer node.mtxTag.Unlock()
+
+	target, err := node.iscsiGetTargetNode(lvolID)
+	if err != nil {
+		return err
+	}
+	groups, err := node.iscsiGetAuthGroups()
+	if err != nil {
+		return err
+	}
+
+	secret := authSecret{
+		User:    creds.ChapUser,
+		Secret:  creds.ChapSecret,
+		MUser:   creds.MutualChapUser,
+		MSecret: creds.MutualChapSecret,
+	}
+	tag := 0
+	for _, group := range groups {
+		if group.Tag == target.ChapGroup && len(group.Secrets) == 1 && group.Secrets[0] == secret {
+			return nil // already set
+		}
+		if group.Tag > tag {
+			tag = group.Tag
+		}
+	}
+	if !creds.chapEnabled() && target.ChapGroup == 0 {
+		return nil // already disabled
+	}
+
+	if creds.chapEnabled() {
+		tag++
+		err = node.iscsiCreateAuthGroup(tag, secret)
+		if err != nil {
+			return err
+		}
+		err = node.iscsiTargetNodeSetAuth(lvolID, tag, creds.mutualChapEnabled())
+		if err != nil {
+			node.iscsiDeleteAuthGroup(tag) //nolint:errcheck // we can do few
+			return err
+		}
+	} else {
+		err = node.iscsiTargetNodeSetAuth(lvolID, 0, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// replaced auth group is not used by any target node now
+	if target.ChapGroup != 0 {
+		err = node.iscsiDeleteAuthGroup(target.ChapGroup)
+		if err != nil {
+			klog.Errorf("failed to delete auth group %d: %s", target.ChapGroup, err)
+		}
+	}
+	return nil
+}
+
+// RestoreVolumes tracks existing logical volumes, volumes exported through
+// iSCSI target nodes are marked as published. Any initiator access, mapped
+// by older releases to target nodes at creation, is replaced by no access.
+func (node *nodeISCSI) RestoreVolumes(lvolIDs []string) error {
+	var targets []targetNode
+
+	err := node.client.call("iscsi_get_target_nodes", nil, &targets)
+	if err != nil {
+		return err
+	}
+	err = node.revokeAnyInitiator(targets)
+	if err != nil {
+		return err
+	}
+	encrypted, err := node.client.encryptedLvols()
+	if err != nil {
+		return err
+	}
+
+	published := make(map[string]bool)
+	for _, target := range targets {
+		// target name is lvolID, see PublishVolume
+		published[strings.TrimPrefix(target.Name, iqnPrefixName)] = true
+	}
+
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	for _, lvolID := range lvolIDs {
+		if _, exists := node.lvols[lvolID]; exists {
+			continue
+		}
+		node.lvols[lvolID] = &lvolISCSI{published: published[lvolID], encrypted: encrypted[lvolID]}
+		klog.V(5).Infof("volume restored: %s, published: %v", lvolID, published[lvolID])
+	}
+	return nil
+}
+
 func (node *nodeISCSI) createPortalGroup() error {
 	err := node.iscsiGetPortalGroups()
 	if err == nil {
@@ -176,22 +580,100 @@ func (node *nodeISCSI) createPortalGroup() error {
 	return node.iscsiGetPortalGroups()
 }
 
-func (node *nodeISCSI) createInitiatorGroup() error {
-	err := node.iscsiGetInitiatorGroups()
-	if err == nil {
-		return nil
+// returns tag of the initiator group matching no initiator, created if not
+// exists, the group is shared by all target nodes
+func (node *nodeISCSI) createNoHostGroup() (int, error) {
+	node.mtxTag.Lock()
+	defer node.mtxTag.Unlock()
+
+	groups, err := node.iscsiListInitiatorGroups()
+	if err != nil {
+		return 0, err
+	}
+	for _, group := range groups {
+		if isNoHostGroup(group) {
+			return group.Tag, nil
+		}
 	}
 
-	err = node.iscsiCreateInitiatorGroup([]string{"ANY"}, []string{"ANY"})
-	if err == nil {
-		return nil
+	tag := nextInitiatorGroupTag(groups)
+	err = node.iscsiCreateInitiatorGroup(tag, []string{noHostInitiator}, []string{"ANY"})
+	if err != nil {
+		return 0, err
+	}
+	return tag, nil
+}
+
+// returns tags of initiator groups shared by target nodes, they are not
+// created for a volume and must not be deleted with it
+func (node *nodeISCSI) sharedGroupTags() (map[int]bool, error) {
+	groups, err := node.iscsiListInitiatorGroups()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[int]bool{numberInitiatorGroupTag: true}
+	for _, group := range groups {
+		if isNoHostGroup(group) {
+			tags[group.Tag] = true
+		}
+	}
+	return tags, nil
+}
+
+// map target nodes with any initiator access to the no host initiator group
+// and remove the any initiator map, hosts are allowed per AllowHost
+func (node *nodeISCSI) revokeAnyInitiator(targets []targetNode) error {
+	anyMap := pgIgMap{numberPortalGroupTag, numberInitiatorGroupTag}
+	noHostTag := 0
+	for _, target := range targets {
+		if !strings.HasPrefix(target.Name, iqnPrefixName) || !containsMap(target.PgIgMaps, anyMap) {
+			continue
+		}
+		if noHostTag == 0 {
+			var err error
+			noHostTag, err = node.createNoHostGroup()
+			if err != nil {
+				return err
+			}
+		}
+		targetName := strings.TrimPrefix(target.Name, iqnPrefixName)
+		err := node.iscsiTargetNodeAddMap(targetName, pgIgMap{numberPortalGroupTag, noHostTag})
+		if err != nil {
+			return err
+		}
+		err = node.iscsiTargetNodeRemoveMap(targetName, anyMap)
+		if err != nil {
+			return err
+		}
+		klog.Warningf("any initiator access revoked: %s, hosts must be published again", targetName)
+	}
+	return nil
+}
+
+func isNoHostGroup(group initiatorGroup) bool {
+	return len(group.Initiators) == 1 && group.Initiators[0] == noHostInitiator
+}
+
+func nextInitiatorGroupTag(groups []initiatorGroup) int {
+	tag := numberInitiatorGroupTag
+	for _, group := range groups {
+		if group.Tag > tag {
+			tag = group.Tag
+		}
 	}
+	return tag + 1
+}
 
-	return node.iscsiGetInitiatorGroups()
+func containsMap(maps []pgIgMap, m pgIgMap) bool {
+	for _, existing := range maps {
+		if existing == m {
+			return true
+		}
+	}
+	return false
 }
 
 func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
-	var err error
 	node.mtx.Lock()
 	lvol, exists := node.lvols[lvolID]
 	node.mtx.Unlock()
@@ -203,11 +685,37 @@ func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
 		return ErrVolumeUnpublished
 	}
 
+	target, err := node.iscsiGetTargetNode(lvolID)
+	if err != nil {
+		return err
+	}
+
 	err = node.iscsiDeleteTargetNode(lvolID)
 	if err != nil {
 		return err
 	}
 
+	// delete initiator groups and auth group created for this volume by AllowHost
+	sharedTags, err := node.sharedGroupTags()
+	if err != nil {
+		return err
+	}
+	for _, m := range target.PgIgMaps {
+		if sharedTags[m.IgTag] {
+			continue
+		}
+		err = node.iscsiDeleteInitiatorGroup(m.IgTag)
+		if err != nil {
+			klog.Errorf("failed to delete initiator group %d: %s", m.IgTag, err)
+		}
+	}
+	if target.ChapGroup != 0 {
+		err = node.iscsiDeleteAuthGroup(target.ChapGroup)
+		if err != nil {
+			klog.Errorf("failed to delete auth group %d: %s", target.ChapGroup, err)
+		}
+	}
+
 	lvol.reset()
 	klog.V(5).Infof("volume unpublished: %s", lvolID)
 	return nil
@@ -238,14 +746,14 @@ func (node *nodeISCSI) iscsiCreatePortalGroup() error {
 }
 
 // Add an initiator group
-func (node *nodeISCSI) iscsiCreateInitiatorGroup(initiators, netmasks []string) error {
+func (node *nodeISCSI) iscsiCreateInitiatorGroup(tag int, initiators, netmasks []string) error {
 	params := struct {
 		Initiators []string `json:"initiators"`
 		Tag        int      `json:"tag"`
 		Netmasks   []string `json:"netmasks"`
 	}{
 		Initiators: initiators,
-		Tag:        numberInitiatorGroupTag,
+		Tag:        tag,
 		Netmasks:   netmasks,
 	}
 	var result bool
@@ -259,28 +767,83 @@ func (node *nodeISCSI) iscsiCreateInitiatorGroup(initiators, netmasks []string)
 	return nil
 }
 
-// Add an iSCSI target node
-func (node *nodeISCSI) iscsiCreateTargetNode(targetName, bdevName string) error {
+// Delete an initiator group
+func (node *nodeISCSI) iscsiDeleteInitiatorGroup(tag int) error {
+	params := struct {
+		Tag int `json:"tag"`
+	}{
+		Tag: tag,
+	}
+	var result bool
+	err := node.client.call("iscsi_delete_initiator_group", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("delete iscsi initiator group failure")
+	}
+	return nil
+}
+
+// Add an auth group with one CHAP secret
+func (node *nodeISCSI) iscsiCreateAuthGroup(tag int, secret authSecret) error {
+	params := authGroup{
+		Tag:     tag,
+		Secrets: []authSecret{secret},
+	}
+	var result bool
+	err := node.client.call("iscsi_create_auth_group", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("create iscsi auth group failure")
+	}
+	return nil
+}
+
+// Delete an auth group
+func (node *nodeISCSI) iscsiDeleteAuthGroup(tag int) error {
+	params := struct {
+		Tag int `json:"tag"`
+	}{
+		Tag: tag,
+	}
+	var result bool
+	err := node.client.call("iscsi_delete_auth_group", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("delete iscsi auth group failure")
+	}
+	return nil
+}
+
+func (node *nodeISCSI) iscsiGetAuthGroups() ([]authGroup, error) {
+	var results []authGroup
+	err := node.client.call("iscsi_get_auth_groups", nil, &results)
+	return results, err
+}
+
+// Add an iSCSI target node mapped to the initiator group
+func (node *nodeISCSI) iscsiCreateTargetNode(targetName, bdevName string, igTag int) error {
 	type Luns struct {
 		LunID    int    `json:"lun_id"`
 		BdevName string `json:"bdev_name"`
 	}
-	type PgIgMaps struct {
-		IgTag int `json:"ig_tag"`
-		PgTag int `json:"pg_tag"`
-	}
 	params := struct {
-		Luns        []Luns     `json:"luns"`
-		Name        string     `json:"name"`
-		AliasName   string     `json:"alias_name"`
-		PgIgMaps    []PgIgMaps `json:"pg_ig_maps"`
-		DisableChap bool       `json:"disable_chap"`
-		QueueDepth  int        `json:"queue_depth"`
+		Luns        []Luns    `json:"luns"`
+		Name        string    `json:"name"`
+		AliasName   string    `json:"alias_name"`
+		PgIgMaps    []pgIgMap `json:"pg_ig_maps"`
+		DisableChap bool      `json:"disable_chap"`
+		QueueDepth  int       `json:"queue_depth"`
 	}{
 		Luns:        []Luns{{0, bdevName}},
 		Name:        targetName,
 		AliasName:   "iscsi-" + bdevName,
-		PgIgMaps:    []PgIgMaps{{numberPortalGroupTag, numberInitiatorGroupTag}},
+		PgIgMaps:    []pgIgMap{{numberPortalGroupTag, igTag}},
 		DisableChap: true,
 		QueueDepth:  targetQueueDepth,
 	}
@@ -313,35 +876,110 @@ func (node *nodeISCSI) iscsiDeleteTargetNode(targetName string) error {
 	return nil
 }
 
-// Check if portal group is available
-func (node *nodeISCSI) iscsiGetPortalGroups() error {
-	var results []struct {
-		Tag int `json:"tag"`
+// Require CHAP authentication to an iSCSI target node with secrets in the
+// auth group, or disable CHAP if tag is 0
+func (node *nodeISCSI) iscsiTargetNodeSetAuth(targetName string, chapGroup int, mutualChap bool) error {
+	params := struct {
+		Name        string `json:"name"`
+		ChapGroup   int    `json:"chap_group"`
+		DisableChap bool   `json:"disable_chap"`
+		RequireChap bool   `json:"require_chap"`
+		MutualChap  bool   `json:"mutual_chap"`
+	}{
+		Name:        iqnPrefixName + targetName,
+		ChapGroup:   chapGroup,
+		DisableChap: chapGroup == 0,
+		RequireChap: chapGroup != 0,
+		MutualChap:  mutualChap,
 	}
-	err := node.client.call("iscsi_get_portal_groups", nil, &results)
+	var result bool
+	err := node.client.call("iscsi_target_node_set_auth", &params, &result)
 	if err != nil {
 		return err
 	}
-	for _, value := range results {
-		if value.Tag == numberPortalGroupTag {
-			return nil
+	if !result {
+		return fmt.Errorf("set iscsi target node auth failure")
+	}
+	return nil
+}
+
+// Get an iSCSI target node
+func (node *nodeISCSI) iscsiGetTargetNode(targetName string) (*targetNode, error) {
+	var targets []targetNode
+	err := node.client.call("iscsi_get_target_nodes", nil, &targets)
+	if err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		if targets[i].Name == iqnPrefixName+targetName {
+			return &targets[i], nil
 		}
 	}
-	return fmt.Errorf("port group not available")
+	return nil, fmt.Errorf("target node not exists: %s", targetName)
+}
+
+// Add a mapping to an iSCSI target node if not exists
+func (node *nodeISCSI) iscsiTargetNodeAddMap(targetName string, m pgIgMap) error {
+	target, err := node.iscsiGetTargetNode(targetName)
+	if err != nil {
+		return err
+	}
+	if containsMap(target.PgIgMaps, m) {
+		return nil
+	}
+	return node.iscsiTargetNodeCallMap("iscsi_target_node_add_pg_ig_maps", targetName, m)
+}
+
+// Remove a mapping from an iSCSI target node if exists
+func (node *nodeISCSI) iscsiTargetNodeRemoveMap(targetName string, m pgIgMap) error {
+	target, err := node.iscsiGetTargetNode(targetName)
+	if err != nil {
+		return err
+	}
+	if !containsMap(target.PgIgMaps, m) {
+		return nil
+	}
+	return node.iscsiTargetNodeCallMap("iscsi_target_node_remove_pg_ig_maps", targetName, m)
+}
+
+func (node *nodeISCSI) iscsiTargetNodeCallMap(method, targetName string, m pgIgMap) error {
+	params := struct {
+		Name     string    `json:"name"`
+		PgIgMaps []pgIgMap `json:"pg_ig_maps"`
+	}{
+		Name:     iqnPrefixName + targetName,
+		PgIgMaps: []pgIgMap{m},
+	}
+	var result bool
+	err := node.client.call(method, &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("%s failure", method)
+	}
+	return nil
 }
 
-func (node *nodeISCSI) iscsiGetInitiatorGroups() error {
+// Check if portal group is available
+func (node *nodeISCSI) iscsiGetPortalGroups() error {
 	var results []struct {
 		Tag int `json:"tag"`
 	}
-	err := node.client.call("iscsi_get_initiator_groups", nil, &results)
+	err := node.client.call("iscsi_get_portal_groups", nil, &results)
 	if err != nil {
 		return err
 	}
 	for _, value := range results {
-		if value.Tag == numberInitiatorGroupTag {
+		if value.Tag == numberPortalGroupTag {
 			return nil
 		}
 	}
-	return fmt.Errorf("initiator group not available")
+	return fmt.Errorf("port group not available")
+}
+
+func (node *nodeISCSI) iscsiListInitiatorGroups() ([]initiatorGroup, error) {
+	var results []initiatorGroup
+	err := node.client.call("iscsi_get_initiator_groups", nil, &results)
+	return results, err
 }
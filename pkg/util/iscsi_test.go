@@ -17,6 +17,7 @@ limitations under the License.
 package util
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -30,7 +31,7 @@ const (
 
 //nolint:cyclop // TestISCSI exceeds cyclomatic complexity of 10
 func TestISCSI(t *testing.T) {
-	nodeIx, err := NewSpdkNode(rpcURLISCSI, rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI)
+	nodeIx, err := NewSpdkNode(rpcURLISCSI, rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI, NodeOptions{})
 	if err != nil {
 		t.Fatalf("NewSpdkNode: %s", err)
 	}
@@ -50,7 +51,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("No free space: %s", lvs[0].Name)
 	}
 
-	lvolID, err := node.CreateVolume(lvs[0].Name, lvs[0].FreeSizeMiB)
+	lvolID, err := node.CreateVolume("csi-test-iscsi", lvs[0].Name, lvs[0].FreeSizeMiB, DefaultLvolOptions())
 	if err != nil {
 		t.Fatalf("CreateVolume: %s", err)
 	}
@@ -70,6 +71,78 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("iscsiValidateVolumePublished: %s", err)
 	}
 
+	host := HostID{IQN: "iqn.2005-03.org.open-iscsi:csi-test-host"}
+	// no initiator allowed until AllowHost
+	err = iscsiValidateHostAllowed(node, lvolID, host.IQN, false)
+	if err != nil {
+		t.Fatalf("iscsiValidateHostAllowed: %s", err)
+	}
+	err = node.AllowHost(lvolID, HostID{}, Credentials{})
+	if !errors.Is(err, ErrHostIDRequired) {
+		t.Fatalf("AllowHost without initiator name: %v", err)
+	}
+	creds := Credentials{
+		ChapUser:         "csi-test-user",
+		ChapSecret:       "csi-test-secret",
+		MutualChapUser:   "csi-test-muser",
+		MutualChapSecret: "csi-test-msecret",
+	}
+	err = node.AllowHost(lvolID, host, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = iscsiValidateHostAllowed(node, lvolID, host.IQN, true)
+	if err != nil {
+		t.Fatalf("iscsiValidateHostAllowed: %s", err)
+	}
+	err = iscsiValidateChap(node, lvolID, creds)
+	if err != nil {
+		t.Fatalf("iscsiValidateChap: %s", err)
+	}
+	// idempotent
+	err = node.AllowHost(lvolID, host, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = iscsiValidateChap(node, lvolID, creds)
+	if err != nil {
+		t.Fatalf("iscsiValidateChap: %s", err)
+	}
+	err = node.DisallowHost(lvolID, host)
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = iscsiValidateHostAllowed(node, lvolID, host.IQN, false)
+	if err != nil {
+		t.Fatalf("iscsiValidateHostDisallowed: %s", err)
+	}
+	err = iscsiValidateChap(node, lvolID, Credentials{})
+	if err != nil {
+		t.Fatalf("iscsiValidateChapDisabled: %s", err)
+	}
+
+	// any initiator access mapped by older releases is revoked on restore
+	err = node.iscsiCreateInitiatorGroup(numberInitiatorGroupTag, []string{"ANY"}, []string{"ANY"})
+	if err != nil {
+		t.Fatalf("iscsiCreateInitiatorGroup: %s", err)
+	}
+	err = node.iscsiTargetNodeAddMap(lvolID, pgIgMap{numberPortalGroupTag, numberInitiatorGroupTag})
+	if err != nil {
+		t.Fatalf("iscsiTargetNodeAddMap: %s", err)
+	}
+	err = node.RestoreVolumes(nil)
+	if err != nil {
+		t.Fatalf("RestoreVolumes: %s", err)
+	}
+	err = iscsiValidateHostAllowed(node, lvolID, host.IQN, false)
+	if err != nil {
+		t.Fatalf("iscsiValidateHostAllowed: %s", err)
+	}
+	err = node.iscsiDeleteInitiatorGroup(numberInitiatorGroupTag)
+	if err != nil {
+		t.Fatalf("iscsiDeleteInitiatorGroup: %s", err)
+	}
+
 	snapshotName := "snapshot-pvc"
 	var snapshotID string
 	snapshotID, err = node.CreateSnapshot(lvolID, snapshotName)
@@ -155,3 +228,54 @@ func iscsiValidateVolumePublished(node *nodeISCSI, lvolID string) error {
 
 	return fmt.Errorf("iqn not found: %s", iqn)
 }
+
+func iscsiValidateHostAllowed(node *nodeISCSI, lvolID, iqn string, allowed bool) error {
+	target, err := node.iscsiGetTargetNode(lvolID)
+	if err != nil {
+		return err
+	}
+	for _, m := range target.PgIgMaps {
+		if m.IgTag == numberInitiatorGroupTag {
+			return fmt.Errorf("any initiator allowed: %s", lvolID)
+		}
+	}
+
+	hostMaps, err := node.hostMaps(lvolID, iqn)
+	if err != nil {
+		return err
+	}
+	if (len(hostMaps) > 0) != allowed {
+		return fmt.Errorf("initiator %s allowed: %v, expected: %v", iqn, len(hostMaps) > 0, allowed)
+	}
+	return nil
+}
+
+func iscsiValidateChap(node *nodeISCSI, lvolID string, creds Credentials) error {
+	target, err := node.iscsiGetTargetNode(lvolID)
+	if err != nil {
+		return err
+	}
+	groups, err := node.iscsiGetAuthGroups()
+	if err != nil {
+		return err
+	}
+
+	if !creds.chapEnabled() {
+		if target.ChapGroup != 0 {
+			return fmt.Errorf("chap not disabled: %d", target.ChapGroup)
+		}
+		if len(groups) != 0 {
+			return fmt.Errorf("auth groups not deleted: %v", groups)
+		}
+		return nil
+	}
+
+	if len(groups) != 1 || groups[0].Tag != target.ChapGroup {
+		return fmt.Errorf("auth group mismatch: %d, %v", target.ChapGroup, groups)
+	}
+	secret := authSecret{creds.ChapUser, creds.ChapSecret, creds.MutualChapUser, creds.MutualChapSecret}
+	if len(groups[0].Secrets) != 1 || groups[0].Secrets[0] != secret {
+		return fmt.Errorf("chap secret mismatch: %v", groups[0].Secrets)
+	}
+	return nil
+}
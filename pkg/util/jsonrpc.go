@@ -18,15 +18,15 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 // SpdkNode defines interface for SPDK storage node
@@ -36,6 +36,31 @@ import (
 //   - VolumeInfo returns a string map to be passed to client node. Client node
 //     needs these info to mount the target. E.g, target IP, service port, nqn.
 //   - Create/Delete/Publish/UnpublishVolume per CSI controller service spec.
+//     CreateVolume provisions the lvol per LvolOptions.
+//   - ResizeVolume grows a logical volume to new size.
+//   - SetQos sets rate limits of a logical volume, takes effect immediately
+//     even if the volume is in use.
+//   - CloneSnapshot creates a logical volume from a snapshot.
+//   - Lvols returns all logical volumes(including snapshots) on that node.
+//   - RestoreVolumes re-registers existing logical volumes and their publish
+//     state, so they can be managed after controller restart.
+//   - AllowHost/DisallowHost grants/revokes access of a client host to a
+//     published volume, a published volume is accessible by no host until
+//     allowed. Host ID is required by AllowHost, empty host ID passed to
+//     DisallowHost revokes any host access granted by older releases. Host
+//     must present the credentials to connect if they are not empty.
+//   - EncryptVolume stacks a crypto bdev on a logical volume before it is
+//     published, the volume is then exported through the crypto bdev and
+//     data is encrypted at rest. The crypto bdev is deleted with the volume.
+//   - SetRPCCredentials replaces user name and password of spdk json rpc,
+//     e.g. rotated in secret, it's thread safe and takes effect on next call.
+//   - SetMultipath replaces target addresses besides targetAddr and ANA
+//     states of NVMe-oF node, see NodeOptions. It's thread safe and applies
+//     to volumes published afterwards. iSCSI node accepts empty ones only.
+//   - Ping checks if spdk json rpc is responsive, with a timeout much shorter
+//     than other calls, it's thread safe.
+//   - IOStats returns cumulative I/O statistics of all bdevs by bdev name,
+//     volumes are found by volume ID, it's thread safe.
 //
 // NOTE: concurrency, idempotency, message ordering
 //
@@ -50,9 +75,9 @@ import (
 //     PublishVolume/UnpublishVolume/DeleteVolume for *different
 //     volumes* thread safe. Caller may issue these requests to
 //     *different volumes", in same volume store or not, concurrently.
-//   - PublishVolume/UnpublishVolume/DeleteVolume for *same volume* is
-//     not thread safe, concurrent access may lead to data
-//     race. Caller must serialize these calls to *same volume*,
+//   - PublishVolume/UnpublishVolume/DeleteVolume/ResizeVolume/SetQos/
+//     AllowHost/DisallowHost/EncryptVolume for *same volume* is not thread safe, concurrent
+//     access may lead to data race. Caller must serialize these calls to *same volume*,
 //     possibly by mutex or message queue per volume.
 //   - Implementation should make sure LvStores and VolumeInfo are
 //     thread safe, but it doesn't lock the returned resources. It
@@ -78,12 +103,24 @@ import (
 type SpdkNode interface {
 	Info() string
 	LvStores() ([]LvStore, error)
+	SetMultipath(targetAddrs []string, anaStates map[string]string) error
 	VolumeInfo(lvolID string) (map[string]string, error)
-	CreateVolume(lvsName string, sizeMiB int64) (string, error)
+	CreateVolume(lvolName, lvsName string, sizeMiB int64, opts LvolOptions) (string, error)
 	DeleteVolume(lvolID string) error
+	ResizeVolume(lvolID string, sizeMiB int64) error
+	SetQos(lvolID string, qos QosLimits) error
+	EncryptVolume(lvolID string, key CryptoKey) error
 	PublishVolume(lvolID string) error
 	UnpublishVolume(lvolID string) error
+	AllowHost(lvolID string, host HostID, creds Credentials) error
+	DisallowHost(lvolID string, host HostID) error
 	CreateSnapshot(lvolName, snapshotName string) (string, error)
+	CloneSnapshot(lvolName, snapshotID string) (string, error)
+	Lvols() ([]Lvol, error)
+	RestoreVolumes(lvolIDs []string) error
+	SetRPCCredentials(rpcUser, rpcPass string)
+	Ping() error
+	IOStats() (map[string]IOStat, error)
 }
 
 // logical volume store
@@ -93,6 +130,60 @@ type LvStore struct {
 	FreeSizeMiB  int64
 }
 
+// provisioning options of new logical volume
+type LvolOptions struct {
+	ThinProvision bool
+	ClearMethod   string // none, unmap, write_zeroes
+}
+
+// DefaultLvolOptions returns default provisioning options of logical volume
+func DefaultLvolOptions() LvolOptions {
+	return LvolOptions{
+		ThinProvision: cfgLvolThinProvision,
+		ClearMethod:   cfgLvolClearMethod,
+	}
+}
+
+// rate limits of logical volume, 0 means unlimited
+type QosLimits struct {
+	RWIOsPerSec    int64 // read/write I/O per second, multiple of 1000
+	RWMBytesPerSec int64 // read/write MB per second
+	RMBytesPerSec  int64 // read MB per second
+	WMBytesPerSec  int64 // write MB per second
+}
+
+// data encryption key of logical volume, keys are hex encoded
+type CryptoKey struct {
+	Cipher string // AES_XTS
+	Key    string
+	Key2   string // tweak key of AES_XTS, must differ from Key
+}
+
+// logical volume or snapshot found on spdk node
+type Lvol struct {
+	ID           string // bdev name, used as volume ID
+	Name         string // lvol name, without lvstore prefix
+	LvsName      string
+	SizeMiB      int64
+	IsSnapshot   bool
+	BaseSnapshot string   // name of the snapshot this lvol is cloned from
+	Clones       []string // names of lvols cloned from this snapshot
+	Qos          QosLimits
+	Encrypted    bool // exported through crypto bdev, see EncryptVolume
+}
+
+// cumulative I/O statistics of a bdev since it's created
+type IOStat struct {
+	ReadOps             uint64
+	ReadBytes           uint64
+	WriteOps            uint64
+	WriteBytes          uint64
+	ReadLatencySeconds  float64 // total time spent on reads
+	WriteLatencySeconds float64 // total time spent on writes
+}
+
+const cryptoBdevPrefix = "csi-crypto-"
+
 // errors deserve special care
 var (
 	// json response errors: errors.New("json: tag-string")
@@ -104,6 +195,7 @@ var (
 	ErrVolumeDeleted     = errors.New("volume deleted")
 	ErrVolumePublished   = errors.New("volume already published")
 	ErrVolumeUnpublished = errors.New("volume not published")
+	ErrHostIDRequired    = errors.New("host id required")
 )
 
 // jsonrpc http proxy
@@ -111,12 +203,42 @@ type rpcClient struct {
 	rpcURL     string
 	rpcUser    string
 	rpcPass    string
+	mtxAuth    sync.Mutex // protect rpcUser and rpcPass
 	httpClient *http.Client
 	rpcID      int32 // json request message ID, auto incremented
 }
 
-func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string) (SpdkNode, error) {
-	client := rpcClient{
+// options of spdk node from config map
+type NodeOptions struct {
+	// directory shared with spdk target, where NVMe-oF authentication keys
+	// are written to and loaded into spdk keyring. spdk target reads key
+	// files by path, the directory must be at same path on both sides, it's
+	// checked by loading a probe key when the node is created.
+	KeyDir string
+	// more target addresses besides targetAddr, volumes are published
+	// through listeners on all addresses for NVMe multipath
+	TargetAddrs []string
+	// ANA state of listener per target address, optimized, non_optimized
+	// or inaccessible, ANA reporting is enabled if not empty
+	AnaStates map[string]string
+	// NVMe-oF transport tuning, spdk defaults are used if not set
+	Transport TransportOptions
+}
+
+// TransportOptions of NVMe-oF transport created on spdk node, zero values
+// are not passed to spdk. Digests are negotiated by initiator when
+// connecting, they are passed to nodes in volume context.
+type TransportOptions struct {
+	IOUnitSize        int  `json:"ioUnitSize"`
+	MaxQueueDepth     int  `json:"maxQueueDepth"`
+	NumSharedBuffers  int  `json:"numSharedBuffers"`
+	InCapsuleDataSize int  `json:"inCapsuleDataSize"`
+	HeaderDigest      bool `json:"headerDigest"` // TCP only
+	DataDigest        bool `json:"dataDigest"`   // TCP only
+}
+
+func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string, opts NodeOptions) (SpdkNode, error) {
+	client := &rpcClient{
 		rpcURL:     rpcURL,
 		rpcUser:    rpcUser,
 		rpcPass:    rpcPass,
@@ -125,11 +247,14 @@ func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string) (SpdkN
 
 	switch strings.ToLower(targetType) {
 	case "nvme-rdma":
-		return newNVMf(&client, "RDMA", targetAddr), nil
+		return newNVMf(client, "RDMA", targetAddr, opts)
 	case "nvme-tcp":
-		return newNVMf(&client, "TCP", targetAddr), nil
+		return newNVMf(client, "TCP", targetAddr, opts)
 	case "iscsi":
-		return newISCSI(&client, targetAddr), nil
+		if len(opts.TargetAddrs) > 0 || len(opts.AnaStates) > 0 {
+			return nil, fmt.Errorf("multipath is not supported by iSCSI target")
+		}
+		return newISCSI(client, targetAddr), nil
 	default:
 		return nil, fmt.Errorf("unknown transport: %s", targetType)
 	}
@@ -139,6 +264,28 @@ func (client *rpcClient) info() string {
 	return client.rpcURL
 }
 
+func (client *rpcClient) setCredentials(rpcUser, rpcPass string) {
+	client.mtxAuth.Lock()
+	defer client.mtxAuth.Unlock()
+	client.rpcUser = rpcUser
+	client.rpcPass = rpcPass
+}
+
+func (client *rpcClient) credentials() (rpcUser, rpcPass string) {
+	client.mtxAuth.Lock()
+	defer client.mtxAuth.Unlock()
+	return client.rpcUser, client.rpcPass
+}
+
+func (client *rpcClient) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfgPingTimeoutSeconds*time.Second)
+	defer cancel()
+	var result struct {
+		Version string `json:"version"`
+	}
+	return client.callContext(ctx, "spdk_get_version", nil, &result)
+}
+
 func (client *rpcClient) lvStores() ([]LvStore, error) {
 	var result []struct {
 		FreeClusters  int64  `json:"free_clusters"`
@@ -163,7 +310,109 @@ func (client *rpcClient) lvStores() ([]LvStore, error) {
 	return lvs, nil
 }
 
-func (client *rpcClient) createVolume(lvsName string, sizeMiB int64) (string, error) {
+func (client *rpcClient) ioStats() (map[string]IOStat, error) {
+	var result struct {
+		TickRate uint64 `json:"tick_rate"`
+		Bdevs    []struct {
+			Name              string `json:"name"`
+			BytesRead         uint64 `json:"bytes_read"`
+			NumReadOps        uint64 `json:"num_read_ops"`
+			BytesWritten      uint64 `json:"bytes_written"`
+			NumWriteOps       uint64 `json:"num_write_ops"`
+			ReadLatencyTicks  uint64 `json:"read_latency_ticks"`
+			WriteLatencyTicks uint64 `json:"write_latency_ticks"`
+		} `json:"bdevs"`
+	}
+	err := client.call("bdev_get_iostat", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.TickRate == 0 {
+		return nil, fmt.Errorf("bdev_get_iostat: invalid tick rate")
+	}
+
+	tickRate := float64(result.TickRate)
+	stats := make(map[string]IOStat, len(result.Bdevs))
+	for i := range result.Bdevs {
+		bdev := &result.Bdevs[i]
+		stats[bdev.Name] = IOStat{
+			ReadOps:             bdev.NumReadOps,
+			ReadBytes:           bdev.BytesRead,
+			WriteOps:            bdev.NumWriteOps,
+			WriteBytes:          bdev.BytesWritten,
+			ReadLatencySeconds:  float64(bdev.ReadLatencyTicks) / tickRate,
+			WriteLatencySeconds: float64(bdev.WriteLatencyTicks) / tickRate,
+		}
+	}
+	return stats, nil
+}
+
+func (client *rpcClient) lvols() ([]Lvol, error) {
+	var result []struct {
+		Name           string   `json:"name"`
+		Aliases        []string `json:"aliases"`
+		BlockSize      int64    `json:"block_size"`
+		NumBlocks      int64    `json:"num_blocks"`
+		DriverSpecific struct {
+			Lvol *struct {
+				Snapshot     bool     `json:"snapshot"`
+				BaseSnapshot string   `json:"base_snapshot"`
+				Clones       []string `json:"clones"`
+			} `json:"lvol"`
+			Crypto *struct {
+				BaseBdevName string `json:"base_bdev_name"`
+			} `json:"crypto"`
+		} `json:"driver_specific"`
+		AssignedRateLimits struct {
+			RWIOsPerSec    int64 `json:"rw_ios_per_sec"`
+			RWMBytesPerSec int64 `json:"rw_mbytes_per_sec"`
+			RMBytesPerSec  int64 `json:"r_mbytes_per_sec"`
+			WMBytesPerSec  int64 `json:"w_mbytes_per_sec"`
+		} `json:"assigned_rate_limits"`
+	}
+
+	err := client.call("bdev_get_bdevs", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	// lvols with crypto bdevs created by us stacked on
+	encrypted := make(map[string]bool)
+	for i := range result {
+		r := &result[i]
+		if r.DriverSpecific.Crypto != nil && r.Name == cryptoBdevName(r.DriverSpecific.Crypto.BaseBdevName) {
+			encrypted[r.DriverSpecific.Crypto.BaseBdevName] = true
+		}
+	}
+
+	var lvols []Lvol
+	for i := range result {
+		r := &result[i]
+		// lvol bdev has one alias "lvs_name/lvol_name"
+		if r.DriverSpecific.Lvol == nil || len(r.Aliases) == 0 {
+			continue
+		}
+		lvsName, lvolName, found := strings.Cut(r.Aliases[0], "/")
+		if !found {
+			continue
+		}
+		lvols = append(lvols, Lvol{
+			ID:           r.Name,
+			Name:         lvolName,
+			LvsName:      lvsName,
+			SizeMiB:      r.BlockSize * r.NumBlocks / 1024 / 1024,
+			IsSnapshot:   r.DriverSpecific.Lvol.Snapshot,
+			BaseSnapshot: r.DriverSpecific.Lvol.BaseSnapshot,
+			Clones:       r.DriverSpecific.Lvol.Clones,
+			Qos:          QosLimits(r.AssignedRateLimits),
+			Encrypted:    encrypted[r.Name],
+		})
+	}
+
+	return lvols, nil
+}
+
+func (client *rpcClient) createVolume(lvolName, lvsName string, sizeMiB int64, opts LvolOptions) (string, error) {
 	params := struct {
 		LvolName      string `json:"lvol_name"`
 		Size          int64  `json:"size"`
@@ -171,11 +420,11 @@ func (client *rpcClient) createVolume(lvsName string, sizeMiB int64) (string, er
 		ClearMethod   string `json:"clear_method"`
 		ThinProvision bool   `json:"thin_provision"`
 	}{
-		LvolName:      "csi-" + uuid.New().String(),
+		LvolName:      lvolName,
 		Size:          sizeMiB * 1024 * 1024,
 		LvsName:       lvsName,
-		ClearMethod:   cfgLvolClearMethod,
-		ThinProvision: cfgLvolThinProvision,
+		ClearMethod:   opts.ClearMethod,
+		ThinProvision: opts.ThinProvision,
 	}
 
 	var lvolID string
@@ -203,6 +452,156 @@ func (client *rpcClient) deleteVolume(lvolID string) error {
 	return err
 }
 
+func (client *rpcClient) resizeVolume(lvolID string, sizeMiB int64) error {
+	params := struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}{
+		Name: lvolID,
+		Size: sizeMiB * 1024 * 1024,
+	}
+
+	var result bool
+	err := client.call("bdev_lvol_resize", &params, &result)
+	if errorMatches(err, ErrJSONNoSpaceLeft) {
+		err = ErrJSONNoSpaceLeft // may happen in concurrency
+	}
+	if err == nil && !result {
+		err = fmt.Errorf("resize lvol failure: %s", lvolID)
+	}
+
+	return err
+}
+
+func (client *rpcClient) setQos(lvolID string, qos QosLimits) error {
+	params := struct {
+		Name           string `json:"name"`
+		RWIOsPerSec    int64  `json:"rw_ios_per_sec"`
+		RWMBytesPerSec int64  `json:"rw_mbytes_per_sec"`
+		RMBytesPerSec  int64  `json:"r_mbytes_per_sec"`
+		WMBytesPerSec  int64  `json:"w_mbytes_per_sec"`
+	}{
+		Name:           lvolID,
+		RWIOsPerSec:    qos.RWIOsPerSec,
+		RWMBytesPerSec: qos.RWMBytesPerSec,
+		RMBytesPerSec:  qos.RMBytesPerSec,
+		WMBytesPerSec:  qos.WMBytesPerSec,
+	}
+
+	var result bool
+	err := client.call("bdev_set_qos_limit", &params, &result)
+	if err == nil && !result {
+		err = fmt.Errorf("set qos limit failure: %s", lvolID)
+	}
+
+	return err
+}
+
+// create crypto bdev on top of a logical volume, with a crypto key of the
+// same name, returns name of the crypto bdev
+func (client *rpcClient) createCryptoBdev(lvolID string, key CryptoKey) (string, error) {
+	name := cryptoBdevName(lvolID)
+
+	keyParams := struct {
+		Cipher string `json:"cipher"`
+		Key    string `json:"key"`
+		Key2   string `json:"key2"`
+		Name   string `json:"name"`
+	}{
+		Cipher: key.Cipher,
+		Key:    key.Key,
+		Key2:   key.Key2,
+		Name:   name,
+	}
+
+	err := client.call("accel_crypto_key_create", &keyParams, nil)
+	if err != nil {
+		return "", err
+	}
+
+	params := struct {
+		BaseBdevName string `json:"base_bdev_name"`
+		Name         string `json:"name"`
+		KeyName      string `json:"key_name"`
+	}{
+		BaseBdevName: lvolID,
+		Name:         name,
+		KeyName:      name,
+	}
+
+	var bdevName string
+	err = client.call("bdev_crypto_create", &params, &bdevName)
+	if err != nil {
+		client.destroyCryptoKey(name) //nolint:errcheck // we can do few
+		return "", err
+	}
+
+	return bdevName, nil
+}
+
+// delete crypto bdev of a logical volume and its crypto key, no error if
+// they don't exist
+func (client *rpcClient) deleteCryptoBdev(lvolID string) error {
+	name := cryptoBdevName(lvolID)
+
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+
+	err := client.call("bdev_crypto_delete", &params, nil)
+	if err != nil && !errorMatches(err, ErrJSONNoSuchDevice) {
+		return err
+	}
+
+	return client.destroyCryptoKey(name)
+}
+
+func (client *rpcClient) destroyCryptoKey(name string) error {
+	params := struct {
+		KeyName string `json:"key_name"`
+	}{
+		KeyName: name,
+	}
+
+	err := client.call("accel_crypto_key_destroy", &params, nil)
+	if err != nil && strings.Contains(err.Error(), "No key object found") {
+		err = nil // already destroyed
+	}
+
+	return err
+}
+
+// returns ids of logical volumes with crypto bdevs stacked on
+func (client *rpcClient) encryptedLvols() (map[string]bool, error) {
+	lvols, err := client.lvols()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make(map[string]bool)
+	for i := range lvols {
+		if lvols[i].Encrypted {
+			encrypted[lvols[i].ID] = true
+		}
+	}
+	return encrypted, nil
+}
+
+// crypto bdev and its key of a logical volume are named after the volume
+func cryptoBdevName(lvolID string) string {
+	return cryptoBdevPrefix + lvolID
+}
+
+// bdev exported by target for a logical volume
+func exportedBdevName(lvolID string, encrypted bool) string {
+	if encrypted {
+		return cryptoBdevName(lvolID)
+	}
+	return lvolID
+}
+
 func (client *rpcClient) snapshot(lvolName, snapShotName string) (string, error) {
 	params := struct {
 		LvolName     string `json:"lvol_name"`
@@ -218,8 +617,35 @@ func (client *rpcClient) snapshot(lvolName, snapShotName string) (string, error)
 	return snapshotID, err
 }
 
+func (client *rpcClient) clone(lvolName, snapshotID string) (string, error) {
+	params := struct {
+		SnapshotName string `json:"snapshot_name"`
+		CloneName    string `json:"clone_name"`
+	}{
+		SnapshotName: snapshotID,
+		CloneName:    lvolName,
+	}
+
+	var lvolID string
+	err := client.call("bdev_lvol_clone", &params, &lvolID)
+
+	return lvolID, err
+}
+
 // low level rpc request/response handling
 func (client *rpcClient) call(method string, args, result interface{}) error {
+	return client.callContext(context.Background(), method, args, result)
+}
+
+func (client *rpcClient) callContext(ctx context.Context, method string, args, result interface{}) (err error) {
+	start := time.Now()
+	defer func() {
+		rpcDuration.WithLabelValues(client.rpcURL, method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			rpcErrors.WithLabelValues(client.rpcURL, method).Inc()
+		}
+	}()
+
 	type rpcRequest struct {
 		Ver    string `json:"jsonrpc"`
 		ID     int32  `json:"id"`
@@ -234,8 +660,6 @@ func (client *rpcClient) call(method string, args, result interface{}) error {
 	}
 
 	var data []byte
-	var err error
-
 	if args == nil {
 		data, err = json.Marshal(request)
 	} else {
@@ -252,12 +676,12 @@ func (client *rpcClient) call(method string, args, result interface{}) error {
 		return fmt.Errorf("%s: %w", method, err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, client.rpcURL, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.rpcURL, bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("%s: %w", method, err)
 	}
 
-	req.SetBasicAuth(client.rpcUser, client.rpcPass)
+	req.SetBasicAuth(client.credentials())
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.httpClient.Do(req)
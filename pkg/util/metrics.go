@@ -0,0 +1,58 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+// metrics are registered to prometheus default registry, node label of spdk
+// json rpc metrics is rpc url of spdk node
+var (
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "spdkcsi_spdk_rpc_duration_seconds",
+		Help: "Latency of spdk json rpc calls per spdk node and method.",
+	}, []string{"node", "method"})
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "spdkcsi_spdk_rpc_errors_total",
+		Help: "Failed spdk json rpc calls per spdk node and method.",
+	}, []string{"node", "method"})
+)
+
+// StartMetricsServer serves prometheus metrics at /metrics in background
+func StartMetricsServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		klog.Errorf("metrics server stopped: %s", err.Error())
+	}()
+	klog.Infof("serving metrics at %s/metrics", listener.Addr())
+	return nil
+}
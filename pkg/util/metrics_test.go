@@ -0,0 +1,55 @@
+package util
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRPCMetrics(t *testing.T) {
+	nodeIx, err := NewSpdkNode(rpcURL, rpcUser, "wrong", "nvme-tcp", trAddr, NodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCount := rpcErrors.WithLabelValues(rpcURL, "bdev_lvol_get_lvstores")
+	before := testutil.ToFloat64(errCount)
+	if _, err = nodeIx.LvStores(); err == nil {
+		t.Fatal("should fail with wrong rpc password")
+	}
+	if testutil.ToFloat64(errCount) != before+1 {
+		t.Fatal("failed rpc call is not counted")
+	}
+
+	nodeIx.SetRPCCredentials(rpcUser, rpcPass)
+	if err = nodeIx.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if testutil.ToFloat64(rpcErrors.WithLabelValues(rpcURL, "spdk_get_version")) != 0 {
+		t.Fatal("successful rpc call is counted as error")
+	}
+	if testutil.CollectAndCount(rpcDuration, "spdkcsi_spdk_rpc_duration_seconds") < 2 {
+		t.Fatal("rpc latency is not observed")
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	err := StartMetricsServer("127.0.0.1:9811")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://127.0.0.1:9811/metrics") //nolint:noctx // only for test
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "spdkcsi_spdk_rpc") {
+		t.Fatal("spdk json rpc metrics not exported")
+	}
+}
@@ -17,7 +17,13 @@ limitations under the License.
 package util
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -25,73 +31,214 @@ import (
 	"k8s.io/klog"
 )
 
-const invalidNSID = 0
+const (
+	invalidNSID = 0
+	nqnPrefix   = "nqn.2020-04.io.spdk.csi:uuid:"
+)
 
 type nodeNVMf struct {
 	client *rpcClient
 
 	targetType   string // RDMA, TCP
-	targetAddr   string
 	targetPort   string
 	transCreated int32
+	keyDir       string           // see NodeOptions
+	transport    TransportOptions // see NodeOptions
 
 	lvols map[string]*lvolNVMf
-	mtx   sync.Mutex // for concurrent access to lvols map
+	paths *multipath // replaced by SetMultipath
+	mtx   sync.Mutex // for concurrent access to lvols map and paths
+}
+
+// listener addresses and ANA states, volume keeps the paths it's published
+// through until unpublished
+type multipath struct {
+	targetAddrs []string          // listener addresses, first one is targetAddr
+	anaStates   map[string]string // see NodeOptions
 }
 
 type lvolNVMf struct {
-	nsID  int
-	nqn   string
-	model string
+	nsID          int
+	nqn           string
+	model         string
+	secureChannel bool // listener requires TLS
+	encrypted     bool // exported through crypto bdev, kept after unpublish
+	paths         *multipath
 }
 
 func (lvol *lvolNVMf) reset() {
 	lvol.nsID = invalidNSID
 	lvol.nqn = ""
 	lvol.model = ""
+	lvol.secureChannel = false
+	lvol.paths = nil
+}
+
+// keys of a host registered in spdk keyring, empty if not used
+type hostKeys struct {
+	dhchapKey      string
+	dhchapCtrlrKey string
+	psk            string
+}
+
+// listen address of nvmf subsystem
+type listenAddress struct {
+	TrType  string `json:"trtype"`
+	AdrFam  string `json:"adrfam"`
+	TrAddr  string `json:"traddr"`
+	TrSvcID string `json:"trsvcid"`
 }
 
-func newNVMf(client *rpcClient, targetType, targetAddr string) *nodeNVMf {
-	return &nodeNVMf{
+func newNVMf(client *rpcClient, targetType, targetAddr string, opts NodeOptions) (*nodeNVMf, error) {
+	paths, err := newMultipath(targetAddr, opts.TargetAddrs, opts.AnaStates)
+	if err != nil {
+		return nil, err
+	}
+	if (opts.Transport.HeaderDigest || opts.Transport.DataDigest) && targetType != "TCP" {
+		return nil, fmt.Errorf("digest is not supported by %s transport", targetType)
+	}
+
+	node := &nodeNVMf{
 		client:     client,
 		targetType: targetType,
-		targetAddr: targetAddr,
 		targetPort: cfgNVMfSvcPort,
+		keyDir:     opts.KeyDir,
+		transport:  opts.Transport,
 		lvols:      make(map[string]*lvolNVMf),
+		paths:      paths,
+	}
+	if node.keyDir != "" {
+		err := node.checkKeyDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func newMultipath(targetAddr string, moreAddrs []string, anaStates map[string]string) (*multipath, error) {
+	targetAddrs := []string{targetAddr}
+	for _, addr := range moreAddrs {
+		if !contains(targetAddrs, addr) {
+			targetAddrs = append(targetAddrs, addr)
+		}
+	}
+	for addr, state := range anaStates {
+		if !contains(targetAddrs, addr) {
+			return nil, fmt.Errorf("ANA state of unknown target address: %s", addr)
+		}
+		switch state {
+		case "optimized", "non_optimized", "inaccessible":
+		default:
+			return nil, fmt.Errorf("invalid ANA state of %s: %s", addr, state)
+		}
+	}
+	return &multipath{targetAddrs: targetAddrs, anaStates: anaStates}, nil
+}
+
+// load a probe key file from keyDir into spdk keyring, so keyDir not shared
+// with spdk target fails node creation rather than publishing volumes
+func (node *nodeNVMf) checkKeyDir() error {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return err
+	}
+	name := "csi-probe-" + hex.EncodeToString(random)
+	path := filepath.Join(node.keyDir, name)
+	err = os.WriteFile(path, []byte(name), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write to keyDir %s: %w", node.keyDir, err)
+	}
+	defer os.Remove(path)
+
+	err = node.keyringAddKey(name, path)
+	if err != nil {
+		return fmt.Errorf("failed to load key file %s, keyDir must be shared with spdk target at same path: %w", path, err)
 	}
+	return node.keyringRemoveKey(name)
 }
 
 func (node *nodeNVMf) Info() string {
 	return node.client.info()
 }
 
+func (node *nodeNVMf) SetRPCCredentials(rpcUser, rpcPass string) {
+	node.client.setCredentials(rpcUser, rpcPass)
+}
+
+func (node *nodeNVMf) Ping() error {
+	return node.client.ping()
+}
+
+func (node *nodeNVMf) IOStats() (map[string]IOStat, error) {
+	return node.client.ioStats()
+}
+
 func (node *nodeNVMf) LvStores() ([]LvStore, error) {
 	return node.client.lvStores()
 }
 
+// SetMultipath changes target addresses besides targetAddr and ANA states,
+// volumes published already keep their listeners until unpublished.
+func (node *nodeNVMf) SetMultipath(targetAddrs []string, anaStates map[string]string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	paths, err := newMultipath(node.paths.targetAddrs[0], targetAddrs, anaStates)
+	if err != nil {
+		return err
+	}
+	node.paths = paths
+	return nil
+}
+
+func (node *nodeNVMf) multipath() *multipath {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	return node.paths
+}
+
 // VolumeInfo returns a string:string map containing information necessary
 // for CSI node(initiator) to connect to this target and identify the disk.
 func (node *nodeNVMf) VolumeInfo(lvolID string) (map[string]string, error) {
 	node.mtx.Lock()
 	lvol, exists := node.lvols[lvolID]
+	paths := node.paths
 	node.mtx.Unlock()
 
 	if !exists {
 		return nil, fmt.Errorf("volume not exists: %s", lvolID)
 	}
+	if lvol.paths != nil {
+		paths = lvol.paths
+	}
 
-	return map[string]string{
+	volumeInfo := map[string]string{
 		"targetType": node.targetType,
-		"targetAddr": node.targetAddr,
-		"targetPort": node.targetPort,
-		"nqn":        lvol.nqn,
-		"model":      lvol.model,
-	}, nil
+		"targetAddr": paths.targetAddrs[0],
+		// all paths, connected by initiator for multipath
+		"targetAddrs": strings.Join(paths.targetAddrs, ","),
+		"targetPort":  node.targetPort,
+		"nqn":         lvol.nqn,
+		"model":       lvol.model,
+	}
+	if node.transport.HeaderDigest {
+		volumeInfo["headerDigest"] = "true"
+	}
+	if node.transport.DataDigest {
+		volumeInfo["dataDigest"] = "true"
+	}
+	return volumeInfo, nil
+}
+
+func (node *nodeNVMf) Lvols() ([]Lvol, error) {
+	return node.client.lvols()
 }
 
 // CreateVolume creates a logical volume and returns volume ID
-func (node *nodeNVMf) CreateVolume(lvsName string, sizeMiB int64) (string, error) {
-	lvolID, err := node.client.createVolume(lvsName, sizeMiB)
+func (node *nodeNVMf) CreateVolume(lvolName, lvsName string, sizeMiB int64, opts LvolOptions) (string, error) {
+	lvolID, err := node.client.createVolume(lvolName, lvsName, sizeMiB, opts)
 	if err != nil {
 		return "", err
 	}
@@ -119,7 +266,39 @@ func (node *nodeNVMf) CreateSnapshot(lvolName, snapshotName string) (string, err
 	return snapshotID, nil
 }
 
+// CloneSnapshot creates a logical volume from snapshot and returns volume ID
+func (node *nodeNVMf) CloneSnapshot(lvolName, snapshotID string) (string, error) {
+	lvolID, err := node.client.clone(lvolName, snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	_, exists := node.lvols[lvolID]
+	if exists {
+		return "", fmt.Errorf("volume ID already exists: %s", lvolID)
+	}
+	node.lvols[lvolID] = &lvolNVMf{nsID: invalidNSID}
+
+	klog.V(5).Infof("volume cloned: %s, from snapshot: %s", lvolID, snapshotID)
+	return lvolID, nil
+}
+
 func (node *nodeNVMf) DeleteVolume(lvolID string) error {
+	node.mtx.Lock()
+	lvol, exists := node.lvols[lvolID]
+	node.mtx.Unlock()
+
+	if exists && lvol.encrypted {
+		err := node.client.deleteCryptoBdev(lvolID)
+		if err != nil {
+			return err
+		}
+		lvol.encrypted = false
+	}
+
 	err := node.client.deleteVolume(lvolID)
 	if err != nil {
 		return err
@@ -134,6 +313,55 @@ func (node *nodeNVMf) DeleteVolume(lvolID string) error {
 	return nil
 }
 
+// ResizeVolume grows a logical volume, client node needs to rescan the
+// device to see the new size
+func (node *nodeNVMf) ResizeVolume(lvolID string, sizeMiB int64) error {
+	err := node.client.resizeVolume(lvolID, sizeMiB)
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("volume resized: %s, %d MiB", lvolID, sizeMiB)
+	return nil
+}
+
+// SetQos sets rate limits of a logical volume
+func (node *nodeNVMf) SetQos(lvolID string, qos QosLimits) error {
+	err := node.client.setQos(lvolID, qos)
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("volume qos set: %s, %+v", lvolID, qos)
+	return nil
+}
+
+// EncryptVolume stacks a crypto bdev on an unpublished volume
+func (node *nodeNVMf) EncryptVolume(lvolID string, key CryptoKey) error {
+	node.mtx.Lock()
+	lvol, exists := node.lvols[lvolID]
+	node.mtx.Unlock()
+
+	if !exists {
+		return ErrVolumeDeleted
+	}
+	if lvol.encrypted {
+		return nil
+	}
+	if lvol.nqn != "" {
+		return ErrVolumePublished
+	}
+
+	_, err := node.client.createCryptoBdev(lvolID, key)
+	if err != nil {
+		return err
+	}
+	lvol.encrypted = true
+
+	klog.V(5).Infof("volume encrypted: %s", lvolID)
+	return nil
+}
+
 // PublishVolume exports a volume through NVMf target
 func (node *nodeNVMf) PublishVolume(lvolID string) error {
 	var err error
@@ -162,18 +390,19 @@ func (node *nodeNVMf) PublishVolume(lvolID string) error {
 	}()
 
 	lvol.model = lvolID
-	lvol.nqn, err = node.createSubsystem(lvol.model)
+	lvol.paths = node.multipath()
+	lvol.nqn, err = node.createSubsystem(lvol.model, lvol.paths)
 	if err != nil {
 		return err
 	}
 
-	lvol.nsID, err = node.subsystemAddNs(lvol.nqn, lvolID)
+	lvol.nsID, err = node.subsystemAddNs(lvol.nqn, exportedBdevName(lvolID, lvol.encrypted))
 	if err != nil {
 		node.deleteSubsystem(lvol.nqn) //nolint:errcheck // we can do few
 		return err
 	}
 
-	err = node.subsystemAddListener(lvol.nqn)
+	err = node.subsystemAddListeners(lvol.nqn, lvol.paths, false)
 	if err != nil {
 		node.subsystemRemoveNs(lvol.nqn, lvol.nsID) //nolint:errcheck // ditto
 		node.deleteSubsystem(lvol.nqn)              //nolint:errcheck // ditto
@@ -210,25 +439,345 @@ func (node *nodeNVMf) UnpublishVolume(lvolID string) error {
 	if err != nil {
 		return err
 	}
+	node.removeUnusedKeys(lvolID, "")
 
 	lvol.reset()
 	klog.V(5).Infof("volume unpublished: %s", lvolID)
 	return nil
 }
 
-func (node *nodeNVMf) createSubsystem(model string) (string, error) {
-	nqn := "nqn.2020-04.io.spdk.csi:uuid:" + model
+// AllowHost allows a host to connect to the subsystem of a published volume,
+// other hosts are not allowed. Host must authenticate with DH-HMAC-CHAP and
+// connect through TLS if keys are provided.
+func (node *nodeNVMf) AllowHost(lvolID string, host HostID, creds Credentials) error {
+	if creds.chapEnabled() {
+		return fmt.Errorf("iSCSI CHAP is not supported by NVMe-oF target")
+	}
+	if host.NQN == "" {
+		return fmt.Errorf("%w: host nqn is unknown", ErrHostIDRequired)
+	}
+	if creds.nvmeAuthEnabled() {
+		if node.keyDir == "" {
+			return fmt.Errorf("NVMe-oF authentication requires keyDir of spdk node")
+		}
+		if creds.TLSKey != "" && node.targetType != "TCP" {
+			return fmt.Errorf("TLS is not supported by %s transport", node.targetType)
+		}
+	}
+
+	nqn, err := node.publishedNqn(lvolID)
+	if err != nil {
+		return err
+	}
+
+	err = node.addHost(lvolID, nqn, host.NQN, creds)
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("host allowed: %s, nqn: %s", lvolID, host.NQN)
+	return nil
+}
+
+// DisallowHost reverts AllowHost, empty host nqn revokes any host access
+// granted by older releases to hosts without host nqn
+func (node *nodeNVMf) DisallowHost(lvolID string, host HostID) error {
+	nqn, err := node.publishedNqn(lvolID)
+	if err != nil {
+		return err
+	}
+
+	if host.NQN == "" {
+		err = node.subsystemAllowAnyHost(nqn, false)
+	} else {
+		err = node.removeHost(lvolID, nqn, host.NQN)
+	}
+	if err != nil {
+		return err
+	}
+
+	klog.V(5).Infof("host disallowed: %s, nqn: %s", lvolID, host.NQN)
+	return nil
+}
+
+func (node *nodeNVMf) addHost(lvolID, nqn, hostNqn string, creds Credentials) error {
+	// re-add host in case keys are changed
+	hosts, err := node.subsystemHosts(nqn)
+	if err != nil {
+		return err
+	}
+	if contains(hosts, hostNqn) {
+		err = node.subsystemRemoveHost(nqn, hostNqn)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := node.addKeys(lvolID, creds)
+	if err == nil {
+		err = node.setSecureChannel(lvolID, nqn, creds.TLSKey != "")
+	}
+	if err == nil {
+		err = node.subsystemAddHost(nqn, hostNqn, keys)
+	}
+	// previous keys of the host, or keys just added if failed
+	node.removeUnusedKeys(lvolID, nqn)
+	return err
+}
+
+func (node *nodeNVMf) removeHost(lvolID, nqn, hostNqn string) error {
+	hosts, err := node.subsystemHosts(nqn)
+	if err != nil {
+		return err
+	}
+	if contains(hosts, hostNqn) {
+		err = node.subsystemRemoveHost(nqn, hostNqn)
+		if err != nil {
+			return err
+		}
+	}
+	// keys are shared by hosts of the volume
+	node.removeUnusedKeys(lvolID, nqn)
+	return nil
+}
+
+// write keys to files under keyDir and load them into spdk keyring, keys
+// are named after the volume and their values, so hosts of a multi-node
+// volume with same credentials share keys, and changed credentials of one
+// host don't replace keys used by other hosts
+func (node *nodeNVMf) addKeys(lvolID string, creds Credentials) (hostKeys, error) {
+	var keys hostKeys
+	if !creds.nvmeAuthEnabled() {
+		return keys, nil
+	}
+	loaded, err := node.keyringKeys()
+	if err != nil {
+		return hostKeys{}, err
+	}
+
+	for _, key := range hostKeySlots(&keys, creds) {
+		if key.value == "" {
+			continue
+		}
+		name := keyName(lvolID, key.kind, key.value)
+		if !loaded[name] {
+			path := filepath.Join(node.keyDir, name)
+			// spdk keyring requires key file accessible only by owner
+			err = os.WriteFile(path, []byte(key.value), 0o600)
+			if err != nil {
+				return hostKeys{}, err
+			}
+			err = node.keyringAddKey(name, path)
+			if err != nil {
+				return hostKeys{}, fmt.Errorf("failed to load key file %s: %w", path, err)
+			}
+		}
+		*key.name = name
+	}
+	return keys, nil
+}
+
+type hostKeySlot struct {
+	name  *string
+	kind  string
+	value string
+}
+
+// key names of hostKeys to fill, with kinds and values from credentials
+func hostKeySlots(keys *hostKeys, creds Credentials) []hostKeySlot {
+	return []hostKeySlot{
+		{&keys.dhchapKey, "dhchap", creds.DHChapSecret},
+		{&keys.dhchapCtrlrKey, "dhchap-ctrlr", creds.DHChapCtrlSecret},
+		{&keys.psk, "psk", creds.TLSKey},
+	}
+}
+
+// remove keys of a volume from spdk keyring and keyDir, except keys used
+// by hosts of the subsystem, all keys are removed if nqn is empty. Errors
+// are ignored as keys may not be loaded.
+func (node *nodeNVMf) removeUnusedKeys(lvolID, nqn string) {
+	if node.keyDir == "" {
+		return
+	}
+	used := make(map[string]bool)
+	if nqn != "" {
+		hosts, err := node.subsystemHostKeys(nqn)
+		if err != nil {
+			klog.Warningf("failed to get keys of hosts, keys kept: %s", err)
+			return
+		}
+		for _, keys := range hosts {
+			used[keys.dhchapKey] = true
+			used[keys.dhchapCtrlrKey] = true
+			used[keys.psk] = true
+		}
+	}
+
+	files, err := os.ReadDir(node.keyDir)
+	if err != nil {
+		klog.Warningf("failed to list keyDir %s: %s", node.keyDir, err)
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, keyName(lvolID, "", "")) || used[name] {
+			continue
+		}
+		err = node.keyringRemoveKey(name)
+		if err != nil {
+			klog.Warningf("failed to remove key %s: %s", name, err)
+		}
+		path := filepath.Join(node.keyDir, name)
+		err = os.Remove(path)
+		if err != nil {
+			klog.Warningf("failed to remove key file %s: %s", path, err)
+		}
+	}
+}
+
+// key name carries hash of the value, prefix of keys of the volume if kind
+// is empty
+func keyName(lvolID, kind, value string) string {
+	if kind == "" {
+		return fmt.Sprintf("csi-%s-", lvolID)
+	}
+	hash := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("csi-%s-%s-%s", lvolID, kind, hex.EncodeToString(hash[:8]))
+}
+
+// re-create listeners of the subsystem if TLS requirement changes
+func (node *nodeNVMf) setSecureChannel(lvolID, nqn string, secureChannel bool) error {
+	node.mtx.Lock()
+	lvol := node.lvols[lvolID]
+	node.mtx.Unlock()
+
+	if lvol.secureChannel == secureChannel {
+		return nil
+	}
+	err := node.subsystemRemoveListeners(nqn, lvol.paths)
+	if err != nil {
+		return err
+	}
+	err = node.subsystemAddListeners(nqn, lvol.paths, secureChannel)
+	if err != nil {
+		// try restoring original listeners
+		node.subsystemAddListeners(nqn, lvol.paths, lvol.secureChannel) //nolint:errcheck // we can do few
+		return err
+	}
+	lvol.secureChannel = secureChannel
+	return nil
+}
+
+func (node *nodeNVMf) publishedNqn(lvolID string) (string, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	lvol, exists := node.lvols[lvolID]
+	if !exists {
+		return "", ErrVolumeDeleted
+	}
+	if lvol.nqn == "" {
+		return "", ErrVolumeUnpublished
+	}
+	return lvol.nqn, nil
+}
+
+// RestoreVolumes tracks existing logical volumes, volumes exported through
+// NVMf subsystems created by us are marked as published
+func (node *nodeNVMf) RestoreVolumes(lvolIDs []string) error {
+	type namespace struct {
+		NsID     int    `json:"nsid"`
+		BdevName string `json:"bdev_name"`
+	}
+
+	type listener struct {
+		TrAddr        string `json:"traddr"`
+		SecureChannel bool   `json:"secure_channel"`
+	}
+
+	var subsystems []struct {
+		Nqn             string      `json:"nqn"`
+		ModelNumber     string      `json:"model_number"`
+		Namespaces      []namespace `json:"namespaces"`
+		ListenAddresses []listener  `json:"listen_addresses"`
+	}
+
+	err := node.client.call("nvmf_get_subsystems", nil, &subsystems)
+	if err != nil {
+		return err
+	}
+	encrypted, err := node.client.encryptedLvols()
+	if err != nil {
+		return err
+	}
+
+	published := make(map[string]*lvolNVMf)
+	for i := range subsystems {
+		subsystem := &subsystems[i]
+		if !strings.HasPrefix(subsystem.Nqn, nqnPrefix) || len(subsystem.Namespaces) == 0 {
+			continue
+		}
+		// namespace is the lvol or crypto bdev on top of it
+		lvolID := strings.TrimPrefix(subsystem.Namespaces[0].BdevName, cryptoBdevPrefix)
+		lvol := &lvolNVMf{
+			nsID:  subsystem.Namespaces[0].NsID,
+			nqn:   subsystem.Nqn,
+			model: subsystem.ModelNumber,
+		}
+		// listeners are all secure or all plain, see setSecureChannel
+		var targetAddrs []string
+		for _, listener := range subsystem.ListenAddresses {
+			lvol.secureChannel = lvol.secureChannel || listener.SecureChannel
+			targetAddrs = append(targetAddrs, listener.TrAddr)
+		}
+		if len(targetAddrs) > 0 {
+			lvol.paths = &multipath{targetAddrs: targetAddrs}
+		}
+		published[lvolID] = lvol
+	}
+
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+
+	// ANA states are not listed with subsystems, take current ones
+	for _, lvol := range published {
+		if lvol.paths == nil {
+			lvol.paths = node.paths
+		} else {
+			lvol.paths.anaStates = node.paths.anaStates
+		}
+	}
+
+	for _, lvolID := range lvolIDs {
+		if _, exists := node.lvols[lvolID]; exists {
+			continue
+		}
+		lvol, exists := published[lvolID]
+		if !exists {
+			lvol = &lvolNVMf{nsID: invalidNSID}
+		}
+		lvol.encrypted = encrypted[lvolID]
+		node.lvols[lvolID] = lvol
+		klog.V(5).Infof("volume restored: %s, nqn: %s", lvolID, lvol.nqn)
+	}
+	return nil
+}
+
+func (node *nodeNVMf) createSubsystem(model string, paths *multipath) (string, error) {
+	nqn := nqnPrefix + model
 
 	params := struct {
 		Nqn          string `json:"nqn"`
 		AllowAnyHost bool   `json:"allow_any_host"`
 		SerialNumber string `json:"serial_number"`
 		ModelNumber  string `json:"model_number"`
+		AnaReporting bool   `json:"ana_reporting,omitempty"`
 	}{
 		Nqn:          nqn,
 		AllowAnyHost: cfgAllowAnyHost,
 		SerialNumber: "spdkcsi-sn",
 		ModelNumber:  model, // client matches imported disk with model string
+		AnaReporting: len(paths.anaStates) > 0,
 	}
 
 	err := node.client.call("nvmf_create_subsystem", &params, nil)
@@ -260,30 +809,83 @@ func (node *nodeNVMf) subsystemAddNs(nqn, lvolID string) (int, error) {
 	return nsID, err
 }
 
-func (node *nodeNVMf) subsystemAddListener(nqn string) error {
-	type listenAddress struct {
-		TrType  string `json:"trtype"`
-		AdrFam  string `json:"adrfam"`
-		TrAddr  string `json:"traddr"`
-		TrSvcID string `json:"trsvcid"`
+// add listeners on all target addresses, with ANA states if configured,
+// added listeners are removed on error
+func (node *nodeNVMf) subsystemAddListeners(nqn string, paths *multipath, secureChannel bool) error {
+	for i, addr := range paths.targetAddrs {
+		err := node.subsystemAddListener(nqn, addr, secureChannel)
+		if err == nil && paths.anaStates[addr] != "" {
+			err = node.subsystemSetAnaState(nqn, addr, paths.anaStates[addr])
+			if err != nil {
+				node.subsystemRemoveListener(nqn, addr) //nolint:errcheck // we can do few
+			}
+		}
+		if err != nil {
+			for _, added := range paths.targetAddrs[:i] {
+				node.subsystemRemoveListener(nqn, added) //nolint:errcheck // ditto
+			}
+			return err
+		}
 	}
+	return nil
+}
 
+func (node *nodeNVMf) subsystemRemoveListeners(nqn string, paths *multipath) error {
+	for _, addr := range paths.targetAddrs {
+		err := node.subsystemRemoveListener(nqn, addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *nodeNVMf) listenAddress(addr string) listenAddress {
+	return listenAddress{
+		TrType:  node.targetType,
+		TrAddr:  addr,
+		TrSvcID: node.targetPort,
+		AdrFam:  addressFamily(addr),
+	}
+}
+
+// address family of listener, IPv4 or IPv6 per target address
+func addressFamily(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip != nil && ip.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func (node *nodeNVMf) subsystemAddListener(nqn, addr string, secureChannel bool) error {
 	params := struct {
 		Nqn           string        `json:"nqn"`
 		ListenAddress listenAddress `json:"listen_address"`
+		SecureChannel bool          `json:"secure_channel,omitempty"`
 	}{
-		Nqn: nqn,
-		ListenAddress: listenAddress{
-			TrType:  node.targetType,
-			TrAddr:  node.targetAddr,
-			TrSvcID: node.targetPort,
-			AdrFam:  cfgAddrFamily,
-		},
+		Nqn:           nqn,
+		ListenAddress: node.listenAddress(addr),
+		SecureChannel: secureChannel,
 	}
 
 	return node.client.call("nvmf_subsystem_add_listener", &params, nil)
 }
 
+func (node *nodeNVMf) subsystemSetAnaState(nqn, addr, anaState string) error {
+	params := struct {
+		Nqn           string        `json:"nqn"`
+		ListenAddress listenAddress `json:"listen_address"`
+		AnaState      string        `json:"ana_state"`
+	}{
+		Nqn:           nqn,
+		ListenAddress: node.listenAddress(addr),
+		AnaState:      anaState,
+	}
+
+	return node.client.call("nvmf_subsystem_listener_set_ana_state", &params, nil)
+}
+
 func (node *nodeNVMf) subsystemRemoveNs(nqn string, nsID int) error {
 	params := struct {
 		Nqn  string `json:"nqn"`
@@ -306,28 +908,230 @@ func (node *nodeNVMf) deleteSubsystem(nqn string) error {
 	return node.client.call("nvmf_delete_subsystem", &params, nil)
 }
 
+func (node *nodeNVMf) subsystemAddHost(nqn, hostNqn string, keys hostKeys) error {
+	params := struct {
+		Nqn            string `json:"nqn"`
+		Host           string `json:"host"`
+		Psk            string `json:"psk,omitempty"`
+		DHChapKey      string `json:"dhchap_key,omitempty"`
+		DHChapCtrlrKey string `json:"dhchap_ctrlr_key,omitempty"`
+	}{
+		Nqn:            nqn,
+		Host:           hostNqn,
+		Psk:            keys.psk,
+		DHChapKey:      keys.dhchapKey,
+		DHChapCtrlrKey: keys.dhchapCtrlrKey,
+	}
+
+	return node.client.call("nvmf_subsystem_add_host", &params, nil)
+}
+
+func (node *nodeNVMf) subsystemRemoveHost(nqn, hostNqn string) error {
+	params := struct {
+		Nqn  string `json:"nqn"`
+		Host string `json:"host"`
+	}{
+		Nqn:  nqn,
+		Host: hostNqn,
+	}
+
+	return node.client.call("nvmf_subsystem_remove_host", &params, nil)
+}
+
+func (node *nodeNVMf) subsystemAllowAnyHost(nqn string, allowAnyHost bool) error {
+	params := struct {
+		Nqn          string `json:"nqn"`
+		AllowAnyHost bool   `json:"allow_any_host"`
+	}{
+		Nqn:          nqn,
+		AllowAnyHost: allowAnyHost,
+	}
+
+	return node.client.call("nvmf_subsystem_allow_any_host", &params, nil)
+}
+
+// returns nqns of hosts allowed to connect to the subsystem
+func (node *nodeNVMf) subsystemHosts(nqn string) ([]string, error) {
+	keys, err := node.subsystemHostKeys(nqn)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for hostNqn := range keys {
+		hosts = append(hosts, hostNqn)
+	}
+	return hosts, nil
+}
+
+// returns keys of hosts allowed to connect to the subsystem, by host nqn
+func (node *nodeNVMf) subsystemHostKeys(nqn string) (map[string]hostKeys, error) {
+	type host struct {
+		Nqn            string `json:"nqn"`
+		Psk            string `json:"psk"`
+		DHChapKey      string `json:"dhchap_key"`
+		DHChapCtrlrKey string `json:"dhchap_ctrlr_key"`
+	}
+
+	var subsystems []struct {
+		Nqn   string `json:"nqn"`
+		Hosts []host `json:"hosts"`
+	}
+
+	params := struct {
+		Nqn string `json:"nqn"`
+	}{
+		Nqn: nqn,
+	}
+
+	err := node.client.call("nvmf_get_subsystems", &params, &subsystems)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]hostKeys)
+	for i := range subsystems {
+		if subsystems[i].Nqn != nqn {
+			continue
+		}
+		for _, h := range subsystems[i].Hosts {
+			hosts[h.Nqn] = hostKeys{dhchapKey: h.DHChapKey, dhchapCtrlrKey: h.DHChapCtrlrKey, psk: h.Psk}
+		}
+	}
+	return hosts, nil
+}
+
+func (node *nodeNVMf) subsystemRemoveListener(nqn, addr string) error {
+	params := struct {
+		Nqn           string        `json:"nqn"`
+		ListenAddress listenAddress `json:"listen_address"`
+	}{
+		Nqn:           nqn,
+		ListenAddress: node.listenAddress(addr),
+	}
+
+	return node.client.call("nvmf_subsystem_remove_listener", &params, nil)
+}
+
+func (node *nodeNVMf) keyringAddKey(name, path string) error {
+	params := struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}{
+		Name: name,
+		Path: path,
+	}
+
+	return node.client.call("keyring_file_add_key", &params, nil)
+}
+
+// returns names of keys loaded in spdk keyring
+func (node *nodeNVMf) keyringKeys() (map[string]bool, error) {
+	var keys []struct {
+		Name string `json:"name"`
+	}
+	err := node.client.call("keyring_get_keys", nil, &keys)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, key := range keys {
+		names[key.Name] = true
+	}
+	return names, nil
+}
+
+func (node *nodeNVMf) keyringRemoveKey(name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+
+	return node.client.call("keyring_file_remove_key", &params, nil)
+}
+
 func (node *nodeNVMf) createTransport() error {
 	// concurrent requests can happen despite this fast path check
 	if atomic.LoadInt32(&node.transCreated) != 0 {
 		return nil
 	}
 
-	// TODO: support transport parameters
-	params := struct {
-		TrType string `json:"trtype"`
-	}{
-		TrType: node.targetType,
+	params := transportParams{
+		TrType:            node.targetType,
+		IOUnitSize:        node.transport.IOUnitSize,
+		MaxQueueDepth:     node.transport.MaxQueueDepth,
+		NumSharedBuffers:  node.transport.NumSharedBuffers,
+		InCapsuleDataSize: node.transport.InCapsuleDataSize,
 	}
 
 	err := node.client.call("nvmf_create_transport", &params, nil)
 
 	if err == nil {
-		klog.V(5).Infof("Transport created: %s,%s", node.targetAddr, node.targetType)
+		klog.V(5).Infof("Transport created: %s,%s", node.multipath().targetAddrs, node.targetType)
 		atomic.StoreInt32(&node.transCreated, 1)
 	} else if strings.Contains(err.Error(), "already exists") {
 		err = nil // ignore transport already exists error
+		// transport is not re-created, volumes may be using it
+		if mismatch := node.checkTransport(&params); mismatch != nil {
+			klog.Warningf("configured transport options are not applied: %s", mismatch)
+		}
 		atomic.StoreInt32(&node.transCreated, 1)
 	}
 
 	return err
 }
+
+// options of nvmf transport, zero values are not passed to spdk
+type transportParams struct {
+	TrType            string `json:"trtype"`
+	IOUnitSize        int    `json:"io_unit_size,omitempty"`
+	MaxQueueDepth     int    `json:"max_queue_depth,omitempty"`
+	NumSharedBuffers  int    `json:"num_shared_buffers,omitempty"`
+	InCapsuleDataSize int    `json:"in_capsule_data_size,omitempty"`
+}
+
+// compare options of existing transport with non-zero expected ones
+func (node *nodeNVMf) checkTransport(expected *transportParams) error {
+	params := struct {
+		TrType string `json:"trtype"`
+	}{
+		TrType: expected.TrType,
+	}
+	var transports []transportParams
+	err := node.client.call("nvmf_get_transports", &params, &transports)
+	if err != nil {
+		return fmt.Errorf("failed to get %s transport: %w", expected.TrType, err)
+	}
+	if len(transports) == 0 {
+		return fmt.Errorf("%s transport not found", expected.TrType)
+	}
+	existing := &transports[0]
+
+	var mismatches []string
+	for _, option := range []struct {
+		name               string
+		expected, existing int
+	}{
+		{"io_unit_size", expected.IOUnitSize, existing.IOUnitSize},
+		{"max_queue_depth", expected.MaxQueueDepth, existing.MaxQueueDepth},
+		{"num_shared_buffers", expected.NumSharedBuffers, existing.NumSharedBuffers},
+		{"in_capsule_data_size", expected.InCapsuleDataSize, existing.InCapsuleDataSize},
+	} {
+		if option.expected != 0 && option.expected != option.existing {
+			mismatches = append(mismatches, fmt.Sprintf("%s=%d, expected %d", option.name, option.existing, option.expected))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s transport exists with %s", expected.TrType, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
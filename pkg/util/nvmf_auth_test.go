@@ -0,0 +1,355 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake NVMe-oF target serving spdk json rpc of one subsystem, with keyring
+// loading key files under root of its own filesystem
+type fakeNVMfTarget struct {
+	mtx          sync.Mutex
+	root         string
+	nqn          string
+	keyring      map[string]string            // key name to key
+	listeners    map[string]bool              // listener address to secure channel
+	hosts        map[string]map[string]string // host nqn to key names
+	allowAnyHost bool
+}
+
+func newFakeNVMfTarget(t *testing.T, root, nqn string, listeners ...string) (*fakeNVMfTarget, *httptest.Server) {
+	target := &fakeNVMfTarget{
+		root:      root,
+		nqn:       nqn,
+		keyring:   make(map[string]string),
+		listeners: make(map[string]bool),
+		hosts:     make(map[string]map[string]string),
+	}
+	for _, addr := range listeners {
+		target.listeners[addr] = false
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID     int32           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+		result, err := target.serve(request.Method, request.Params)
+		if err != nil {
+			response["error"] = map[string]interface{}{"code": -32602, "message": err.Error()}
+		} else {
+			response["result"] = result
+		}
+		json.NewEncoder(w).Encode(response) //nolint:errcheck // only for test
+	}))
+	t.Cleanup(server.Close)
+	return target, server
+}
+
+//nolint:cyclop // one case per rpc method
+func (target *fakeNVMfTarget) serve(method string, data json.RawMessage) (interface{}, error) {
+	var params struct {
+		Nqn           string `json:"nqn"`
+		Name          string `json:"name"`
+		Path          string `json:"path"`
+		Host          string `json:"host"`
+		Psk           string `json:"psk"`
+		DHChapKey     string `json:"dhchap_key"`
+		DHChapCtrlKey string `json:"dhchap_ctrlr_key"`
+		AllowAnyHost  bool   `json:"allow_any_host"`
+		SecureChannel bool   `json:"secure_channel"`
+		ListenAddress struct {
+			TrAddr string `json:"traddr"`
+		} `json:"listen_address"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &params); err != nil {
+			return nil, err
+		}
+	}
+	if params.Nqn != "" && params.Nqn != target.nqn {
+		return nil, fmt.Errorf("subsystem not found: %s", params.Nqn)
+	}
+
+	target.mtx.Lock()
+	defer target.mtx.Unlock()
+
+	switch method {
+	case "nvmf_get_subsystems":
+		var hosts, listeners []map[string]interface{}
+		for hostNqn, keys := range target.hosts {
+			hosts = append(hosts, map[string]interface{}{
+				"nqn": hostNqn, "psk": keys["psk"], "dhchap_key": keys["dhchap"], "dhchap_ctrlr_key": keys["dhchap-ctrlr"],
+			})
+		}
+		for addr, secure := range target.listeners {
+			listeners = append(listeners, map[string]interface{}{"traddr": addr, "secure_channel": secure})
+		}
+		// subsystem is named after the lvol it exports
+		namespaces := []map[string]interface{}{{"nsid": 1, "bdev_name": strings.TrimPrefix(target.nqn, nqnPrefix)}}
+		return []map[string]interface{}{{"nqn": target.nqn, "hosts": hosts, "listen_addresses": listeners, "namespaces": namespaces}}, nil
+	case "bdev_get_bdevs":
+		return []interface{}{}, nil
+	case "nvmf_subsystem_add_listener":
+		if _, exists := target.listeners[params.ListenAddress.TrAddr]; exists {
+			return nil, errors.New("listener already exists")
+		}
+		target.listeners[params.ListenAddress.TrAddr] = params.SecureChannel
+	case "nvmf_subsystem_remove_listener":
+		delete(target.listeners, params.ListenAddress.TrAddr)
+	case "keyring_get_keys":
+		var keys []map[string]interface{}
+		for name := range target.keyring {
+			keys = append(keys, map[string]interface{}{"name": name})
+		}
+		return keys, nil
+	case "keyring_file_add_key":
+		if _, exists := target.keyring[params.Name]; exists {
+			return nil, errors.New("key already exists")
+		}
+		// key file is read from filesystem of target
+		key, err := os.ReadFile(filepath.Join(target.root, params.Path))
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file: %w", err)
+		}
+		target.keyring[params.Name] = string(key)
+	case "keyring_file_remove_key":
+		delete(target.keyring, params.Name)
+	case "nvmf_subsystem_add_host":
+		keys := map[string]string{"psk": params.Psk, "dhchap": params.DHChapKey, "dhchap-ctrlr": params.DHChapCtrlKey}
+		for _, name := range keys {
+			if _, exists := target.keyring[name]; name != "" && !exists {
+				return nil, fmt.Errorf("key not found: %s", name)
+			}
+		}
+		target.hosts[params.Host] = keys
+	case "nvmf_subsystem_remove_host":
+		delete(target.hosts, params.Host)
+	case "nvmf_subsystem_allow_any_host":
+		target.allowAnyHost = params.AllowAnyHost
+	case "nvmf_create_transport":
+		return nil, errors.New("transport type 'TCP' already exists")
+	case "nvmf_get_transports":
+		// spdk defaults of TCP transport
+		return []map[string]interface{}{{
+			"trtype": "TCP", "io_unit_size": 131072, "max_queue_depth": 128, "num_shared_buffers": 511, "in_capsule_data_size": 4096,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("method not found: %s", method)
+	}
+	return true, nil
+}
+
+// connect checks a host connecting to the listener as the target does: TLS
+// with pre-shared key if the listener requires secure channel, then
+// DH-HMAC-CHAP per keys of the host
+func (target *fakeNVMfTarget) connect(addr, hostNqn string, creds Credentials) error {
+	target.mtx.Lock()
+	defer target.mtx.Unlock()
+
+	secure, exists := target.listeners[addr]
+	if !exists {
+		return fmt.Errorf("no listener on %s", addr)
+	}
+	keys, allowed := target.hosts[hostNqn]
+	if !allowed && !target.allowAnyHost {
+		return fmt.Errorf("host not allowed: %s", hostNqn)
+	}
+	if secure != (creds.TLSKey != "") {
+		return fmt.Errorf("secure channel mismatch, listener requires TLS: %v", secure)
+	}
+	if secure && target.keyring[keys["psk"]] != creds.TLSKey {
+		return errors.New("TLS handshake failed")
+	}
+	if keys["dhchap"] != "" && target.keyring[keys["dhchap"]] != creds.DHChapSecret {
+		return errors.New("DH-HMAC-CHAP host authentication failed")
+	}
+	if keys["dhchap-ctrlr"] != "" && target.keyring[keys["dhchap-ctrlr"]] != creds.DHChapCtrlSecret {
+		return errors.New("DH-HMAC-CHAP controller authentication failed")
+	}
+	return nil
+}
+
+func newFakeNVMfNode(t *testing.T, server *httptest.Server, keyDir, lvolID, nqn string) *nodeNVMf {
+	client := &rpcClient{rpcURL: server.URL, httpClient: &http.Client{Timeout: 10 * time.Second}}
+	node, err := newNVMf(client, "TCP", trAddr, NodeOptions{KeyDir: keyDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.lvols[lvolID] = &lvolNVMf{nsID: 1, nqn: nqn, paths: node.paths}
+	return node
+}
+
+//nolint:cyclop // TestNVMfSecureChannel exceeds cyclomatic complexity of 10
+func TestNVMfSecureChannel(t *testing.T) {
+	lvolID := "lvol-auth"
+	nqn := nqnPrefix + "lvol-auth"
+	hostNqn := "nqn.2014-08.org.nvmexpress:uuid:host-1"
+	creds := Credentials{
+		DHChapSecret:     "DHHC-1:00:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWZnaGlq:",
+		DHChapCtrlSecret: "DHHC-1:00:a2xtbm9wcXJzdHV2d3h5ejAxMjM0NTY3ODlhYmNkZWZnaGlq:",
+		TLSKey:           "NVMeTLSkey-1:01:MDAxMTIyMzM0NDU1NjY3Nzg4OTlhYWJiY2NkZGVlZmZwJEiQ:",
+	}
+
+	// keyDir is shared, target reads key files at same path
+	keyDir := t.TempDir()
+	target, server := newFakeNVMfTarget(t, "", nqn, trAddr)
+	node := newFakeNVMfNode(t, server, keyDir, lvolID, nqn)
+
+	err := node.AllowHost(lvolID, HostID{NQN: hostNqn}, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = target.connect(trAddr, hostNqn, creds)
+	if err != nil {
+		t.Fatalf("host with keys should connect: %s", err)
+	}
+	for name, c := range map[string]Credentials{
+		"plain connection": {DHChapSecret: creds.DHChapSecret, DHChapCtrlSecret: creds.DHChapCtrlSecret},
+		"wrong psk":        {DHChapSecret: creds.DHChapSecret, DHChapCtrlSecret: creds.DHChapCtrlSecret, TLSKey: tlsKeyPrefix + "01:wrong:"},
+		"wrong dhchap key": {DHChapSecret: dhchapSecretPrefix + "00:wrong:", DHChapCtrlSecret: creds.DHChapCtrlSecret, TLSKey: creds.TLSKey},
+	} {
+		if target.connect(trAddr, hostNqn, c) == nil {
+			t.Fatalf("host should not connect with %s", name)
+		}
+	}
+	if target.connect(trAddr, "nqn.2014-08.org.nvmexpress:uuid:host-2", creds) == nil {
+		t.Fatal("other host should not connect")
+	}
+
+	// keys are removed with last host
+	err = node.DisallowHost(lvolID, HostID{NQN: hostNqn})
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	if target.connect(trAddr, hostNqn, creds) == nil {
+		t.Fatal("disallowed host should not connect")
+	}
+	if len(target.keyring) != 0 {
+		t.Fatalf("keys not removed from keyring: %v", target.keyring)
+	}
+
+	// secure channel is restored after controller restart, listeners are
+	// re-created for a host without TLS key
+	err = node.AllowHost(lvolID, HostID{NQN: hostNqn}, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	node = newFakeNVMfNode(t, server, keyDir, lvolID, nqn)
+	delete(node.lvols, lvolID)
+	err = node.RestoreVolumes([]string{lvolID})
+	if err != nil {
+		t.Fatalf("RestoreVolumes: %s", err)
+	}
+	if !node.lvols[lvolID].secureChannel {
+		t.Fatal("secure channel not restored")
+	}
+	plainCreds := Credentials{DHChapSecret: creds.DHChapSecret, DHChapCtrlSecret: creds.DHChapCtrlSecret}
+	err = node.AllowHost(lvolID, HostID{NQN: hostNqn}, plainCreds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = target.connect(trAddr, hostNqn, plainCreds)
+	if err != nil {
+		t.Fatalf("host without TLS key should connect after restore: %s", err)
+	}
+	err = node.DisallowHost(lvolID, HostID{NQN: hostNqn})
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+
+	// keyDir not visible to target fails node creation
+	_, server = newFakeNVMfTarget(t, t.TempDir(), nqn, trAddr)
+	client := &rpcClient{rpcURL: server.URL, httpClient: &http.Client{Timeout: 10 * time.Second}}
+	_, err = newNVMf(client, "TCP", trAddr, NodeOptions{KeyDir: keyDir})
+	if err == nil || !strings.Contains(err.Error(), "keyDir must be shared") {
+		t.Fatalf("expect keyDir not shared error, got: %v", err)
+	}
+	files, err := os.ReadDir(keyDir)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("key files not cleaned up: %v, %v", files, err)
+	}
+}
+
+func TestNVMfMultiHostKeys(t *testing.T) {
+	lvolID := "lvol-auth"
+	nqn := nqnPrefix + "lvol-auth"
+	hostNqns := []string{"nqn.2014-08.org.nvmexpress:uuid:host-1", "nqn.2014-08.org.nvmexpress:uuid:host-2"}
+	creds := []Credentials{
+		{DHChapSecret: "DHHC-1:00:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWZnaGlq:"},
+		{DHChapSecret: "DHHC-1:00:a2xtbm9wcXJzdHV2d3h5ejAxMjM0NTY3ODlhYmNkZWZnaGlq:"},
+	}
+
+	target, server := newFakeNVMfTarget(t, "", nqn, trAddr)
+	node := newFakeNVMfNode(t, server, t.TempDir(), lvolID, nqn)
+	for i := range hostNqns {
+		err := node.AllowHost(lvolID, HostID{NQN: hostNqns[i]}, creds[i])
+		if err != nil {
+			t.Fatalf("AllowHost: %s", err)
+		}
+	}
+	// rotating keys of one host keeps keys of the other
+	rotated := Credentials{DHChapSecret: "DHHC-1:00:bW5vcHFyc3R1dnd4eXowMTIzNDU2Nzg5YWJjZGVmZ2hpams=:"}
+	err := node.AllowHost(lvolID, HostID{NQN: hostNqns[0]}, rotated)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	for i, c := range []Credentials{rotated, creds[1]} {
+		err = target.connect(trAddr, hostNqns[i], c)
+		if err != nil {
+			t.Fatalf("host %s should connect: %s", hostNqns[i], err)
+		}
+	}
+	if len(target.keyring) != 2 {
+		t.Fatalf("replaced key not removed: %v", target.keyring)
+	}
+	err = node.DisallowHost(lvolID, HostID{NQN: hostNqns[0]})
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = target.connect(trAddr, hostNqns[1], creds[1])
+	if err != nil {
+		t.Fatalf("remaining host should connect: %s", err)
+	}
+	if len(target.keyring) != 1 {
+		t.Fatalf("keys of disallowed host not removed: %v", target.keyring)
+	}
+}
+
+func TestNVMfExistingTransport(t *testing.T) {
+	_, server := newFakeNVMfTarget(t, "", nqnPrefix+"lvol-transport", trAddr)
+	client := &rpcClient{rpcURL: server.URL, httpClient: &http.Client{Timeout: 10 * time.Second}}
+
+	// existing transport is used, options are compared
+	node, err := newNVMf(client, "TCP", trAddr, NodeOptions{Transport: TransportOptions{MaxQueueDepth: 128}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node.createTransport()
+	if err != nil {
+		t.Fatalf("createTransport: %s", err)
+	}
+	err = node.checkTransport(&transportParams{TrType: "TCP", MaxQueueDepth: 128})
+	if err != nil {
+		t.Fatalf("checkTransport: %s", err)
+	}
+	err = node.checkTransport(&transportParams{TrType: "TCP", MaxQueueDepth: 256, InCapsuleDataSize: 8192})
+	if err == nil || !strings.Contains(err.Error(), "max_queue_depth=128, expected 256") ||
+		!strings.Contains(err.Error(), "in_capsule_data_size=4096, expected 8192") {
+		t.Fatalf("checkTransport should report mismatch: %v", err)
+	}
+}
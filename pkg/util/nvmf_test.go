@@ -35,6 +35,8 @@ const (
 	rpcUser = "spdkcsiuser"
 	rpcPass = "spdkcsipass"
 	trAddr  = "127.0.0.1"
+	// second path of multipath
+	trAddr2 = "127.0.0.2"
 )
 
 func TestNVMeTCP(t *testing.T) {
@@ -43,7 +45,13 @@ func TestNVMeTCP(t *testing.T) {
 
 //nolint:cyclop // testNVMeoF exceeds cyclomatic complexity of 10
 func testNVMeoF(trType string, t *testing.T) {
-	nodeIx, err := NewSpdkNode(rpcURL, rpcUser, rpcPass, trType, trAddr)
+	opts := NodeOptions{
+		KeyDir:      t.TempDir(),
+		TargetAddrs: []string{trAddr2},
+		AnaStates:   map[string]string{trAddr2: "non_optimized"},
+		Transport:   TransportOptions{MaxQueueDepth: 128, HeaderDigest: true},
+	}
+	nodeIx, err := NewSpdkNode(rpcURL, rpcUser, rpcPass, trType, trAddr, opts)
 	if err != nil {
 		t.Fatalf("NewSpdkNode: %s", err)
 	}
@@ -64,10 +72,11 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("No free space: %s", lvs[0].Name)
 	}
 
-	lvolID, err := node.CreateVolume(lvs[0].Name, lvs[0].FreeSizeMiB)
+	lvolID, err := node.CreateVolume("csi-test-nvmf", lvs[0].Name, lvs[0].FreeSizeMiB, DefaultLvolOptions())
 	if err != nil {
 		t.Fatalf("CreateVolume: %s", err)
 	}
+	paths := &multipath{targetAddrs: []string{trAddr, trAddr2}, anaStates: opts.AnaStates}
 	err = validateVolumeCreated(node, lvolID)
 	if err != nil {
 		t.Fatalf("validateVolumeCreated: %s", err)
@@ -85,6 +94,100 @@ func testNVMeoF(trType string, t *testing.T) {
 	if err != nil {
 		t.Fatalf("validateVolumePublished: %s", err)
 	}
+	err = validateListeners(node, nqn, paths)
+	if err != nil {
+		t.Fatalf("validateListeners: %s", err)
+	}
+	volumeInfo, err := node.VolumeInfo(lvolID)
+	if err != nil {
+		t.Fatalf("VolumeInfo: %s", err)
+	}
+	if volumeInfo["targetAddr"] != trAddr || volumeInfo["targetAddrs"] != trAddr+","+trAddr2 {
+		t.Fatalf("VolumeInfo target addresses mismatch: %v", volumeInfo)
+	}
+	if volumeInfo["headerDigest"] != "true" || volumeInfo["dataDigest"] != "" {
+		t.Fatalf("VolumeInfo digests mismatch: %v", volumeInfo)
+	}
+
+	host := HostID{NQN: "nqn.2014-08.org.nvmexpress:uuid:csi-test-host"}
+	err = node.AllowHost(lvolID, host, Credentials{})
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = validateHostAllowed(node, nqn, host.NQN, true)
+	if err != nil {
+		t.Fatalf("validateHostAllowed: %s", err)
+	}
+	err = node.DisallowHost(lvolID, host)
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = validateHostAllowed(node, nqn, host.NQN, false)
+	if err != nil {
+		t.Fatalf("validateHostDisallowed: %s", err)
+	}
+
+	creds := Credentials{
+		DHChapSecret:     "DHHC-1:00:csi-test-host-secret:",
+		DHChapCtrlSecret: "DHHC-1:00:csi-test-ctrl-secret:",
+		TLSKey:           "NVMeTLSkey-1:01:csi-test-psk:",
+	}
+	err = node.AllowHost(lvolID, host, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = validateHostKeys(node, nqn, host.NQN, creds)
+	if err != nil {
+		t.Fatalf("validateHostKeys: %s", err)
+	}
+	// ANA states kept on re-created secure listeners
+	err = validateListeners(node, nqn, paths)
+	if err != nil {
+		t.Fatalf("validateListeners: %s", err)
+	}
+	// keys rotated
+	creds.DHChapSecret = "DHHC-1:00:csi-test-host-secret-2:"
+	err = node.AllowHost(lvolID, host, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = validateHostKeys(node, nqn, host.NQN, creds)
+	if err != nil {
+		t.Fatalf("validateHostKeys: %s", err)
+	}
+	// keys shared with another host of multi-node volume, and kept when
+	// keys of the first host are rotated again
+	host2 := HostID{NQN: "nqn.2014-08.org.nvmexpress:uuid:csi-test-host-2"}
+	err = node.AllowHost(lvolID, host2, creds)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	creds2 := creds
+	creds2.DHChapSecret = "DHHC-1:00:csi-test-host-secret-3:"
+	err = node.AllowHost(lvolID, host, creds2)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = validateHostKeys(node, nqn, host2.NQN, creds)
+	if err != nil {
+		t.Fatalf("validateHostKeys: %s", err)
+	}
+	err = node.DisallowHost(lvolID, host)
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = validateHostKeys(node, nqn, host2.NQN, creds)
+	if err != nil {
+		t.Fatalf("validateHostKeys: %s", err)
+	}
+	err = node.DisallowHost(lvolID, host2)
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = validateHostKeys(node, nqn, host.NQN, Credentials{})
+	if err != nil {
+		t.Fatalf("validateHostKeysRemoved: %s", err)
+	}
 
 	snapshotName := "snapshot-pvc"
 	var snapshotID string
@@ -106,6 +209,27 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateSnapshotDeleted: %s", err)
 	}
 
+	// multipath changed in place, published volume keeps its listeners
+	err = node.SetMultipath(nil, map[string]string{trAddr2: "optimized"})
+	if err == nil {
+		t.Fatal("SetMultipath should fail with ANA state of unknown address")
+	}
+	err = node.SetMultipath(nil, nil)
+	if err != nil {
+		t.Fatalf("SetMultipath: %s", err)
+	}
+	err = validateListeners(node, nqn, paths)
+	if err != nil {
+		t.Fatalf("validateListeners: %s", err)
+	}
+	volumeInfo, err = node.VolumeInfo(lvolID)
+	if err != nil {
+		t.Fatalf("VolumeInfo: %s", err)
+	}
+	if volumeInfo["targetAddrs"] != trAddr+","+trAddr2 {
+		t.Fatalf("VolumeInfo target addresses mismatch: %v", volumeInfo)
+	}
+
 	err = node.UnpublishVolume(lvolID)
 	if err != nil {
 		t.Fatalf("UnpublishVolume: %s", err)
@@ -115,6 +239,20 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateVolumeUnpublished: %s", err)
 	}
 
+	// published again through new paths
+	err = node.PublishVolume(lvolID)
+	if err != nil {
+		t.Fatalf("PublishVolume: %s", err)
+	}
+	err = validateListeners(node, nqn, &multipath{targetAddrs: []string{trAddr}})
+	if err != nil {
+		t.Fatalf("validateListeners: %s", err)
+	}
+	err = node.UnpublishVolume(lvolID)
+	if err != nil {
+		t.Fatalf("UnpublishVolume: %s", err)
+	}
+
 	err = node.DeleteVolume(lvolID)
 	if err != nil {
 		t.Fatalf("DeleteVolume: %s", err)
@@ -125,6 +263,27 @@ func testNVMeoF(trType string, t *testing.T) {
 	}
 }
 
+func TestAddressFamily(t *testing.T) {
+	for addr, family := range map[string]string{
+		"192.168.1.100":   "IPv4",
+		"::ffff:10.0.0.1": "IPv4", // IPv4-mapped
+		"fd00::100":       "IPv6",
+		"::1":             "IPv6",
+	} {
+		if addressFamily(addr) != family {
+			t.Fatalf("address family of %s: %s, expected: %s", addr, addressFamily(addr), family)
+		}
+	}
+
+	// digest is negotiated only by TCP transport
+	_, err := NewSpdkNode(rpcURL, rpcUser, rpcPass, "nvme-rdma", trAddr, NodeOptions{
+		Transport: TransportOptions{HeaderDigest: true},
+	})
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
 func validateVolumeCreated(node *nodeNVMf, lvolID string) error {
 	params := struct {
 		Name string `json:"name"`
@@ -194,3 +353,138 @@ func validateVolumeUnpublished(node *nodeNVMf, nqn string, nsID int) error {
 	}
 	return nil
 }
+
+func validateHostAllowed(node *nodeNVMf, nqn, hostNqn string, allowed bool) error {
+	var result []struct {
+		Nqn          string `json:"nqn"`
+		AllowAnyHost bool   `json:"allow_any_host"`
+		Hosts        []struct {
+			Nqn string `json:"nqn"`
+		} `json:"hosts"`
+	}
+
+	err := node.client.call("nvmf_get_subsystems", nil, &result)
+	if err != nil {
+		return err
+	}
+
+	for i := range result {
+		if result[i].Nqn != nqn {
+			continue
+		}
+		if result[i].AllowAnyHost {
+			return fmt.Errorf("any host allowed: %s", nqn)
+		}
+		found := false
+		for _, host := range result[i].Hosts {
+			found = found || host.Nqn == hostNqn
+		}
+		if found != allowed {
+			return fmt.Errorf("host %s allowed: %v, expected: %v", hostNqn, found, allowed)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("nqn not found: %s", nqn)
+}
+
+// validate keys of the host in spdk keyring and secure channel of listener,
+// host is expected to be removed if credentials are empty
+func validateHostKeys(node *nodeNVMf, nqn, hostNqn string, creds Credentials) error {
+	var subsystems []struct {
+		Nqn             string `json:"nqn"`
+		ListenAddresses []struct {
+			SecureChannel bool `json:"secure_channel"`
+		} `json:"listen_addresses"`
+		Hosts []struct {
+			Nqn            string `json:"nqn"`
+			Psk            string `json:"psk"`
+			DHChapKey      string `json:"dhchap_key"`
+			DHChapCtrlrKey string `json:"dhchap_ctrlr_key"`
+		} `json:"hosts"`
+	}
+	err := node.client.call("nvmf_get_subsystems", nil, &subsystems)
+	if err != nil {
+		return err
+	}
+	var keys []struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+	err = node.client.call("keyring_get_keys", nil, &keys)
+	if err != nil {
+		return err
+	}
+	keyring := make(map[string]string)
+	for _, key := range keys {
+		keyring[key.Name] = key.Key
+	}
+
+	if !creds.nvmeAuthEnabled() {
+		if len(keyring) != 0 {
+			return fmt.Errorf("keys not removed: %v", keyring)
+		}
+		return nil
+	}
+
+	for i := range subsystems {
+		if subsystems[i].Nqn != nqn {
+			continue
+		}
+		for _, listener := range subsystems[i].ListenAddresses {
+			if !listener.SecureChannel {
+				return fmt.Errorf("listener not secure: %v", subsystems[i].ListenAddresses)
+			}
+		}
+		for _, host := range subsystems[i].Hosts {
+			if host.Nqn != hostNqn {
+				continue
+			}
+			if keyring[host.DHChapKey] != creds.DHChapSecret ||
+				keyring[host.DHChapCtrlrKey] != creds.DHChapCtrlSecret ||
+				keyring[host.Psk] != creds.TLSKey {
+				return fmt.Errorf("host keys mismatch: %v, %v", host, keyring)
+			}
+			return nil
+		}
+		return fmt.Errorf("host not found: %s", hostNqn)
+	}
+	return fmt.Errorf("nqn not found: %s", nqn)
+}
+
+// validate subsystem listens on all target addresses, with expected ANA states
+func validateListeners(node *nodeNVMf, nqn string, paths *multipath) error {
+	params := struct {
+		Nqn string `json:"nqn"`
+	}{
+		Nqn: nqn,
+	}
+	var listeners []struct {
+		Address struct {
+			TrAddr string `json:"traddr"`
+		} `json:"address"`
+		AnaState string `json:"ana_state"`
+	}
+	err := node.client.call("nvmf_subsystem_get_listeners", &params, &listeners)
+	if err != nil {
+		return err
+	}
+
+	if len(listeners) != len(paths.targetAddrs) {
+		return fmt.Errorf("%d listeners, expected: %d", len(listeners), len(paths.targetAddrs))
+	}
+	for _, listener := range listeners {
+		addr := listener.Address.TrAddr
+		if !contains(paths.targetAddrs, addr) {
+			return fmt.Errorf("unknown listener address: %s", addr)
+		}
+		expected := paths.anaStates[addr]
+		if expected == "" {
+			expected = "optimized"
+		}
+		if listener.AnaState != expected {
+			return fmt.Errorf("ANA state of %s: %s, expected: %s", addr, listener.AnaState, expected)
+		}
+	}
+	return nil
+}
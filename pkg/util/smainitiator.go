@@ -36,7 +36,12 @@ const (
 	smaNvmfTCPSubNqnPref = "nqn.2022-04.io.spdk.csi:cnode0:uuid:"
 )
 
-func NewSpdkCsiSmaInitiator(volumeContext map[string]string, smaClient smarpc.StorageManagementAgentClient, smaTargetType string) (SpdkCsiInitiator, error) {
+// NewSpdkCsiSmaInitiator creates initiator attaching volumes through SMA,
+// which has no way to pass credentials, so they are rejected
+func NewSpdkCsiSmaInitiator(volumeContext map[string]string, creds Credentials, smaClient smarpc.StorageManagementAgentClient, smaTargetType string) (SpdkCsiInitiator, error) {
+	if !creds.empty() {
+		return nil, fmt.Errorf("authentication is not supported by SMA initiator")
+	}
 	iSmaCommon := &smaCommon{
 		smaClient:     smaClient,
 		volumeContext: volumeContext,
@@ -191,11 +196,11 @@ func (sma *smaCommon) nvmfVolumeParameters() *smarpc.VolumeParameters_Nvmf {
 // re-use the Connect() and Disconnect() functions from initiator.go
 func (i *smainitiatorNvmfTCP) initiatorNVMf() *initiatorNVMf {
 	return &initiatorNVMf{
-		targetType: smaNvmfTCPTargetType,
-		targetAddr: smaNvmfTCPTargetAddr,
-		targetPort: smaNvmfTCPTargetPort,
-		nqn:        smaNvmfTCPSubNqnPref + i.sma.volumeContext["model"],
-		model:      i.sma.volumeContext["model"],
+		targetType:  smaNvmfTCPTargetType,
+		targetAddrs: []string{smaNvmfTCPTargetAddr},
+		targetPort:  smaNvmfTCPTargetPort,
+		nqn:         smaNvmfTCPSubNqnPref + i.sma.volumeContext["model"],
+		model:       i.sma.volumeContext["model"],
 	}
 }
 
@@ -266,6 +271,11 @@ func (i *smainitiatorNvmfTCP) Connect() (string, error) {
 	return devicePath, nil
 }
 
+// For SMA NvmfTCP Rescan(), the volume is exposed through local NVMe/TCP device, so rescan it as NVMf initiator does
+func (i *smainitiatorNvmfTCP) Rescan() error {
+	return i.initiatorNVMf().Rescan()
+}
+
 // For SMA NvmfTCP Disconnect(), "nvme disconnect" will be executed first to terminate the target connection,
 // then, DetachVolume() will be called to detache the volume from the device,
 // finally, DeleteDevice() will help to delete the device created in the Connect() function.
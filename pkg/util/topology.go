@@ -0,0 +1,60 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// TopologyKeyPrefix is the prefix of kubernetes node labels reported as
+// topology segments of the node, e.g. "topology.spdk.io/rack=rack1".
+// Topology keys of spdk nodes in config map should use the same prefix.
+const TopologyKeyPrefix = "topology.spdk.io/"
+
+// GetNodeTopology returns topology segments from labels of kubernetes node.
+// rest.ErrNotInCluster is returned if not running in kubernetes cluster.
+func GetNodeTopology(nodeName string) (map[string]string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return TopologyFromLabels(node.GetLabels()), nil
+}
+
+// TopologyFromLabels returns labels with topology key prefix
+func TopologyFromLabels(labels map[string]string) map[string]string {
+	topology := make(map[string]string)
+	for key, value := range labels {
+		if strings.HasPrefix(key, TopologyKeyPrefix) {
+			topology[key] = value
+		}
+	}
+	return topology
+}
@@ -18,6 +18,7 @@ limitations under the License.
 package util_test
 
 import (
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -65,3 +66,83 @@ func TestTryLockConcurrent(t *testing.T) {
 		t.Fatal("concurrency test failed")
 	}
 }
+
+func TestTopologyFromLabels(t *testing.T) {
+	labels := map[string]string{
+		"kubernetes.io/hostname":   "node1",
+		"topology.spdk.io/rack":    "rack1",
+		"topology.spdk.io/row":     "row1",
+		"topology.kubernetes.io/z": "zone1",
+	}
+
+	topology := util.TopologyFromLabels(labels)
+	if len(topology) != 2 || topology["topology.spdk.io/rack"] != "rack1" || topology["topology.spdk.io/row"] != "row1" {
+		t.Fatalf("unexpected topology: %v", topology)
+	}
+}
+
+func TestNodeID(t *testing.T) {
+	host := util.HostID{NQN: "nqn.2014-08.org.nvmexpress:uuid:1234", IQN: "iqn.2005-03.org.open-iscsi:1234"}
+	name, decoded := util.DecodeNodeID(util.EncodeNodeID("node-1", host))
+	if name != "node-1" || decoded != host {
+		t.Fatalf("node id mismatch: %s, %v", name, decoded)
+	}
+
+	// plain node name without host id
+	if id := util.EncodeNodeID("node-1", util.HostID{}); id != "node-1" {
+		t.Fatalf("unexpected node id: %s", id)
+	}
+	// legacy node id, or node id not encoded by us, is taken as node name
+	for _, id := range []string{"node-1", "node-1.example.com", "{node-1", `{"nqn":"nqn.2014-08.org.nvmexpress:uuid:1234"}`} {
+		name, decoded = util.DecodeNodeID(id)
+		if name != id || decoded != (util.HostID{}) {
+			t.Fatalf("node id mismatch: %s, %v", name, decoded)
+		}
+	}
+	if !util.SameNode("node-1", util.EncodeNodeID("node-1", host)) || util.SameNode("node-1", util.EncodeNodeID("node-2", host)) {
+		t.Fatal("legacy node id should match encoded node id of same node only")
+	}
+
+	// too long to encode
+	host.NQN += strings.Repeat("0", 200)
+	if id := util.EncodeNodeID("node-1", host); id != "node-1" {
+		t.Fatalf("unexpected node id: %s", id)
+	}
+}
+
+func TestCredentialsFromSecrets(t *testing.T) {
+	// keys documented in storageclass.yaml
+	creds, err := util.CredentialsFromSecrets(map[string]string{
+		"chap-user":          "user",
+		"chap-secret":        "secret",
+		"mutual-chap-user":   "muser",
+		"mutual-chap-secret": "msecret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds != (util.Credentials{ChapUser: "user", ChapSecret: "secret", MutualChapUser: "muser", MutualChapSecret: "msecret"}) {
+		t.Fatalf("credentials mismatch: %v", creds)
+	}
+
+	creds, err = util.CredentialsFromSecrets(nil)
+	if err != nil || creds != (util.Credentials{}) {
+		t.Fatalf("expect empty credentials: %v, %v", creds, err)
+	}
+
+	invalidSecrets := []map[string]string{
+		{util.SecretChapUser: "user"},
+		{util.SecretChapSecret: "secret"},
+		{util.SecretMutualChapUser: "muser", util.SecretMutualChapSecret: "msecret"},
+		{util.SecretChapUser: "user", util.SecretChapSecret: "secret", util.SecretMutualChapUser: "muser"},
+		{util.SecretDHChapCtrlSecret: "DHHC-1:00:ctrl:"},
+		{util.SecretDHChapSecret: "not-dhchap-secret"},
+		{util.SecretTLSKey: "not-tls-key"},
+	}
+	for _, secrets := range invalidSecrets {
+		_, err = util.CredentialsFromSecrets(secrets)
+		if err == nil {
+			t.Fatalf("expect error: %v", secrets)
+		}
+	}
+}